@@ -0,0 +1,133 @@
+package squashfs
+
+import (
+	"container/list"
+	"sync"
+	"sync/atomic"
+)
+
+//DefaultCacheSize is the default memory budget, in bytes, of a Reader's block cache.
+const DefaultCacheSize = 16 * 1024 * 1024
+
+//CacheStats are statistics about a Reader's block cache.
+type CacheStats struct {
+	Hits      uint64 //How many times a block was found in the cache.
+	Misses    uint64 //How many times a block had to be read and decompressed.
+	Evictions uint64 //How many blocks have been removed to stay within the budget.
+	Blocks    int    //How many blocks are currently cached.
+	Size      int64  //The total size of the currently cached blocks.
+	Budget    int64  //The maximum size of the cached blocks.
+}
+
+//blockCache is a LRU cache of decompressed metadata and fragment blocks, keyed by their offset in the archive.
+//Cached data is shared, so it must never be modified.
+type blockCache struct {
+	items     map[int64]*list.Element
+	lru       *list.List //Front is the most recently used.
+	mut       sync.Mutex
+	size      int64
+	budget    int64 //Only changed while holding mut, but read atomically so a disabled cache doesn't need the lock.
+	hits      uint64
+	misses    uint64
+	evictions uint64
+}
+
+//cachedBlock is a decompressed block. next is the offset right after the block on disk.
+type cachedBlock struct {
+	data   []byte
+	offset int64
+	next   int64
+}
+
+func newBlockCache(budget int64) *blockCache {
+	return &blockCache{
+		items:  make(map[int64]*list.Element),
+		lru:    list.New(),
+		budget: budget,
+	}
+}
+
+//get returns the block at the given offset, if it's cached.
+func (c *blockCache) get(offset int64) (*cachedBlock, bool) {
+	if c.disabled() {
+		return nil, false
+	}
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	el, ok := c.items[offset]
+	if !ok {
+		c.misses++
+		return nil, false
+	}
+	c.hits++
+	c.lru.MoveToFront(el)
+	return el.Value.(*cachedBlock), true
+}
+
+//add adds the block to the cache, evicting the least recently used blocks if over budget.
+//Blocks larger then the whole budget aren't cached.
+func (c *blockCache) add(block *cachedBlock) {
+	if c.disabled() {
+		return
+	}
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	if int64(len(block.data)) > c.budget {
+		return
+	}
+	if el, ok := c.items[block.offset]; ok {
+		c.lru.MoveToFront(el)
+		return
+	}
+	c.items[block.offset] = c.lru.PushFront(block)
+	c.size += int64(len(block.data))
+	c.evict()
+}
+
+//evict removes blocks until the cache is within budget. The mutex must be held.
+func (c *blockCache) evict() {
+	for c.size > c.budget {
+		el := c.lru.Back()
+		block := c.lru.Remove(el).(*cachedBlock)
+		delete(c.items, block.offset)
+		c.size -= int64(len(block.data))
+		c.evictions++
+	}
+}
+
+func (c *blockCache) setBudget(budget int64) {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	atomic.StoreInt64(&c.budget, budget)
+	c.evict()
+}
+
+//disabled returns if the budget is 0, in which case nothing is cached and the lock isn't needed.
+func (c *blockCache) disabled() bool {
+	return atomic.LoadInt64(&c.budget) <= 0
+}
+
+func (c *blockCache) stats() CacheStats {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	return CacheStats{
+		Hits:      c.hits,
+		Misses:    c.misses,
+		Evictions: c.evictions,
+		Blocks:    c.lru.Len(),
+		Size:      c.size,
+		Budget:    c.budget,
+	}
+}
+
+//SetCacheSize sets the memory budget, in bytes, of the cache used for decompressed metadata and fragment blocks.
+//The cache is shared by everything reading from the Reader. A size of 0 disables the cache, so blocks are decompressed every time
+//they're read and CacheStats stops changing.
+func (r *Reader) SetCacheSize(size int64) {
+	r.cache.setBudget(size)
+}
+
+//CacheStats returns statistics about the Reader's block cache.
+func (r *Reader) CacheStats() CacheStats {
+	return r.cache.stats()
+}
@@ -0,0 +1,179 @@
+//Recompress writes a squashfs archive again with a different compression type, compression level, or block size.
+//Everything in the archive (including ownership, xattrs, and hard links) is kept. If nothing is changed, the compressed data is copied as is.
+//
+//If the input is an AppImage, the AppImage's runtime is copied to the beginning of the output, so the output is also an AppImage.
+//
+//Usage:
+//
+//	recompress [-comp type] [-level level] [-block size] input output
+//
+//Such as converting a gzip AppImage to zstd:
+//
+//	recompress -comp zstd app.AppImage app-zstd.AppImage
+package main
+
+import (
+	"debug/elf"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/CalebQ42/squashfs"
+)
+
+var compressionTypes = map[string]int{
+	"gzip": squashfs.GzipCompression,
+	"lzma": squashfs.LzmaCompression,
+	"lzo":  squashfs.LzoCompression,
+	"xz":   squashfs.XzCompression,
+	"lz4":  squashfs.Lz4Compression,
+	"zstd": squashfs.ZstdCompression,
+}
+
+func main() {
+	comp := flag.String("comp", "", "The compression type to use: gzip, lzma, lzo, xz, lz4, or zstd. If not set, the input's compression (and it's options) are used.")
+	level := flag.Int("level", 0, "The compression level to use with gzip or zstd. If not set, the default level is used.")
+	blockSize := flag.Int("block", 0, "The block size to use, between 4096 and 1048576. If not set, the input's block size is used.")
+	flag.Usage = func() {
+		fmt.Fprintln(flag.CommandLine.Output(), "Usage: recompress [-comp type] [-level level] [-block size] input output")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 2 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	err := recompress(flag.Arg(0), flag.Arg(1), *comp, *level, *blockSize)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+func recompress(input, output, comp string, level, blockSize int) error {
+	in, err := os.Open(input)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	stat, err := in.Stat()
+	if err != nil {
+		return err
+	}
+	if outStat, err := os.Stat(output); err == nil && os.SameFile(stat, outStat) {
+		return errors.New("The output can't be the same as the input")
+	}
+	offset, err := appImageOffset(in)
+	if err != nil {
+		return err
+	}
+	rdr, err := squashfs.NewSquashfsReader(io.NewSectionReader(in, offset, stat.Size()-offset))
+	if err != nil {
+		return err
+	}
+	w, err := squashfs.NewWriterFromReader(rdr)
+	if err != nil {
+		return err
+	}
+	compressionType := rdr.Compression()
+	if comp != "" {
+		var ok bool
+		compressionType, ok = compressionTypes[comp]
+		if !ok {
+			return errors.New("Unknown compression type " + comp)
+		}
+	}
+	if compressionType != rdr.Compression() {
+		conv, err := squashfs.NewWriterWithOptions(compressionType, false)
+		if err != nil {
+			return err
+		}
+		conv.BlockSize = w.BlockSize
+		conv.Flags = w.Flags
+		conv.CreationTime = w.CreationTime
+		err = conv.AddArchive("/", rdr)
+		if err != nil {
+			return err
+		}
+		w = conv
+	}
+	if blockSize != 0 {
+		w.BlockSize = uint32(blockSize)
+	}
+	if level != 0 {
+		switch compressionType {
+		case squashfs.GzipCompression:
+			err = w.SetGzipOptions(level, 15, 0)
+		case squashfs.ZstdCompression:
+			err = w.SetZstdOptions(level)
+		default:
+			err = errors.New("-level can only be used with gzip or zstd")
+		}
+		if err != nil {
+			return err
+		}
+	}
+	out, err := os.OpenFile(output, os.O_RDWR|os.O_CREATE|os.O_TRUNC, stat.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	//The AppImage's runtime is kept so the output is still an AppImage.
+	_, err = io.Copy(out, io.NewSectionReader(in, 0, offset))
+	if err != nil {
+		return err
+	}
+	_, err = w.WriteTo(out)
+	if err != nil {
+		return err
+	}
+	return out.Close()
+}
+
+//appImageOffset returns where the squashfs archive starts in an AppImage, which is right after the end of the ELF runtime.
+//If f isn't an ELF file, 0 is returned.
+func appImageOffset(f io.ReaderAt) (int64, error) {
+	magic := make([]byte, 4)
+	_, err := f.ReadAt(magic, 0)
+	if err != nil || string(magic) != elf.ELFMAG {
+		return 0, nil
+	}
+	runtime, err := elf.NewFile(f)
+	if err != nil {
+		return 0, err
+	}
+	//The runtime ends after the section header table (which is usually at the end), or the last section or segment.
+	//elf.File doesn't give where the section header table is, so it's read from the ELF header.
+	var offset int64
+	switch runtime.Class {
+	case elf.ELFCLASS64:
+		var hdr elf.Header64
+		err = binary.Read(io.NewSectionReader(f, 0, int64(binary.Size(hdr))), runtime.ByteOrder, &hdr)
+		offset = int64(hdr.Shoff) + int64(hdr.Shentsize)*int64(hdr.Shnum)
+	case elf.ELFCLASS32:
+		var hdr elf.Header32
+		err = binary.Read(io.NewSectionReader(f, 0, int64(binary.Size(hdr))), runtime.ByteOrder, &hdr)
+		offset = int64(hdr.Shoff) + int64(hdr.Shentsize)*int64(hdr.Shnum)
+	}
+	if err != nil {
+		return 0, err
+	}
+	for _, sec := range runtime.Sections {
+		if sec.Type != elf.SHT_NOBITS && int64(sec.Offset+sec.FileSize) > offset {
+			offset = int64(sec.Offset + sec.FileSize)
+		}
+	}
+	for _, prog := range runtime.Progs {
+		if int64(prog.Off+prog.Filesz) > offset {
+			offset = int64(prog.Off + prog.Filesz)
+		}
+	}
+	_, err = f.ReadAt(magic, offset)
+	if err != nil || string(magic) != "hsqs" {
+		return 0, errors.New("Can't find the squashfs archive in the AppImage")
+	}
+	return offset, nil
+}
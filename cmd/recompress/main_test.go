@@ -0,0 +1,255 @@
+package main
+
+import (
+	"bytes"
+	"debug/elf"
+	"encoding/binary"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/CalebQ42/squashfs"
+)
+
+//testFiles are the files in the archive made by makeArchive.
+func testFiles() map[string]string {
+	random := make([]byte, 20000)
+	rand.New(rand.NewSource(1)).Read(random)
+	return map[string]string{
+		"text.txt":       strings.Repeat("squashfs ", 3000),
+		"random.bin":     string(random),
+		"small.txt":      "small",
+		"dir/nested.txt": "nested",
+	}
+}
+
+//makeArchive writes a gzip archive with a block size of 4096, with runtime before it, and returns it's path.
+func makeArchive(t *testing.T, runtime []byte) string {
+	w, err := squashfs.NewWriter()
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.BlockSize = 4096
+	for name, data := range testFiles() {
+		err = w.AddReaderTo("/"+name, strings.NewReader(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	name := filepath.Join(t.TempDir(), "input")
+	fil, err := os.Create(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fil.Close()
+	_, err = fil.Write(runtime)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = w.WriteTo(fil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return name
+}
+
+//checkOutput checks that the archive in output, after runtime, has the given compression and block size and has all of testFiles.
+func checkOutput(t *testing.T, output string, runtime []byte, compression int, blockSize uint32) {
+	data, err := os.ReadFile(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(data, runtime) {
+		t.Fatal("The output doesn't start with the runtime")
+	}
+	archive := data[len(runtime):]
+	rdr, err := squashfs.NewSquashfsReader(bytes.NewReader(archive))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rdr.Compression() != compression {
+		t.Errorf("Output has compression %d, wanted %d", rdr.Compression(), compression)
+	}
+	//The block size is right after the magic, inode count, and creation time.
+	if size := binary.LittleEndian.Uint32(archive[12:]); size != blockSize {
+		t.Errorf("Output has block size %d, wanted %d", size, blockSize)
+	}
+	for name, want := range testFiles() {
+		got, err := rdr.ReadFile(name)
+		if err != nil {
+			t.Fatal(name, err)
+		}
+		if string(got) != want {
+			t.Errorf("%s content doesn't match", name)
+		}
+	}
+}
+
+//fakeRuntime64 is a little-endian 64 bit ELF file with a .shstrtab section and a segment that goes past the end of the sections,
+//so the AppImage's archive starts at the end of the segment.
+func fakeRuntime64() []byte {
+	strtab := []byte("\x00.shstrtab\x00")
+	hdr := elf.Header64{
+		Type:      uint16(elf.ET_EXEC),
+		Machine:   uint16(elf.EM_X86_64),
+		Version:   uint32(elf.EV_CURRENT),
+		Phoff:     64,
+		Shoff:     64 + 56,
+		Ehsize:    64,
+		Phentsize: 56,
+		Phnum:     1,
+		Shentsize: 64,
+		Shnum:     2,
+		Shstrndx:  1,
+	}
+	copy(hdr.Ident[:], elf.ELFMAG)
+	hdr.Ident[elf.EI_CLASS] = byte(elf.ELFCLASS64)
+	hdr.Ident[elf.EI_DATA] = byte(elf.ELFDATA2LSB)
+	hdr.Ident[elf.EI_VERSION] = byte(elf.EV_CURRENT)
+	strtabOffset := hdr.Shoff + 2*64
+	end := strtabOffset + uint64(len(strtab)) + 13
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.LittleEndian, hdr)
+	binary.Write(&buf, binary.LittleEndian, elf.Prog64{
+		Type:   uint32(elf.PT_LOAD),
+		Flags:  uint32(elf.PF_R),
+		Filesz: end,
+		Memsz:  end,
+	})
+	binary.Write(&buf, binary.LittleEndian, elf.Section64{})
+	binary.Write(&buf, binary.LittleEndian, elf.Section64{
+		Name: 1,
+		Type: uint32(elf.SHT_STRTAB),
+		Off:  strtabOffset,
+		Size: uint64(len(strtab)),
+	})
+	buf.Write(strtab)
+	buf.Write(make([]byte, int(end)-buf.Len()))
+	return buf.Bytes()
+}
+
+//fakeRuntime32 is a big-endian 32 bit ELF file without any segments, with the section header table at the end.
+func fakeRuntime32() []byte {
+	strtab := []byte("\x00.shstrtab\x00")
+	hdr := elf.Header32{
+		Type:      uint16(elf.ET_EXEC),
+		Machine:   uint16(elf.EM_PPC),
+		Version:   uint32(elf.EV_CURRENT),
+		Shoff:     52 + uint32(len(strtab)),
+		Ehsize:    52,
+		Shentsize: 40,
+		Shnum:     2,
+		Shstrndx:  1,
+	}
+	copy(hdr.Ident[:], elf.ELFMAG)
+	hdr.Ident[elf.EI_CLASS] = byte(elf.ELFCLASS32)
+	hdr.Ident[elf.EI_DATA] = byte(elf.ELFDATA2MSB)
+	hdr.Ident[elf.EI_VERSION] = byte(elf.EV_CURRENT)
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.BigEndian, hdr)
+	buf.Write(strtab)
+	binary.Write(&buf, binary.BigEndian, elf.Section32{})
+	binary.Write(&buf, binary.BigEndian, elf.Section32{
+		Name: 1,
+		Type: uint32(elf.SHT_STRTAB),
+		Off:  52,
+		Size: uint32(len(strtab)),
+	})
+	return buf.Bytes()
+}
+
+func TestRecompress(t *testing.T) {
+	tests := []struct {
+		name        string
+		runtime     []byte
+		comp        string
+		level       int
+		blockSize   int
+		compression int
+		wantSize    uint32
+	}{
+		{"copy", nil, "", 0, 0, squashfs.GzipCompression, 4096},
+		{"gzip to zstd", nil, "zstd", 0, 0, squashfs.ZstdCompression, 4096},
+		{"zstd level", nil, "zstd", 3, 0, squashfs.ZstdCompression, 4096},
+		{"block size", nil, "", 0, 8192, squashfs.GzipCompression, 8192},
+		{"gzip level and block size", nil, "gzip", 6, 16384, squashfs.GzipCompression, 16384},
+		{"64 bit AppImage", fakeRuntime64(), "zstd", 0, 0, squashfs.ZstdCompression, 4096},
+		{"32 bit AppImage", fakeRuntime32(), "xz", 0, 8192, squashfs.XzCompression, 8192},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			input := makeArchive(t, test.runtime)
+			output := filepath.Join(t.TempDir(), "output")
+			err := recompress(input, output, test.comp, test.level, test.blockSize)
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkOutput(t, output, test.runtime, test.compression, test.wantSize)
+		})
+	}
+}
+
+func TestRecompressErrors(t *testing.T) {
+	dir := t.TempDir()
+	input := makeArchive(t, nil)
+	for _, test := range []struct {
+		name  string
+		comp  string
+		level int
+	}{
+		{"unknown compression", "zip", 0},
+		{"lzo level", "lzo", 3},
+		{"lz4 level", "lz4", 3},
+	} {
+		err := recompress(input, filepath.Join(dir, "output"), test.comp, test.level, 0)
+		if err == nil {
+			t.Error(test.name, "didn't return an error")
+		}
+	}
+	if recompress(input, input, "zstd", 0, 0) == nil {
+		t.Error("Using the input as the output didn't return an error")
+	}
+	//A truncated ELF header, and an ELF file without an archive after it, can't be read.
+	runtime := fakeRuntime64()
+	for name, data := range map[string][]byte{
+		"truncated":  runtime[:40],
+		"no archive": runtime,
+	} {
+		fil := filepath.Join(dir, "runtime")
+		err := os.WriteFile(fil, data, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if recompress(fil, filepath.Join(dir, "output"), "", 0, 0) == nil {
+			t.Error(name, "ELF file didn't return an error")
+		}
+	}
+}
+
+func TestAppImageOffset(t *testing.T) {
+	for name, runtime := range map[string][]byte{
+		"64 bit": fakeRuntime64(),
+		"32 bit": fakeRuntime32(),
+	} {
+		_, err := elf.NewFile(bytes.NewReader(runtime))
+		if err != nil {
+			t.Fatal(name, "runtime isn't a valid ELF file:", err)
+		}
+		data := append(append([]byte{}, runtime...), "hsqs"...)
+		offset, err := appImageOffset(bytes.NewReader(data))
+		if err != nil || offset != int64(len(runtime)) {
+			t.Errorf("%s runtime returned %d, %v, wanted %d", name, offset, err, len(runtime))
+		}
+	}
+	offset, err := appImageOffset(strings.NewReader("hsqs"))
+	if err != nil || offset != 0 {
+		t.Errorf("An archive without a runtime returned %d, %v", offset, err)
+	}
+	_, err = appImageOffset(io.NewSectionReader(bytes.NewReader(fakeRuntime32()), 0, 30))
+	if err == nil {
+		t.Error("A truncated ELF header didn't return an error")
+	}
+}
@@ -1,17 +1,46 @@
 package squashfs
 
-import "reflect"
+import "encoding/binary"
 
-func (w *Writer) compressData(data []byte) ([]byte, error) {
-	if reflect.DeepEqual(data, make([]byte, len(data))) {
-		return nil, nil
-	}
+//compressData compresses the given data. If compressing doesn't make the data smaller, the data is returned as is, with compressed set to false.
+func (w *Writer) compressData(data []byte) (out []byte, compressed bool, err error) {
 	compressedData, err := w.compressor.Compress(data)
 	if err != nil {
-		return nil, err
+		return nil, false, err
 	}
 	if len(data) <= len(compressedData) {
-		return data, nil
+		return data, false, nil
+	}
+	return compressedData, true, nil
+}
+
+//metadataBlock returns data (which must be at most 8KB) as a metadata block, including it's header.
+func (w *Writer) metadataBlock(data []byte, uncompressed bool) ([]byte, error) {
+	header := uint16(len(data))
+	if !uncompressed {
+		var compressed bool
+		var err error
+		data, compressed, err = w.compressData(data)
+		if err != nil {
+			return nil, err
+		}
+		uncompressed = !compressed
+		header = uint16(len(data))
+	}
+	if uncompressed {
+		header |= 0x8000
+	}
+	out := make([]byte, 2, 2+len(data))
+	binary.LittleEndian.PutUint16(out, header)
+	return append(out, data...), nil
+}
+
+//isZeros returns whether data is all zeros. All zero data blocks are stored as sparse blocks.
+func isZeros(data []byte) bool {
+	for _, b := range data {
+		if b != 0 {
+			return false
+		}
 	}
-	return compressedData, nil
+	return true
 }
@@ -17,64 +17,54 @@ var (
 
 //DataReader reads data from data blocks.
 type dataReader struct {
-	r             *Reader
-	curData       []byte
-	sizes         []uint32
-	offset        int64 //offset relative to the beginning of the squash file
-	curBlock      int   //Which block in sizes is currently cached
-	curReadOffset int   //offset relative to the currently cached data
+	r        *Reader
+	sizes    []uint32
+	offsets  []int64 //offsets[i] is where block i starts, relative to the beginning of the squash file. Precomputed from sizes.
+	dataSize int64   //dataSize is how much data is held in the blocks. Only really matters for sparse blocks.
 }
 
-//NewDataReader creates a new data reader at the given offset, with the blocks defined by sizes
-func (r *Reader) newDataReader(offset int64, sizes []uint32) (*dataReader, error) {
+//NewDataReader creates a new data reader at the given offset, with the blocks defined by sizes.
+//dataSize is the total amount of uncompressed data held in the blocks.
+func (r *Reader) newDataReader(offset int64, sizes []uint32, dataSize int64) *dataReader {
 	var dr dataReader
 	dr.r = r
-	dr.offset = offset
 	dr.sizes = sizes
-	err := dr.readCurBlock()
-	if err != nil {
-		return nil, err
+	dr.dataSize = dataSize
+	dr.offsets = make([]int64, len(sizes))
+	for i := range sizes {
+		dr.offsets[i] = offset
+		offset += int64(actualDataSize(sizes[i]))
 	}
-	return &dr, nil
+	return &dr
 }
 
 //NewDataReaderFromInode creates a new DataReader from a given inode. Inode must be of BasicFile or ExtendedFile types
 func (r *Reader) newDataReaderFromInode(i *inode.Inode) (*dataReader, error) {
-	var rdr dataReader
-	rdr.r = r
+	var offset int64
+	var sizes []uint32
+	var size int64
 	switch i.Type {
 	case inode.FileType:
 		fil := i.Info.(inode.File)
-		if fil.BlockStart == 0 {
-			return nil, errInodeOnlyFragment
-		}
-		rdr.offset = int64(fil.BlockStart)
-		for _, sizes := range fil.BlockSizes {
-			rdr.sizes = append(rdr.sizes, sizes)
-		}
-		if fil.Fragmented {
-			rdr.sizes = rdr.sizes[:len(rdr.sizes)-1]
-		}
+		offset = int64(fil.BlockStart)
+		sizes = fil.BlockSizes
+		size = int64(fil.Size)
 	case inode.ExtFileType:
 		fil := i.Info.(inode.ExtFile)
-		if fil.BlockStart == 0 {
-			return nil, errInodeOnlyFragment
-		}
-		rdr.offset = int64(fil.BlockStart)
-		for _, sizes := range fil.BlockSizes {
-			rdr.sizes = append(rdr.sizes, sizes)
-		}
-		if fil.Fragmented {
-			rdr.sizes = rdr.sizes[:len(rdr.sizes)-1]
-		}
+		offset = int64(fil.BlockStart)
+		sizes = fil.BlockSizes
+		size = int64(fil.Size)
 	default:
 		return nil, errInodeNotFile
 	}
-	err := rdr.readCurBlock()
-	if err != nil {
-		return nil, err
+	if len(sizes) == 0 {
+		return nil, errInodeOnlyFragment
+	}
+	dataSize := int64(len(sizes)) * int64(r.super.BlockSize)
+	if dataSize > size {
+		dataSize = size
 	}
-	return &rdr, nil
+	return r.newDataReader(offset, sizes, dataSize), nil
 }
 
 //removed the compression bit from a data block size
@@ -82,30 +72,13 @@ func actualDataSize(size uint32) uint32 {
 	return size &^ (1 << 24)
 }
 
-func (d *dataReader) readNextBlock() error {
-	d.curBlock++
-	if d.curBlock >= len(d.sizes) {
-		d.curBlock--
-		return io.EOF
-	}
-	err := d.readCurBlock()
-	if err != nil {
-		d.curBlock--
-		d.readCurBlock()
-		return err
-	}
-	return nil
-}
-
-func (d *dataReader) readBlockAt(offset int64, size uint32) ([]byte, error) {
+//readDataBlock reads, and if necessary decompresses, the data block at the given offset.
+func (r *Reader) readDataBlock(offset int64, size uint32) ([]byte, error) {
 	compressed := size&(1<<24) != (1 << 24)
-	size = size &^ (1 << 24)
-	if d.sizes[d.curBlock] == 0 {
-		return make([]byte, d.r.super.BlockSize), nil
-	}
-	sec := io.NewSectionReader(d.r.r, offset, int64(size))
+	size = actualDataSize(size)
+	sec := io.NewSectionReader(r.r, offset, int64(size))
 	if compressed {
-		btys, err := d.r.decompressor.Decompress(sec)
+		btys, err := r.decompressor.Decompress(sec)
 		if err != nil {
 			return nil, err
 		}
@@ -119,73 +92,30 @@ func (d *dataReader) readBlockAt(offset int64, size uint32) ([]byte, error) {
 	return buf.Bytes(), nil
 }
 
-func (d *dataReader) offsetForBlock(index int) int64 {
-	out := d.offset
-	for i := 0; i < index; i++ {
-		out += int64(actualDataSize(d.sizes[i]))
-	}
-	return out
-}
-
-func (d *dataReader) readCurBlock() error {
-	if d.curBlock >= len(d.sizes) {
-		return io.EOF
-	}
-	offset := d.offsetForBlock(d.curBlock)
-	data, err := d.readBlockAt(offset, d.sizes[d.curBlock])
-	if err != nil {
-		return err
-	}
-	d.curData = data
-	return nil
-}
-
-func (d *dataReader) Read(p []byte) (int, error) {
-	if d.curData == nil {
-		err := d.readCurBlock()
-		if err != nil {
-			return 0, err
+//readBlock returns the uncompressed data of the block at the given index.
+func (d *dataReader) readBlock(index int) ([]byte, error) {
+	if index >= len(d.sizes) {
+		return nil, io.EOF
+	}
+	if d.sizes[index] == 0 {
+		//sparse block
+		size := d.dataSize - int64(index)*int64(d.r.super.BlockSize)
+		if size > int64(d.r.super.BlockSize) {
+			size = int64(d.r.super.BlockSize)
 		}
+		return make([]byte, size), nil
 	}
-	if d.curReadOffset+len(p) <= len(d.curData) {
-		for i := 0; i < len(p); i++ {
-			p[i] = d.curData[d.curReadOffset+i]
-		}
-		d.curReadOffset += len(p)
-		return len(p), nil
-	}
-	read := 0
-	for read < len(p) {
-		if d.curReadOffset == len(d.curData) {
-			err := d.readNextBlock()
-			if err != nil {
-				return read, err
-			}
-			d.curReadOffset = 0
-		}
-		for ; read < len(p); read++ {
-			if d.curReadOffset < len(d.curData) {
-				p[read] = d.curData[d.curReadOffset]
-			} else {
-				break
-			}
-			d.curReadOffset++
-		}
-	}
-	if read != len(p) {
-		return read, errors.New("Didn't read enough data")
-	}
-	return read, nil
+	return d.r.readDataBlock(d.offsets[index], d.sizes[index])
 }
 
-// WriteTo writes all the data in the datablock to the writer. MUST BE USED ON A FRESH DATA READER.
+// WriteTo writes all the data in the datablock to the writer.
 func (d *dataReader) WriteTo(w io.Writer) (int64, error) {
 	type dataCache struct {
 		err   error
 		data  []byte
 		index int
 	}
-	dataChan := make(chan *dataCache)
+	dataChan := make(chan *dataCache, len(d.sizes))
 	for i := range d.sizes {
 		go func(index int, c chan *dataCache) {
 			var cache dataCache
@@ -193,7 +123,7 @@ func (d *dataReader) WriteTo(w io.Writer) (int64, error) {
 			defer func() {
 				c <- &cache
 			}()
-			data, err := d.readBlockAt(d.offsetForBlock(index), d.sizes[index])
+			data, err := d.readBlock(index)
 			if err != nil {
 				cache.err = err
 				return
@@ -0,0 +1,162 @@
+package squashfs
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+
+	"github.com/CalebQ42/squashfs/internal/inode"
+)
+
+//noExportTable is the ExportTableStart value when there is no export table.
+const noExportTable = 0xFFFFFFFFFFFFFFFF
+
+var (
+	//ErrNotExportable is returned when looking up inodes by number in an archive without an export table.
+	ErrNotExportable = errors.New("Archive doesn't have an export table")
+	//ErrInodeNumber is returned when an inode number is outside the range of the archive's inodes.
+	errInodeNumber = errors.New("Inode number out of range")
+)
+
+//readExportTable reads the locations of the metadata blocks holding the export table.
+func (r *Reader) readExportTable() error {
+	if !r.flags.Exportable || r.super.ExportTableStart == noExportTable {
+		return nil
+	}
+	r.exportOffsets = make([]uint64, int(math.Ceil(float64(r.super.InodeCount)/1024)))
+	return binary.Read(io.NewSectionReader(r.r, int64(r.super.ExportTableStart), int64(8*len(r.exportOffsets))), binary.LittleEndian, &r.exportOffsets)
+}
+
+//InodeByNumber returns the inode reference of the inode with the given number using the export table.
+//Inode numbers start at 1. If the archive doesn't have an export table, ErrNotExportable is returned.
+func (r *Reader) InodeByNumber(n uint32) (uint64, error) {
+	if r.exportOffsets == nil {
+		return 0, ErrNotExportable
+	}
+	if n == 0 || n > r.super.InodeCount {
+		return 0, errInodeNumber
+	}
+	rdr, err := r.newMetadataReader(int64(r.exportOffsets[(n-1)/1024]))
+	if err != nil {
+		return 0, err
+	}
+	_, err = rdr.Seek(int64(8*((n-1)%1024)), io.SeekStart)
+	if err != nil {
+		return 0, err
+	}
+	var ref uint64
+	err = binary.Read(rdr, binary.LittleEndian, &ref)
+	return ref, err
+}
+
+//inodeByNumber reads the inode with the given number.
+func (r *Reader) inodeByNumber(n uint32) (*inode.Inode, error) {
+	ref, err := r.InodeByNumber(n)
+	if err != nil {
+		return nil, err
+	}
+	rdr, err := r.newMetadataReaderFromInodeRef(ref)
+	if err != nil {
+		return nil, err
+	}
+	return inode.ProcessInode(rdr, r.super.BlockSize)
+}
+
+//FileByInodeNumber returns the File with the given inode number using the export table.
+//
+//If the File is a directory, it's full path (and Parent) is rebuilt using the parent inode numbers stored in directories.
+//Other types of files don't store their parent, so the returned File will have an empty Name and Path.
+func (r *Reader) FileByInodeNumber(n uint32) (*File, error) {
+	in, err := r.inodeByNumber(n)
+	if err != nil {
+		return nil, err
+	}
+	if in.Type == inode.DirType || in.Type == inode.ExtDirType {
+		return r.dirByInode(in)
+	}
+	return &File{
+		r:       r,
+		in:      in,
+		filType: in.Type,
+	}, nil
+}
+
+//PathByInodeNumber returns the full path of the directory with the given inode number, using the export table and the
+//parent inode numbers stored in directories.
+func (r *Reader) PathByInodeNumber(n uint32) (string, error) {
+	in, err := r.inodeByNumber(n)
+	if err != nil {
+		return "", err
+	}
+	if in.Type != inode.DirType && in.Type != inode.ExtDirType {
+		return "", errNotDirectory
+	}
+	fil, err := r.dirByInode(in)
+	if err != nil {
+		return "", err
+	}
+	return fil.Path(), nil
+}
+
+//dirByInode creates a File for the given directory inode, creating it's Parents by following the parent inode numbers to the root.
+func (r *Reader) dirByInode(in *inode.Inode) (*File, error) {
+	root, err := r.GetRootFolder()
+	if err != nil {
+		return nil, err
+	}
+	//names from the directory to the root.
+	var names []string
+	cur := in
+	for cur.Header.Number != root.in.Header.Number {
+		if len(names) > int(r.super.InodeCount) {
+			return nil, errors.New("Directory parents form a loop")
+		}
+		var parent *inode.Inode
+		parent, err = r.inodeByNumber(parentInodeNumber(cur))
+		if err != nil {
+			return nil, err
+		}
+		var name string
+		name, err = r.nameInDir(parent, cur.Header.Number)
+		if err != nil {
+			return nil, err
+		}
+		names = append(names, name)
+		cur = parent
+	}
+	fil := root
+	for i := len(names) - 1; i >= 0; i-- {
+		fil, err = fil.getChild(names[i])
+		if err != nil {
+			return nil, err
+		}
+	}
+	return fil, nil
+}
+
+//nameInDir returns the name of the entry in the given directory with the given inode number.
+func (r *Reader) nameInDir(dir *inode.Inode, n uint32) (string, error) {
+	d, err := r.readDirFromInode(dir)
+	if err != nil {
+		return "", err
+	}
+	for _, entry := range d.Entries {
+		if uint32(int64(entry.Header.InodeNumber)+int64(entry.EntryRaw.InodeOffset)) == n {
+			return entry.Name, nil
+		}
+	}
+	return "", errors.New("Directory entry not found in parent directory")
+}
+
+//parentInodeNumber returns the inode number of a directory's parent.
+func parentInodeNumber(in *inode.Inode) uint32 {
+	switch in.Type {
+	case inode.DirType:
+		return in.Info.(inode.Dir).ParentInodeNumber
+	case inode.ExtDirType:
+		return in.Info.(inode.ExtDir).ParentInodeNumber
+	default:
+		return 0
+	}
+}
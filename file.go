@@ -4,17 +4,18 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"os"
 	"path"
+	"sort"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/CalebQ42/squashfs/internal/directory"
 	"github.com/CalebQ42/squashfs/internal/inode"
 )
 
-//TODO: implement fs.FS, fs.ReadDirFile, fs.ReadFileFS, fs.StatFS, fs.SubFS with 1.16
-
 var (
 	//ErrNotDirectory is returned when you're trying to do directory things with a non-directory
 	errNotDirectory = errors.New("File is not a directory")
@@ -22,6 +23,10 @@ var (
 	errNotFile = errors.New("File is not a file")
 	//ErrNotReading is returned when running functions that are only meant to be used when reading a squashfs
 	errNotReading = errors.New("Function only supported when reading a squashfs")
+	//ErrTooManySymlinks is returned when resolving a path goes through too many symlinks. Probably a symlink loop.
+	errTooManySymlinks = errors.New("Too many levels of symlinks")
+	//errMknodUnsupported is returned when trying to create a device, FIFO, or socket on a platform that isn't supported.
+	errMknodUnsupported = errors.New("Creating devices, FIFOs, and sockets is only supported on Linux")
 	//ErrBrokenSymlink is returned when using ExtractWithOptions with the unbreakSymlink set to true, but the symlink's file cannot be extracted.
 	ErrBrokenSymlink = errors.New("Extracted symlink is probably broken")
 )
@@ -34,43 +39,73 @@ var (
 //will be significantly faster then calling Read directly.
 //Ex: use io.Sys().(io.Reader) for io.Copy instead of using the File directly.
 //
-//Implements os.FileInfo and io.Reader
+//Files from a directory don't read their inode until it's needed (Info, Size, Mode, ModTime, reading data, etc).
+//Name, Type, IsDir, IsSymlink, and IsFile only use the directory entry, so listing a directory with ReadDir is cheap.
+//
+//Implements os.FileInfo, fs.DirEntry, fs.ReadDirFile, io.Reader, io.ReaderAt, and io.Seeker
 type File struct {
-	reader  io.Reader
-	Parent  *File
-	r       *Reader //Underlying reader. When writing, will probably be an os.File. When reading this is kept nil UNTIL reading to save memory.
-	in      *inode.Inode
-	name    string
-	dir     string
-	filType int //The file's type, using inode types.
+	reader     *fileReader
+	Parent     *File
+	r          *Reader      //Underlying reader. When writing, will probably be an os.File. When reading this is kept nil UNTIL reading to save memory.
+	in         *inode.Inode //The file's inode. If nil, the inode hasn't been read yet and is read through lazy.
+	lazy       *lazyInode
+	dirEntries []fs.DirEntry //Children of the directory, populated on the first call to ReadDir.
+	name       string
+	dir        string
+	filType    int //The file's type, using inode types. Set from the directory entry, so it's the basic type even when the inode is extended.
+	dirRead    int //How many of dirEntries have been returned by ReadDir.
+}
 
+//lazyInode is the location of a File's inode that hasn't been read yet. It's shared between copies of the File so it's only read once.
+type lazyInode struct {
+	in   *inode.Inode
+	err  error
+	once sync.Once
+	ref  uint64
 }
 
-//get a File from a directory.entry
+//get a File from a directory.entry. The File's inode isn't read until it's needed.
 func (r *Reader) newFileFromDirEntry(entry *directory.Entry) (fil *File, err error) {
 	fil = new(File)
-	fil.in, err = r.getInodeFromEntry(entry)
-	if err != nil {
-		return nil, err
+	fil.lazy = &lazyInode{
+		ref: uint64(entry.Header.InodeOffset)<<16 | uint64(entry.Offset),
 	}
 	fil.name = entry.Name
 	fil.r = r
-	fil.filType = fil.in.Type
+	fil.filType = int(entry.Type)
 	return
 }
 
+//getInode returns the File's inode, reading it if it hasn't been already.
+func (f *File) getInode() (*inode.Inode, error) {
+	if f.in != nil {
+		return f.in, nil
+	}
+	if f.lazy == nil || f.r == nil {
+		return nil, errNotReading
+	}
+	f.lazy.once.Do(func() {
+		f.lazy.in, f.lazy.err = f.r.readInode(f.lazy.ref)
+	})
+	return f.lazy.in, f.lazy.err
+}
+
 //Name is the file's name
 func (f *File) Name() string {
 	return f.name
 }
 
-//Size is the complete size of the file. Zero if it's not a file.
+//Size is the complete size of the file. Zero if it's not a file or if the inode can't be read.
 func (f *File) Size() int64 {
-	switch f.filType {
+	in, err := f.getInode()
+	if err != nil {
+		return 0
+	}
+	switch in.Type {
 	case inode.FileType:
-		return int64(f.in.Info.(inode.File).Size)
+		return int64(in.Info.(inode.File).Size)
 	case inode.ExtFileType:
-		return int64(f.in.Info.(inode.ExtFile).Size)
+		return int64(in.Info.(inode.ExtFile).Size)
 	default:
 		return 0
 	}
@@ -78,7 +113,29 @@ func (f *File) Size() int64 {
 
 //ModTime is the time of last modification.
 func (f *File) ModTime() time.Time {
-	return time.Unix(int64(f.in.Header.ModifiedTime), 0)
+	in, err := f.getInode()
+	if err != nil {
+		return time.Time{}
+	}
+	return time.Unix(int64(in.Header.ModifiedTime), 0)
+}
+
+//UID returns the uid of the File's owner. If the inode can't be read, returns 0.
+func (f *File) UID() int {
+	in, err := f.getInode()
+	if err != nil || f.r == nil || int(in.Header.UID) >= len(f.r.idTable) {
+		return 0
+	}
+	return int(f.r.idTable[in.Header.UID])
+}
+
+//GID returns the gid of the File's group. If the inode can't be read, returns 0.
+func (f *File) GID() int {
+	in, err := f.getInode()
+	if err != nil || f.r == nil || int(in.Header.GID) >= len(f.r.idTable) {
+		return 0
+	}
+	return int(f.r.idTable[in.Header.GID])
 }
 
 //Sys returns the underlying reader. If the reader isn't initialized, it will initialize it.
@@ -87,28 +144,101 @@ func (f *File) Sys() interface{} {
 	if !f.IsFile() {
 		return nil
 	}
-	if f.reader == nil && f.r != nil {
-		var err error
-		f.reader, err = f.r.newFileReader(f.in)
-		if err != nil {
-			return nil
-		}
+	if f.initReader() != nil {
+		return nil
 	}
 	return f.reader
 }
 
-//TODO: Implement below when 1.16 drops to satisfy fs.File
+//initReader creates the underlying reader if it hasn't been already.
+func (f *File) initReader() error {
+	if f.reader != nil {
+		return nil
+	}
+	if f.r == nil {
+		return errNotReading
+	}
+	in, err := f.getInode()
+	if err != nil {
+		return err
+	}
+	f.reader, err = f.r.newFileReader(in)
+	return err
+}
 
 //Stat simply returns the file. It's simply here to satisfy fs.File
-// func (f *File) Stat() (fs.FileInfo, error) {
-// 	return f, nil
-// }
+func (f *File) Stat() (fs.FileInfo, error) {
+	return f, nil
+}
 
-//Close does nothing. It's simply here to satisfy fs.File
-//TODO: add actual implementation
-// func (f *File) Close() error {
-// 	return nil
-// }
+//Info returns the file after making sure it's inode can be read. It's simply here to satisfy fs.DirEntry
+func (f *File) Info() (fs.FileInfo, error) {
+	_, err := f.getInode()
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+//Type returns the type bits of the File's mode. It's simply here to satisfy fs.DirEntry
+//The type is known from the directory entry, so the File's inode is not read.
+func (f *File) Type() fs.FileMode {
+	switch {
+	case f.IsDir():
+		return os.ModeDir
+	case f.IsSymlink():
+		return os.ModeSymlink
+	case f.IsCharDevice():
+		return os.ModeDevice | os.ModeCharDevice
+	case f.IsDevice():
+		return os.ModeDevice
+	case f.IsFifo():
+		return os.ModeNamedPipe
+	case f.IsSocket():
+		return os.ModeSocket
+	default:
+		return 0
+	}
+}
+
+//Close resets the File's read position, both for reading data and for ReadDir.
+func (f *File) Close() error {
+	f.reader = nil
+	f.dirEntries = nil
+	f.dirRead = 0
+	return nil
+}
+
+//ReadDir returns the next n entries of the directory, sorted by name. If n <= 0, all remaining entries are returned.
+//Implements fs.ReadDirFile.
+func (f *File) ReadDir(n int) ([]fs.DirEntry, error) {
+	if !f.IsDir() {
+		return nil, errNotDirectory
+	}
+	if f.dirEntries == nil {
+		children, err := f.GetChildren()
+		if err != nil {
+			return nil, err
+		}
+		f.dirEntries = make([]fs.DirEntry, len(children))
+		for i := range children {
+			f.dirEntries[i] = children[i]
+		}
+	}
+	remaining := f.dirEntries[f.dirRead:]
+	if n <= 0 {
+		f.dirRead = len(f.dirEntries)
+		return remaining, nil
+	}
+	if len(remaining) == 0 {
+		return nil, io.EOF
+	}
+	if n > len(remaining) {
+		n = len(remaining)
+	}
+	f.dirRead += n
+	return remaining[:n], nil
+}
 
 //GetChildren returns a *squashfs.File slice of every direct child of the directory. If the File is not a directory, will return ErrNotDirectory
 func (f *File) GetChildren() (children []*File, err error) {
@@ -119,7 +249,11 @@ func (f *File) GetChildren() (children []*File, err error) {
 	if !f.IsDir() {
 		return nil, errNotDirectory
 	}
-	dir, err := f.r.readDirFromInode(f.in)
+	in, err := f.getInode()
+	if err != nil {
+		return
+	}
+	dir, err := f.r.readDirFromInode(in)
 	if err != nil {
 		return
 	}
@@ -198,6 +332,13 @@ func (f *File) GetFileAtPath(dirPath string) *File {
 		}
 		return nil
 	}
+	if !strings.ContainsAny(split[0], `*?[\`) {
+		child, err := f.getChild(split[0])
+		if err != nil {
+			return nil
+		}
+		return child.GetFileAtPath(strings.Join(split[1:], "/"))
+	}
 	children, err := f.GetChildren()
 	if err != nil {
 		return nil
@@ -211,16 +352,6 @@ func (f *File) GetFileAtPath(dirPath string) *File {
 	return nil
 }
 
-//TODO: add with 1.16
-//Open is the same as GetFileAtPath to implement fs.FS
-// func (f *File) Open(name string) (fs.File, error) {
-// 	tmp := f.GetFileAtPath(name)
-// 	if tmp == nil {
-// 		return tmp, fs.ErrNotExist
-// 	}
-// 	return tmp, nil
-// }
-
 //IsDir returns if the file is a directory.
 func (f *File) IsDir() bool {
 	return f.filType == inode.DirType || f.filType == inode.ExtDirType
@@ -236,14 +367,51 @@ func (f *File) IsFile() bool {
 	return f.filType == inode.FileType || f.filType == inode.ExtFileType
 }
 
+//IsDevice returns if the file is a block or character device.
+func (f *File) IsDevice() bool {
+	return f.filType == inode.BlockDevType || f.filType == inode.ExtBlockDeviceType || f.IsCharDevice()
+}
+
+//IsCharDevice returns if the file is a character device.
+func (f *File) IsCharDevice() bool {
+	return f.filType == inode.CharDevType || f.filType == inode.ExtCharDeviceType
+}
+
+//IsFifo returns if the file is a FIFO (named pipe).
+func (f *File) IsFifo() bool {
+	return f.filType == inode.FifoType || f.filType == inode.ExtFifoType
+}
+
+//IsSocket returns if the file is a socket.
+func (f *File) IsSocket() bool {
+	return f.filType == inode.SocketType || f.filType == inode.ExtSocketType
+}
+
+//Rdev returns the device number of a block or character device, encoded the same way as syscall.Stat_t's Rdev on Linux
+//(so the major and minor numbers can be found with unix.Major and unix.Minor). If the file isn't a device, returns 0.
+func (f *File) Rdev() uint64 {
+	if !f.IsDevice() {
+		return 0
+	}
+	in, err := f.getInode()
+	if err != nil {
+		return 0
+	}
+	return uint64(deviceNumber(in))
+}
+
 //SymlinkPath returns the path the symlink is pointing to. If the file ISN'T a symlink, will return an empty string.
 //If a path begins with "/" then the symlink is pointing to an absolute path (starting from root, and not a file inside the archive)
 func (f *File) SymlinkPath() string {
-	switch f.filType {
+	in, err := f.getInode()
+	if err != nil {
+		return ""
+	}
+	switch in.Type {
 	case inode.SymType:
-		return f.in.Info.(inode.Sym).Path
+		return in.Info.(inode.Sym).Path
 	case inode.ExtSymType:
-		return f.in.Info.(inode.ExtSym).Path
+		return in.Info.(inode.ExtSym).Path
 	default:
 		return ""
 	}
@@ -283,23 +451,21 @@ func (f *File) GetSymlinkFileRecursive() *File {
 }
 
 //Mode returns the os.FileMode of the File. Sets mode bits for directories and symlinks.
+//If the inode can't be read, only the type bits are set.
 func (f *File) Mode() os.FileMode {
-	mode := os.FileMode(f.in.Header.Permissions)
-	switch {
-	case f.IsDir():
-		mode = mode | os.ModeDir
-	case f.IsSymlink():
-		mode = mode | os.ModeSymlink
+	in, err := f.getInode()
+	if err != nil {
+		return f.Type()
 	}
-	return mode
+	return os.FileMode(in.Header.Permissions) | f.Type()
 }
 
-//ExtractTo extracts the file to the given path. This is the same as ExtractWithOptions(path, false, false, os.ModePerm, false).
+//ExtractTo extracts the file to the given path. This is the same as ExtractWith(path, DefaultExtractionOptions()).
 //Will NOT try to keep symlinks valid, folders extracted will have the permissions set by the squashfs, but the folder to make path will have full permissions (777).
 //
 //Will try it's best to extract all files, and if any errors come up, they will be appended to the error slice that's returned.
 func (f *File) ExtractTo(path string) []error {
-	return f.ExtractWithOptions(path, false, false, os.ModePerm, false)
+	return f.ExtractWith(path, DefaultExtractionOptions())
 }
 
 //ExtractSymlink is similar to ExtractTo, but when it extracts a symlink, it instead extracts the file associated with the symlink in it's place.
@@ -308,7 +474,36 @@ func (f *File) ExtractSymlink(path string) []error {
 	return f.ExtractWithOptions(path, true, false, os.ModePerm, false)
 }
 
+//ExtractionOptions holds the options used by ExtractWith.
+type ExtractionOptions struct {
+	//If set, instead of extracting a symlink, it will extract the file the symlink is pointed to in it's place.
+	//If both DereferenceSymlink and UnbreakSymlink is set, DereferenceSymlink takes precendence.
+	DereferenceSymlink bool
+	//If set, it will also try to extract the symlink's associated file. WARNING: the symlink's file may have to go up the directory to work.
+	//If the file cannot be extracted, a ErrBrokenSymlink will be appended to the returned error slice.
+	UnbreakSymlink bool
+	//FolderPerm only applies to the folders created to get to path. Folders from the archive are given the correct permissions defined by the archive.
+	FolderPerm os.FileMode
+	//If set, errors are printed as they happen.
+	Verbose bool
+	//If set, extended attributes (such as security.capability) are set on the extracted files. Only supported on Linux.
+	//Setting trusted and security xattrs usually requires root.
+	Xattrs bool
+	//XattrNamespaces limits which xattrs are set when Xattrs is set. Each value is either a namespace (such as "security")
+	//or a full xattr name (such as "security.capability"). If empty, all xattrs are set.
+	XattrNamespaces []string
+	links           *extractedLinks //Shared by everything extracted by the same call to ExtractWith.
+}
+
+//DefaultExtractionOptions returns the ExtractionOptions used by ExtractTo.
+func DefaultExtractionOptions() ExtractionOptions {
+	return ExtractionOptions{
+		FolderPerm: os.ModePerm,
+	}
+}
+
 //ExtractWithOptions will extract the file to the given path, while allowing customization on how it works. ExtractTo is the "default" options.
+//This is the same as calling ExtractWith with the equivalent ExtractionOptions.
 //Will try it's best to extract all files, and if any errors come up, they will be appended to the error slice that's returned.
 //Should only return multiple errors if extracting a folder.
 //
@@ -320,18 +515,54 @@ func (f *File) ExtractSymlink(path string) []error {
 //
 //folderPerm only applies to the folders created to get to path. Folders from the archive are given the correct permissions defined by the archive.
 func (f *File) ExtractWithOptions(path string, dereferenceSymlink, unbreakSymlink bool, folderPerm os.FileMode, verbose bool) (errs []error) {
+	return f.ExtractWith(path, ExtractionOptions{
+		DereferenceSymlink: dereferenceSymlink,
+		UnbreakSymlink:     unbreakSymlink,
+		FolderPerm:         folderPerm,
+		Verbose:            verbose,
+	})
+}
+
+//ExtractWith will extract the file to the given path using the given options.
+//Will try it's best to extract all files, and if any errors come up, they will be appended to the error slice that's returned.
+//Should only return multiple errors if extracting a folder.
+//
+//Files that share the same inode (hard links) are extracted as hard links to the first one extracted. If a hard link can't be made,
+//such as if the file system doesn't support them, the file is extracted as a separate copy.
+//
+//Devices, FIFOs, and sockets are created with mknod. Creating devices usually requires root, so if they can't be created because of permissions
+//(or mknod isn't supported, which is anything but Linux), an empty file with the same permissions is created in it's place instead
+//and no error is returned. This way the path still exists, such as to bind mount the host's device onto it.
+func (f *File) ExtractWith(path string, op ExtractionOptions) (errs []error) {
 	errs = make([]error, 0)
-	err := os.MkdirAll(path, folderPerm)
+	err := os.MkdirAll(path, op.FolderPerm)
 	if err != nil {
 		return []error{err}
 	}
+	if op.links == nil {
+		op.links = &extractedLinks{first: make(map[uint32]*extractedLink)}
+	}
+	if in, inErr := f.getInode(); inErr == nil && !f.IsDir() && hardLinks(in) > 1 {
+		link, first := op.links.claim(in.Header.Number, path+"/"+f.name)
+		if first {
+			defer func() {
+				link.ok = len(errs) == 0
+				close(link.done)
+			}()
+		} else {
+			<-link.done
+			if link.ok && os.Link(link.path, path+"/"+f.name) == nil {
+				return
+			}
+		}
+	}
 	switch {
 	case f.IsDir():
 		if f.name != "" {
 			//TODO: check if folder is present, and if so, try to set it's permission
 			err = os.Mkdir(path+"/"+f.name, os.ModePerm)
 			if err != nil {
-				if verbose {
+				if op.Verbose {
 					fmt.Println("Error while making: ", path+"/"+f.name)
 					fmt.Println(err)
 				}
@@ -341,17 +572,20 @@ func (f *File) ExtractWithOptions(path string, dereferenceSymlink, unbreakSymlin
 			var fil *os.File
 			fil, err = os.Open(path + "/" + f.name)
 			if err != nil {
-				if verbose {
+				if op.Verbose {
 					fmt.Println("Error while opening:", path+"/"+f.name)
 					fmt.Println(err)
 				}
 				errs = append(errs, err)
 				return
 			}
-			fil.Chown(int(f.r.idTable[f.in.Header.UID]), int(f.r.idTable[f.in.Header.GID]))
+			defer fil.Close()
+			if in, inErr := f.getInode(); inErr == nil {
+				fil.Chown(int(f.r.idTable[in.Header.UID]), int(f.r.idTable[in.Header.GID]))
+			}
 			//don't mention anything when it fails. Because it fails often. Probably has something to do about uid & gid 0
 			// if err != nil {
-			// 	if verbose {
+			// 	if op.Verbose {
 			// 		fmt.Println("Error while changing owner:", path+"/"+f.Name)
 			// 		fmt.Println(err)
 			// 	}
@@ -359,17 +593,20 @@ func (f *File) ExtractWithOptions(path string, dereferenceSymlink, unbreakSymlin
 			// }
 			err = fil.Chmod(f.Mode())
 			if err != nil {
-				if verbose {
+				if op.Verbose {
 					fmt.Println("Error while changing owner:", path+"/"+f.name)
 					fmt.Println(err)
 				}
 				errs = append(errs, err)
 			}
+			if op.Xattrs {
+				errs = append(errs, f.setXattrs(path+"/"+f.name, op)...)
+			}
 		}
 		var children []*File
 		children, err = f.GetChildren()
 		if err != nil {
-			if verbose {
+			if op.Verbose {
 				fmt.Println("Error getting children for:", f.Path())
 				fmt.Println(err)
 			}
@@ -380,9 +617,9 @@ func (f *File) ExtractWithOptions(path string, dereferenceSymlink, unbreakSymlin
 		for _, child := range children {
 			go func(child *File) {
 				if f.name == "" {
-					finishChan <- child.ExtractWithOptions(path, dereferenceSymlink, unbreakSymlink, folderPerm, verbose)
+					finishChan <- child.ExtractWith(path, op)
 				} else {
-					finishChan <- child.ExtractWithOptions(path+"/"+f.name, dereferenceSymlink, unbreakSymlink, folderPerm, verbose)
+					finishChan <- child.ExtractWith(path+"/"+f.name, op)
 				}
 			}(child)
 		}
@@ -396,7 +633,7 @@ func (f *File) ExtractWithOptions(path string, dereferenceSymlink, unbreakSymlin
 		if os.IsExist(err) {
 			err = os.Remove(path + "/" + f.name)
 			if err != nil {
-				if verbose {
+				if op.Verbose {
 					fmt.Println("Error while making:", path+"/"+f.name)
 					fmt.Println(err)
 				}
@@ -405,7 +642,7 @@ func (f *File) ExtractWithOptions(path string, dereferenceSymlink, unbreakSymlin
 			}
 			fil, err = os.Create(path + "/" + f.name)
 			if err != nil {
-				if verbose {
+				if op.Verbose {
 					fmt.Println("Error while making:", path+"/"+f.name)
 					fmt.Println(err)
 				}
@@ -413,26 +650,29 @@ func (f *File) ExtractWithOptions(path string, dereferenceSymlink, unbreakSymlin
 				return
 			}
 		} else if err != nil {
-			if verbose {
+			if op.Verbose {
 				fmt.Println("Error while making:", path+"/"+f.name)
 				fmt.Println(err)
 			}
 			errs = append(errs, err)
 			return
 		} //Since we will be reading from the file
+		defer fil.Close()
 		_, err = io.Copy(fil, f.Sys().(io.Reader))
 		if err != nil {
-			if verbose {
+			if op.Verbose {
 				fmt.Println("Error while Copying data to:", path+"/"+f.name)
 				fmt.Println(err)
 			}
 			errs = append(errs, err)
 			return
 		}
-		fil.Chown(int(f.r.idTable[f.in.Header.UID]), int(f.r.idTable[f.in.Header.GID]))
+		if in, inErr := f.getInode(); inErr == nil {
+			fil.Chown(int(f.r.idTable[in.Header.UID]), int(f.r.idTable[in.Header.GID]))
+		}
 		//don't mention anything when it fails. Because it fails often. Probably has something to do about uid & gid 0
 		// if err != nil {
-		// 	if verbose {
+		// 	if op.Verbose {
 		// 		fmt.Println("Error while changing owner:", path+"/"+f.Name)
 		// 		fmt.Println(err)
 		// 	}
@@ -441,48 +681,51 @@ func (f *File) ExtractWithOptions(path string, dereferenceSymlink, unbreakSymlin
 		// }
 		err = fil.Chmod(f.Mode())
 		if err != nil {
-			if verbose {
+			if op.Verbose {
 				fmt.Println("Error while setting permissions for:", path+"/"+f.name)
 				fmt.Println(err)
 			}
 			errs = append(errs, err)
 		}
+		if op.Xattrs {
+			errs = append(errs, f.setXattrs(path+"/"+f.name, op)...)
+		}
 		return
 	case f.IsSymlink():
 		symPath := f.SymlinkPath()
-		if dereferenceSymlink {
+		if op.DereferenceSymlink {
 			fil := f.GetSymlinkFile()
 			if fil == nil {
-				if verbose {
+				if op.Verbose {
 					fmt.Println("Symlink path(", symPath, ") is outside the archive:"+path+"/"+f.name)
 				}
 				return
 			}
 			fil.name = f.name
-			extracSymErrs := fil.ExtractWithOptions(path, dereferenceSymlink, unbreakSymlink, folderPerm, verbose)
+			extracSymErrs := fil.ExtractWith(path, op)
 			if len(extracSymErrs) > 0 {
-				if verbose {
+				if op.Verbose {
 					fmt.Println("Error(s) while extracting the symlink's file:", path+"/"+f.name)
 					fmt.Println(extracSymErrs)
 				}
 				errs = append(errs, extracSymErrs...)
 			}
 			return
-		} else if unbreakSymlink {
+		} else if op.UnbreakSymlink {
 			fil := f.GetSymlinkFile()
 			if fil != nil {
 				symPath = path + "/" + symPath
 				paths := strings.Split(symPath, "/")
-				extracSymErrs := fil.ExtractWithOptions(strings.Join(paths[:len(paths)-1], "/"), dereferenceSymlink, unbreakSymlink, folderPerm, verbose)
+				extracSymErrs := fil.ExtractWith(strings.Join(paths[:len(paths)-1], "/"), op)
 				if len(extracSymErrs) > 0 {
-					if verbose {
+					if op.Verbose {
 						fmt.Println("Error(s) while extracting the symlink's file:", path+"/"+f.name)
 						fmt.Println(extracSymErrs)
 					}
 					errs = append(errs, extracSymErrs...)
 				}
 			} else {
-				if verbose {
+				if op.Verbose {
 					fmt.Println("Symlink path(", symPath, ") is outside the archive:"+path+"/"+f.name)
 				}
 				return
@@ -490,31 +733,94 @@ func (f *File) ExtractWithOptions(path string, dereferenceSymlink, unbreakSymlin
 		}
 		err = os.Symlink(f.SymlinkPath(), path+"/"+f.name)
 		if err != nil {
-			if verbose {
+			if op.Verbose {
 				fmt.Println("Error while making symlink:", path+"/"+f.name)
 				fmt.Println(err)
 			}
 			errs = append(errs, err)
+		} else if op.Xattrs {
+			errs = append(errs, f.setXattrs(path+"/"+f.name, op)...)
+		}
+	case f.IsDevice(), f.IsFifo(), f.IsSocket():
+		err = f.extractSpecial(path + "/" + f.name)
+		if err != nil {
+			if op.Verbose {
+				fmt.Println("Error while making:", path+"/"+f.name)
+				fmt.Println(err)
+			}
+			errs = append(errs, err)
+		} else if op.Xattrs {
+			errs = append(errs, f.setXattrs(path+"/"+f.name, op)...)
 		}
 	}
 	return
 }
 
+//extractSpecial creates the device, FIFO, or socket at path, and sets it's owner and permissions. If it can't be created because of
+//permissions, or mknod isn't supported, an empty file is created instead.
+func (f *File) extractSpecial(path string) error {
+	err := mknod(path, f.Mode(), uint32(f.Rdev()))
+	if os.IsExist(err) {
+		err = os.Remove(path)
+		if err != nil {
+			return err
+		}
+		err = mknod(path, f.Mode(), uint32(f.Rdev()))
+	}
+	if errors.Is(err, os.ErrPermission) || errors.Is(err, errMknodUnsupported) {
+		var fil *os.File
+		fil, err = os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, f.Mode().Perm())
+		if err != nil {
+			return err
+		}
+		err = fil.Close()
+	}
+	if err != nil {
+		return err
+	}
+	if in, inErr := f.getInode(); inErr == nil {
+		os.Lchown(path, int(f.r.idTable[in.Header.UID]), int(f.r.idTable[in.Header.GID]))
+	}
+	return os.Chmod(path, f.Mode())
+}
+
 //Read from the file. Doesn't do anything fancy, just pases it to the underlying io.Reader. If a directory, return io.EOF.
 func (f *File) Read(p []byte) (int, error) {
 	if !f.IsFile() {
 		return 0, io.EOF
 	}
-	var err error
-	if f.reader == nil && f.r != nil {
-		f.reader, err = f.r.newFileReader(f.in)
-		if err != nil {
-			return 0, err
-		}
+	err := f.initReader()
+	if err != nil {
+		return 0, err
 	}
 	return f.reader.Read(p)
 }
 
+//ReadAt reads len(p) bytes from the file starting at off. Only the data block (or fragment) holding the data is read.
+//Once the File has been read from (or if it came from Reader.Open), it's safe to call concurrently.
+func (f *File) ReadAt(p []byte, off int64) (int, error) {
+	if !f.IsFile() {
+		return 0, errNotFile
+	}
+	err := f.initReader()
+	if err != nil {
+		return 0, err
+	}
+	return f.reader.ReadAt(p, off)
+}
+
+//Seek sets the offset for the next Read.
+func (f *File) Seek(offset int64, whence int) (int64, error) {
+	if !f.IsFile() {
+		return 0, errNotFile
+	}
+	err := f.initReader()
+	if err != nil {
+		return 0, err
+	}
+	return f.reader.Seek(offset, whence)
+}
+
 //ReadDirFromInode returns a fully populated Directory from a given Inode.
 //If the given inode is not a directory it returns an error.
 func (r *Reader) readDirFromInode(i *inode.Inode) (*directory.Directory, error) {
@@ -548,13 +854,54 @@ func (r *Reader) readDirFromInode(i *inode.Inode) (*directory.Directory, error)
 	return dir, nil
 }
 
-//GetInodeFromEntry returns the inode associated with a given directory.Entry
-func (r *Reader) getInodeFromEntry(en *directory.Entry) (*inode.Inode, error) {
-	br, err := r.newMetadataReader(int64(r.super.InodeTableStart + uint64(en.Header.InodeOffset)))
+//dirEntryByName returns the entry with the given name in the directory inode. If there's no entry with the name, nil is returned.
+//If the directory has an index (extended directories), it's used to skip directly to the metadata block containing the name.
+func (r *Reader) dirEntryByName(i *inode.Inode, name string) (*directory.Entry, error) {
+	var offset uint32
+	var metaOffset uint32
+	var size uint32
+	var indexes []inode.DirIndex
+	switch i.Type {
+	case inode.DirType:
+		offset = i.Info.(inode.Dir).DirectoryIndex
+		metaOffset = uint32(i.Info.(inode.Dir).DirectoryOffset)
+		size = uint32(i.Info.(inode.Dir).DirectorySize)
+	case inode.ExtDirType:
+		offset = i.Info.(inode.ExtDir).DirectoryIndex
+		metaOffset = uint32(i.Info.(inode.ExtDir).DirectoryOffset)
+		size = i.Info.(inode.ExtDir).DirectorySize
+		indexes = i.Info.(inode.ExtDir).Indexes
+	default:
+		return nil, errors.New("Not a directory inode")
+	}
+	//The size is 3 bytes larger then the actual directory data.
+	if size <= 3 {
+		return nil, nil
+	}
+	size -= 3
+	//Each index has the name of the first entry in a metadata block. Find the last one that's <= name.
+	ind := sort.Search(len(indexes), func(j int) bool {
+		return indexes[j].Name > name
+	}) - 1
+	if ind >= 0 {
+		offset = indexes[ind].DirTableOffset
+		metaOffset = (metaOffset + indexes[ind].Offset) % metadataSize
+		size -= indexes[ind].Offset
+	}
+	br, err := r.newMetadataReader(int64(r.super.DirTableStart + uint64(offset)))
+	if err != nil {
+		return nil, err
+	}
+	_, err = br.Seek(int64(metaOffset), io.SeekStart)
 	if err != nil {
 		return nil, err
 	}
-	_, err = br.Seek(int64(en.Offset), io.SeekStart)
+	return directory.Find(br, size, name)
+}
+
+//readInode returns the inode at the given inode reference.
+func (r *Reader) readInode(ref uint64) (*inode.Inode, error) {
+	br, err := r.newMetadataReaderFromInodeRef(ref)
 	if err != nil {
 		return nil, err
 	}
@@ -1,101 +1,183 @@
 package squashfs
 
 import (
-	"bytes"
 	"errors"
 	"io"
+	"sync"
 
 	"github.com/CalebQ42/squashfs/internal/inode"
 )
 
-//FileReader provides a io.Reader interface for files within a squashfs archive
+//FileReader provides a io.Reader, io.ReaderAt, and io.Seeker interface for files within a squashfs archive
 type fileReader struct {
 	r            *Reader
-	data         *dataReader
+	data         *dataReader //nil if the file has no data blocks
 	in           *inode.Inode
 	fragmentData []byte
+	cacheData    []byte //the most recently read data block
+	cacheIndex   int
+	mut          sync.Mutex
 	fragged      bool
-	fragOnly     bool
-	read         int
-	FileSize     int //FileSize is the total size of the given file
+	read         int64
+	FileSize     int64 //FileSize is the total size of the given file
 }
 
 var (
 	//ErrPathIsNotFile returns when trying to read from a file, but the given path is NOT a file.
 	errPathIsNotFile = errors.New("The given path is not a file")
+	//ErrNegativeOffset is returned when trying to read or seek to a negative offset.
+	errNegativeOffset = errors.New("Negative offset")
 )
 
 //ReadFile provides a squashfs.FileReader for the file at the given location.
+//Nothing is read from the archive until data is requested.
 func (r *Reader) newFileReader(in *inode.Inode) (*fileReader, error) {
 	var rdr fileReader
+	rdr.r = r
 	rdr.in = in
-	if in.Type != inode.FileType && in.Type != inode.ExtFileType {
-		return nil, errPathIsNotFile
-	}
+	rdr.cacheIndex = -1
 	switch in.Type {
 	case inode.FileType:
 		fil := in.Info.(inode.File)
 		rdr.fragged = fil.Fragmented
-		rdr.fragOnly = fil.BlockStart == 0
-		rdr.FileSize = int(fil.Size)
+		rdr.FileSize = int64(fil.Size)
 	case inode.ExtFileType:
 		fil := in.Info.(inode.ExtFile)
 		rdr.fragged = fil.Fragmented
-		rdr.fragOnly = fil.BlockStart == 0
-		rdr.FileSize = int(fil.Size)
+		rdr.FileSize = int64(fil.Size)
+	default:
+		return nil, errPathIsNotFile
 	}
 	var err error
-	if rdr.fragged {
-		rdr.fragmentData, err = r.getFragmentDataFromInode(in)
+	rdr.data, err = r.newDataReaderFromInode(in)
+	if err == errInodeOnlyFragment {
+		rdr.data = nil
+	} else if err != nil {
+		return nil, err
+	}
+	return &rdr, nil
+}
+
+//block returns the data that holds the given block index. If index is past the data blocks, the fragment data is returned.
+func (f *fileReader) block(index int) ([]byte, error) {
+	f.mut.Lock()
+	defer f.mut.Unlock()
+	if f.data != nil && index < len(f.data.sizes) {
+		if f.cacheIndex == index {
+			return f.cacheData, nil
+		}
+		data, err := f.data.readBlock(index)
 		if err != nil {
 			return nil, err
 		}
+		f.cacheIndex = index
+		f.cacheData = data
+		return data, nil
 	}
-	if !rdr.fragOnly {
-		rdr.data, err = r.newDataReaderFromInode(in)
+	if !f.fragged {
+		return nil, io.EOF
 	}
-	return &rdr, nil
+	if f.fragmentData == nil {
+		var err error
+		f.fragmentData, err = f.r.getFragmentDataFromInode(f.in)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return f.fragmentData, nil
 }
 
-func (f *fileReader) Read(p []byte) (int, error) {
-	if f.fragOnly {
-		n, err := bytes.NewBuffer(f.fragmentData[f.read:]).Read(p)
-		f.read += n
+//ReadAt reads len(p) bytes starting at off. The block holding off is found directly, so no preceding data is read.
+//Safe to call concurrently.
+func (f *fileReader) ReadAt(p []byte, off int64) (n int, err error) {
+	if off < 0 {
+		return 0, errNegativeOffset
+	}
+	blockSize := int64(f.r.super.BlockSize)
+	for n < len(p) && off < f.FileSize {
+		index := int(off / blockSize)
+		var data []byte
+		data, err = f.block(index)
 		if err != nil {
-			return n, err
+			return
 		}
-		return n, nil
-	}
-	var read int
-	n, err := f.data.Read(p)
-	read += n
-	if f.fragged && err == io.EOF {
-		if f.fragmentData == nil {
-			f.fragmentData, err = f.r.getFragmentDataFromInode(f.in)
+		blockOffset := off - int64(index)*blockSize
+		if blockOffset >= int64(len(data)) {
+			return n, errors.New("Data block is smaller then expected. The archive is probably corrupt")
 		}
-		n, err = bytes.NewBuffer(f.fragmentData).Read(p[read:])
-		read += n
-		if err != nil {
-			return read, err
+		data = data[blockOffset:]
+		if remaining := f.FileSize - off; int64(len(data)) > remaining {
+			data = data[:remaining]
 		}
-	} else if err != nil {
-		return read, err
+		copied := copy(p[n:], data)
+		n += copied
+		off += int64(copied)
 	}
-	return read, nil
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (f *fileReader) Read(p []byte) (int, error) {
+	if f.read >= f.FileSize {
+		return 0, io.EOF
+	}
+	n, err := f.ReadAt(p, f.read)
+	f.read += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
 }
 
+//Seek sets the offset for the next Read. Seeking past the end of the file is allowed, but reads will return io.EOF.
+func (f *fileReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += f.read
+	case io.SeekEnd:
+		offset += f.FileSize
+	default:
+		return f.read, errors.New("Invalid whence")
+	}
+	if offset < 0 {
+		return f.read, errNegativeOffset
+	}
+	f.read = offset
+	return f.read, nil
+}
+
+//WriteTo writes the rest of the file to w. If nothing has been read yet, the data blocks are decompressed in parallel.
 func (f *fileReader) WriteTo(w io.Writer) (int64, error) {
-	if f.fragOnly {
-		n, err := w.Write(f.fragmentData)
-		return int64(n), err
+	if f.read != 0 {
+		if f.read >= f.FileSize {
+			return 0, nil
+		}
+		n, err := io.Copy(w, io.NewSectionReader(f, f.read, f.FileSize-f.read))
+		f.read += n
+		return n, err
 	}
-	if !f.fragged {
-		return f.data.WriteTo(w)
+	var n int64
+	var err error
+	if f.data != nil {
+		n, err = f.data.WriteTo(w)
+		f.read += n
+		if err != nil {
+			return n, err
+		}
 	}
-	n, err := f.data.WriteTo(w)
-	if err != nil {
-		return int64(n), err
+	if f.fragged {
+		var frag []byte
+		frag, err = f.block(int(f.FileSize / int64(f.r.super.BlockSize)))
+		if err != nil {
+			return n, err
+		}
+		var nn int
+		nn, err = w.Write(frag)
+		n += int64(nn)
+		f.read += int64(nn)
 	}
-	nn, err := w.Write(f.fragmentData)
-	return int64(nn) + n, err
+	return n, err
 }
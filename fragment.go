@@ -10,9 +10,9 @@ import (
 
 //FragmentEntry is an entry in the fragment table
 type fragmentEntry struct {
-	Start uint64
-	Size  uint32
-	// Unused uint32
+	Start  uint64
+	Size   uint32
+	Unused uint32
 }
 
 //GetFragmentDataFromInode returns the fragment data for a given inode.
@@ -26,11 +26,7 @@ func (r *Reader) getFragmentDataFromInode(in *inode.Inode) ([]byte, error) {
 		if !bf.Fragmented {
 			return make([]byte, 0), nil
 		}
-		if bf.BlockStart == 0 {
-			size = uint64(bf.Size)
-		} else {
-			size = uint64(bf.BlockSizes[len(bf.BlockSizes)-1])
-		}
+		size = uint64(bf.Size) - uint64(len(bf.BlockSizes))*uint64(r.super.BlockSize)
 		fragIndex = bf.FragmentIndex
 		fragOffset = bf.FragmentOffset
 	} else if in.Type == inode.ExtFileType {
@@ -38,11 +34,7 @@ func (r *Reader) getFragmentDataFromInode(in *inode.Inode) ([]byte, error) {
 		if !bf.Fragmented {
 			return make([]byte, 0), nil
 		}
-		if bf.BlockStart == 0 {
-			size = bf.Size
-		} else {
-			size = uint64(bf.BlockSizes[len(bf.BlockSizes)-1])
-		}
+		size = bf.Size - uint64(len(bf.BlockSizes))*uint64(r.super.BlockSize)
 		fragIndex = bf.FragmentIndex
 		fragOffset = bf.FragmentOffset
 	} else {
@@ -53,7 +45,7 @@ func (r *Reader) getFragmentDataFromInode(in *inode.Inode) ([]byte, error) {
 	if err != nil {
 		return nil, err
 	}
-	_, err = fragEntryRdr.Seek(int64(16*fragIndex), io.SeekStart)
+	_, err = fragEntryRdr.Seek(int64(16*(fragIndex%512)), io.SeekStart)
 	if err != nil {
 		return nil, err
 	}
@@ -63,18 +55,52 @@ func (r *Reader) getFragmentDataFromInode(in *inode.Inode) ([]byte, error) {
 		return nil, err
 	}
 	//now reading the actual fragment
-	dr, err := r.newDataReader(int64(entry.Start), []uint32{entry.Size})
+	data, err := r.readFragmentBlock(entry)
 	if err != nil {
 		return nil, err
 	}
-	_, err = dr.Read(make([]byte, fragOffset))
-	if err != nil {
-		return nil, err
+	if uint64(len(data)) < uint64(fragOffset)+size {
+		return nil, errors.New("Fragment is smaller then expected. The archive is probably corrupt")
+	}
+	//The capacity is limited so the cached block can't be appended over.
+	return data[fragOffset : uint64(fragOffset)+size : uint64(fragOffset)+size], nil
+}
+
+//readFragmentBlock returns the decompressed fragment block, using the Reader's cache if possible.
+//Many small files share the same fragment block, so this saves a lot of decompressing.
+func (r *Reader) readFragmentBlock(entry fragmentEntry) ([]byte, error) {
+	if block, ok := r.cache.get(int64(entry.Start)); ok {
+		return block.data, nil
 	}
-	tmp := make([]byte, size)
-	err = binary.Read(dr, binary.LittleEndian, &tmp)
+	data, err := r.readDataBlock(int64(entry.Start), entry.Size)
 	if err != nil {
 		return nil, err
 	}
-	return tmp, nil
+	r.cache.add(&cachedBlock{
+		data:   data,
+		offset: int64(entry.Start),
+		next:   int64(entry.Start) + int64(actualDataSize(entry.Size)),
+	})
+	return data, nil
+}
+
+//fragmentEntries returns the whole fragment table.
+func (r *Reader) fragmentEntries() ([]fragmentEntry, error) {
+	entries := make([]fragmentEntry, r.super.FragCount)
+	//Each metadata block holds 512 entries.
+	for i := 0; i < len(entries); i += 512 {
+		rdr, err := r.newMetadataReader(int64(r.fragOffsets[i/512]))
+		if err != nil {
+			return nil, err
+		}
+		end := i + 512
+		if end > len(entries) {
+			end = len(entries)
+		}
+		err = binary.Read(rdr, binary.LittleEndian, entries[i:end])
+		if err != nil {
+			return nil, err
+		}
+	}
+	return entries, nil
 }
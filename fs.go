@@ -0,0 +1,320 @@
+package squashfs
+
+import (
+	"bytes"
+	"io/fs"
+	"path"
+	"strings"
+)
+
+//maxSymlinkHops is how many symlinks will be followed when resolving a path before giving up.
+const maxSymlinkHops = 40
+
+//FS is a fs.FS rooted at a directory inside of a squashfs archive. Returned by Reader.Sub and FS.Sub.
+//
+//Symlinks are followed as long as they stay inside the FS. Absolute symlinks are resolved relative to the root of the FS.
+//
+//Implements fs.FS, fs.ReadDirFS, fs.StatFS, fs.ReadFileFS, fs.GlobFS, and fs.SubFS. Lstat and ReadLink match fs.ReadLinkFS,
+//which is only in Go 1.25 and newer.
+type FS struct {
+	root *File
+}
+
+//Open opens the file at the given path. Each call returns a new, independent, *File.
+func (s *FS) Open(name string) (fs.File, error) {
+	fil, err := s.resolve("open", name)
+	if err != nil {
+		return nil, err
+	}
+	return fil, nil
+}
+
+//ReadDir returns all the entries of the directory at the given path, sorted by name.
+func (s *FS) ReadDir(name string) ([]fs.DirEntry, error) {
+	fil, err := s.resolve("readdir", name)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := fil.ReadDir(-1)
+	if err != nil {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: err}
+	}
+	return entries, nil
+}
+
+//Stat returns the fs.FileInfo for the file at the given path.
+func (s *FS) Stat(name string) (fs.FileInfo, error) {
+	fil, err := s.resolve("stat", name)
+	if err != nil {
+		return nil, err
+	}
+	return fil, nil
+}
+
+//ReadFile reads and returns the entire contents of the file at the given path.
+func (s *FS) ReadFile(name string) ([]byte, error) {
+	fil, err := s.resolve("readfile", name)
+	if err != nil {
+		return nil, err
+	}
+	if !fil.IsFile() {
+		return nil, &fs.PathError{Op: "readfile", Path: name, Err: errNotFile}
+	}
+	var buf bytes.Buffer
+	buf.Grow(int(fil.Size()))
+	_, err = fil.reader.WriteTo(&buf)
+	if err != nil {
+		return nil, &fs.PathError{Op: "readfile", Path: name, Err: err}
+	}
+	return buf.Bytes(), nil
+}
+
+//Lstat returns the fs.FileInfo for the file at the given path. If the file is a symlink, it's returned instead of it's target.
+func (s *FS) Lstat(name string) (fs.FileInfo, error) {
+	return s.lresolve("lstat", name)
+}
+
+//ReadLink returns the target of the symlink at the given path.
+func (s *FS) ReadLink(name string) (string, error) {
+	fil, err := s.lresolve("readlink", name)
+	if err != nil {
+		return "", err
+	}
+	if !fil.IsSymlink() {
+		return "", &fs.PathError{Op: "readlink", Path: name, Err: fs.ErrInvalid}
+	}
+	return fil.SymlinkPath(), nil
+}
+
+//Glob returns the paths of all files matching the pattern. Uses the same syntax as path.Match.
+func (s *FS) Glob(pattern string) ([]string, error) {
+	//hide our Glob so fs.Glob does the work using ReadDir and Stat instead of calling back here.
+	return fs.Glob(struct{ fs.ReadDirFS }{s}, pattern)
+}
+
+//Sub returns a FS rooted at the given directory.
+func (s *FS) Sub(dir string) (fs.FS, error) {
+	fil, err := s.resolve("sub", dir)
+	if err != nil {
+		return nil, err
+	}
+	if !fil.IsDir() {
+		return nil, &fs.PathError{Op: "sub", Path: dir, Err: errNotDirectory}
+	}
+	return &FS{root: fil}, nil
+}
+
+//resolve finds the file at name, following any symlinks along the way. The returned File is a fresh copy.
+func (s *FS) resolve(op, name string) (*File, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+	hops := 0
+	cur := name
+	for {
+		fil, symPath, rest, err := s.walk(cur)
+		if err != nil {
+			return nil, &fs.PathError{Op: op, Path: name, Err: err}
+		}
+		if fil != nil {
+			out := fil.handle()
+			if cur != name {
+				//Opening a symlink gives the target, but it keeps the symlink's name.
+				out.name = path.Base(name)
+			}
+			if out.IsFile() {
+				//created now so ReadAt is safe to use concurrently.
+				err = out.initReader()
+				if err != nil {
+					return nil, &fs.PathError{Op: op, Path: name, Err: err}
+				}
+			}
+			return out, nil
+		}
+		hops++
+		if hops > maxSymlinkHops {
+			return nil, &fs.PathError{Op: op, Path: name, Err: errTooManySymlinks}
+		}
+		cur = symPath
+		if rest != "" {
+			cur = path.Join(cur, rest)
+		}
+		if cur == ".." || strings.HasPrefix(cur, "../") {
+			return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+		}
+	}
+}
+
+//lresolve is the same as resolve, except if the file is a symlink, the symlink is returned instead of it's target.
+func (s *FS) lresolve(op, name string) (*File, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+	if name == "." {
+		return s.root.handle(), nil
+	}
+	dir, err := s.resolve(op, path.Dir(name))
+	if err != nil {
+		return nil, err
+	}
+	fil, err := dir.getChild(path.Base(name))
+	if err != nil {
+		return nil, &fs.PathError{Op: op, Path: name, Err: err}
+	}
+	return fil, nil
+}
+
+//walk goes down the given path, starting at the FS's root. If a symlink is encountered, fil will be nil and
+//symPath will be the symlink's target (relative to the root) with rest being the portion of the path after the symlink.
+func (s *FS) walk(name string) (fil *File, symPath, rest string, err error) {
+	fil = s.root
+	if name == "." {
+		return
+	}
+	split := strings.Split(name, "/")
+	for i, part := range split {
+		if !fil.IsDir() {
+			return nil, "", "", errNotDirectory
+		}
+		fil, err = fil.getChild(part)
+		if err != nil {
+			return nil, "", "", err
+		}
+		if fil.IsSymlink() {
+			target := fil.SymlinkPath()
+			if path.IsAbs(target) {
+				symPath = path.Clean(strings.TrimPrefix(target, "/"))
+			} else {
+				symPath = path.Join(strings.Join(split[:i], "/"), target)
+			}
+			return nil, symPath, strings.Join(split[i+1:], "/"), nil
+		}
+	}
+	return
+}
+
+//getChild returns the direct child of the directory with the given name. Unlike GetFileAtPath, wildcards are not used.
+//Only the inode of the child is read, and if the directory has an index it's used to find the child quickly.
+func (f *File) getChild(name string) (*File, error) {
+	if f.r == nil {
+		return nil, errNotReading
+	}
+	if !f.IsDir() {
+		return nil, errNotDirectory
+	}
+	in, err := f.getInode()
+	if err != nil {
+		return nil, err
+	}
+	entry, err := f.r.dirEntryByName(in, name)
+	if err != nil {
+		return nil, err
+	}
+	if entry == nil {
+		return nil, fs.ErrNotExist
+	}
+	fil, err := f.r.newFileFromDirEntry(entry)
+	if err != nil {
+		return nil, err
+	}
+	fil.Parent = f
+	if f.name != "" {
+		fil.dir = f.Path()
+	}
+	return fil, nil
+}
+
+//handle returns a copy of the File with it's own, fresh, read state.
+func (f *File) handle() *File {
+	out := *f
+	out.reader = nil
+	out.dirEntries = nil
+	out.dirRead = 0
+	return &out
+}
+
+func (r *Reader) rootFS() (*FS, error) {
+	root, err := r.GetRootFolder()
+	if err != nil {
+		return nil, err
+	}
+	return &FS{root: root}, nil
+}
+
+//Open opens the file at the given path inside the archive. Each call returns a new, independent, *File.
+//Implements fs.FS.
+func (r *Reader) Open(name string) (fs.File, error) {
+	s, err := r.rootFS()
+	if err != nil {
+		return nil, err
+	}
+	return s.Open(name)
+}
+
+//ReadDir returns all the entries of the directory at the given path, sorted by name.
+//Implements fs.ReadDirFS.
+func (r *Reader) ReadDir(name string) ([]fs.DirEntry, error) {
+	s, err := r.rootFS()
+	if err != nil {
+		return nil, err
+	}
+	return s.ReadDir(name)
+}
+
+//Stat returns the fs.FileInfo for the file at the given path.
+//Implements fs.StatFS.
+func (r *Reader) Stat(name string) (fs.FileInfo, error) {
+	s, err := r.rootFS()
+	if err != nil {
+		return nil, err
+	}
+	return s.Stat(name)
+}
+
+//ReadFile reads and returns the entire contents of the file at the given path.
+//Implements fs.ReadFileFS.
+func (r *Reader) ReadFile(name string) ([]byte, error) {
+	s, err := r.rootFS()
+	if err != nil {
+		return nil, err
+	}
+	return s.ReadFile(name)
+}
+
+//Lstat returns the fs.FileInfo for the file at the given path, without following the symlink if it's a symlink.
+func (r *Reader) Lstat(name string) (fs.FileInfo, error) {
+	s, err := r.rootFS()
+	if err != nil {
+		return nil, err
+	}
+	return s.Lstat(name)
+}
+
+//ReadLink returns the target of the symlink at the given path.
+func (r *Reader) ReadLink(name string) (string, error) {
+	s, err := r.rootFS()
+	if err != nil {
+		return "", err
+	}
+	return s.ReadLink(name)
+}
+
+//Glob returns the paths of all files matching the pattern.
+//Implements fs.GlobFS.
+func (r *Reader) Glob(pattern string) ([]string, error) {
+	s, err := r.rootFS()
+	if err != nil {
+		return nil, err
+	}
+	return s.Glob(pattern)
+}
+
+//Sub returns a fs.FS rooted at the given directory.
+//Implements fs.SubFS.
+func (r *Reader) Sub(dir string) (fs.FS, error) {
+	s, err := r.rootFS()
+	if err != nil {
+		return nil, err
+	}
+	return s.Sub(dir)
+}
@@ -1,6 +1,6 @@
 module github.com/CalebQ42/squashfs
 
-go 1.15
+go 1.16
 
 require (
 	github.com/CalebQ42/GoAppImage v0.5.0
@@ -9,7 +9,7 @@ require (
 	github.com/gopherjs/gopherjs v0.0.0-20200217142428-fce0ec30dd00 // indirect
 	github.com/klauspost/compress v1.11.6
 	github.com/kr/text v0.2.0 // indirect
-	github.com/pierrec/lz4/v4 v4.1.3
+	github.com/pierrec/lz4/v4 v4.1.26
 	github.com/smartystreets/assertions v1.2.0 // indirect
 	github.com/stretchr/testify v1.7.0 // indirect
 	github.com/ulikunitz/xz v0.5.9
@@ -0,0 +1,58 @@
+package squashfs
+
+import (
+	"sync"
+
+	"github.com/CalebQ42/squashfs/internal/inode"
+)
+
+//hardLinks returns how many directory entries use the inode. Basic files don't store it, so 1 is returned.
+func hardLinks(in *inode.Inode) uint32 {
+	switch info := in.Info.(type) {
+	case inode.ExtFile:
+		return info.HardLinks
+	case inode.Sym:
+		return info.HardLinks
+	case inode.ExtSym:
+		return info.HardLinks
+	case inode.Device:
+		return info.HardLinks
+	case inode.ExtDevice:
+		return info.HardLinks
+	case inode.IPC:
+		return info.HardLink
+	case inode.ExtIPC:
+		return info.HardLink
+	default:
+		return 1
+	}
+}
+
+//extractedLinks keeps track of the files with more then one hard link while extracting, so the rest of the files that use the same inode
+//can be extracted as hard links to the first one.
+type extractedLinks struct {
+	first map[uint32]*extractedLink
+	mut   sync.Mutex
+}
+
+//extractedLink is the first file extracted for an inode.
+type extractedLink struct {
+	path string
+	done chan struct{} //Closed once the file is extracted.
+	ok   bool          //If the file was extracted without errors. Only valid once done is closed.
+}
+
+//claim returns the extractedLink of the inode and whether it was just created, in which case the file at path is the first one.
+func (l *extractedLinks) claim(number uint32, path string) (*extractedLink, bool) {
+	l.mut.Lock()
+	defer l.mut.Unlock()
+	if link, ok := l.first[number]; ok {
+		return link, false
+	}
+	link := &extractedLink{
+		path: path,
+		done: make(chan struct{}),
+	}
+	l.first[number] = link
+	return link, true
+}
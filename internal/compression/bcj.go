@@ -0,0 +1,204 @@
+package compression
+
+//The xz filter IDs of the BCJ filters.
+const (
+	bcjX86      = 0x04
+	bcjPowerPC  = 0x05
+	bcjIA64     = 0x06
+	bcjArm      = 0x07
+	bcjArmThumb = 0x08
+	bcjSparc    = 0x09
+)
+
+//bcjFilter applies the given BCJ filter to data, in place. pos is the position of data in the stream (the filter's start offset).
+//If encode is true, relative branch addresses are converted to absolute, otherwise they're converted back.
+//Based on liblzma's simple filters.
+func bcjFilter(id uint64, data []byte, pos uint32, encode bool) {
+	switch id {
+	case bcjX86:
+		bcjX86Code(data, pos, encode)
+	case bcjPowerPC:
+		for i := 0; i+4 <= len(data); i += 4 {
+			if data[i]>>2 != 0x12 || data[i+3]&3 != 1 {
+				continue
+			}
+			src := uint32(data[i]&3)<<24 | uint32(data[i+1])<<16 | uint32(data[i+2])<<8 | uint32(data[i+3]&^3)
+			var dest uint32
+			if encode {
+				dest = pos + uint32(i) + src
+			} else {
+				dest = src - (pos + uint32(i))
+			}
+			data[i] = 0x48 | byte(dest>>24)&0x03
+			data[i+1] = byte(dest >> 16)
+			data[i+2] = byte(dest >> 8)
+			data[i+3] = data[i+3]&0x03 | byte(dest)
+		}
+	case bcjIA64:
+		bcjIA64Code(data, pos, encode)
+	case bcjArm:
+		for i := 0; i+4 <= len(data); i += 4 {
+			if data[i+3] != 0xEB {
+				continue
+			}
+			src := (uint32(data[i+2])<<16 | uint32(data[i+1])<<8 | uint32(data[i])) << 2
+			var dest uint32
+			if encode {
+				dest = pos + uint32(i) + 8 + src
+			} else {
+				dest = src - (pos + uint32(i) + 8)
+			}
+			dest >>= 2
+			data[i+2] = byte(dest >> 16)
+			data[i+1] = byte(dest >> 8)
+			data[i] = byte(dest)
+		}
+	case bcjArmThumb:
+		for i := 0; i+4 <= len(data); i += 2 {
+			if data[i+1]&0xF8 != 0xF0 || data[i+3]&0xF8 != 0xF8 {
+				continue
+			}
+			src := (uint32(data[i+1]&7)<<19 | uint32(data[i])<<11 | uint32(data[i+3]&7)<<8 | uint32(data[i+2])) << 1
+			var dest uint32
+			if encode {
+				dest = pos + uint32(i) + 4 + src
+			} else {
+				dest = src - (pos + uint32(i) + 4)
+			}
+			dest >>= 1
+			data[i+1] = 0xF0 | byte(dest>>19)&0x7
+			data[i] = byte(dest >> 11)
+			data[i+3] = 0xF8 | byte(dest>>8)&0x7
+			data[i+2] = byte(dest)
+			i += 2
+		}
+	case bcjSparc:
+		for i := 0; i+4 <= len(data); i += 4 {
+			if !(data[i] == 0x40 && data[i+1]&0xC0 == 0x00) && !(data[i] == 0x7F && data[i+1]&0xC0 == 0xC0) {
+				continue
+			}
+			src := (uint32(data[i])<<24 | uint32(data[i+1])<<16 | uint32(data[i+2])<<8 | uint32(data[i+3])) << 2
+			var dest uint32
+			if encode {
+				dest = pos + uint32(i) + src
+			} else {
+				dest = src - (pos + uint32(i))
+			}
+			dest >>= 2
+			dest = ((0-(dest>>22)&1)<<22)&0x3FFFFFFF | dest&0x3FFFFF | 0x40000000
+			data[i] = byte(dest >> 24)
+			data[i+1] = byte(dest >> 16)
+			data[i+2] = byte(dest >> 8)
+			data[i+3] = byte(dest)
+		}
+	}
+}
+
+func bcjX86Code(data []byte, pos uint32, encode bool) {
+	maskToAllowed := [8]bool{true, true, true, false, true, false, false, false}
+	maskToBitNumber := [8]uint32{0, 1, 2, 2, 3, 3, 3, 3}
+	test86MSByte := func(b byte) bool {
+		return b == 0 || b == 0xFF
+	}
+	if len(data) < 5 {
+		return
+	}
+	var prevMask uint32
+	prevPos := pos - 5
+	for i := 0; i <= len(data)-5; {
+		b := data[i]
+		if b != 0xE8 && b != 0xE9 {
+			i++
+			continue
+		}
+		offset := pos + uint32(i) - prevPos
+		prevPos = pos + uint32(i)
+		if offset > 5 {
+			prevMask = 0
+		} else {
+			for j := uint32(0); j < offset; j++ {
+				prevMask &= 0x77
+				prevMask <<= 1
+			}
+		}
+		b = data[i+4]
+		if test86MSByte(b) && maskToAllowed[(prevMask>>1)&0x7] && (prevMask>>1) < 0x10 {
+			src := uint32(b)<<24 | uint32(data[i+3])<<16 | uint32(data[i+2])<<8 | uint32(data[i+1])
+			var dest uint32
+			for {
+				if encode {
+					dest = src + (pos + uint32(i) + 5)
+				} else {
+					dest = src - (pos + uint32(i) + 5)
+				}
+				if prevMask == 0 {
+					break
+				}
+				bit := maskToBitNumber[prevMask>>1]
+				b = byte(dest >> (24 - bit*8))
+				if !test86MSByte(b) {
+					break
+				}
+				src = dest ^ (1<<(32-bit*8) - 1)
+			}
+			data[i+4] = ^byte((dest>>24)&1 - 1)
+			data[i+3] = byte(dest >> 16)
+			data[i+2] = byte(dest >> 8)
+			data[i+1] = byte(dest)
+			i += 5
+			prevMask = 0
+		} else {
+			i++
+			prevMask |= 1
+			if test86MSByte(b) {
+				prevMask |= 0x10
+			}
+		}
+	}
+}
+
+func bcjIA64Code(data []byte, pos uint32, encode bool) {
+	branchTable := [32]uint32{
+		0, 0, 0, 0, 0, 0, 0, 0,
+		0, 0, 0, 0, 0, 0, 0, 0,
+		4, 4, 6, 6, 0, 0, 7, 7,
+		4, 4, 0, 0, 4, 4, 0, 0,
+	}
+	for i := 0; i+16 <= len(data); i += 16 {
+		mask := branchTable[data[i]&0x1F]
+		bitPos := uint32(5)
+		for slot := uint32(0); slot < 3; slot, bitPos = slot+1, bitPos+41 {
+			if (mask>>slot)&1 == 0 {
+				continue
+			}
+			bytePos := int(bitPos >> 3)
+			bitRes := bitPos & 0x7
+			var instruction uint64
+			for j := 0; j < 6; j++ {
+				instruction |= uint64(data[i+j+bytePos]) << (8 * j)
+			}
+			instNorm := instruction >> bitRes
+			if (instNorm>>37)&0xF != 0x5 || (instNorm>>9)&0x7 != 0 {
+				continue
+			}
+			src := uint32((instNorm >> 13) & 0xFFFFF)
+			src |= uint32((instNorm>>36)&1) << 20
+			src <<= 4
+			var dest uint32
+			if encode {
+				dest = pos + uint32(i) + src
+			} else {
+				dest = src - (pos + uint32(i))
+			}
+			dest >>= 4
+			instNorm &^= uint64(0x8FFFFF) << 13
+			instNorm |= uint64(dest&0xFFFFF) << 13
+			instNorm |= uint64(dest&0x100000) << (36 - 20)
+			instruction &= 1<<bitRes - 1
+			instruction |= instNorm << bitRes
+			for j := 0; j < 6; j++ {
+				data[i+j+bytePos] = byte(instruction >> (8 * j))
+			}
+		}
+	}
+}
@@ -7,6 +7,15 @@ import (
 	"io"
 )
 
+//The strategies that can be set in Gzip.Strategies. These are the same values mksquashfs uses.
+const (
+	GzipDefault = 1 << iota
+	GzipFiltered
+	GzipHuffmanOnly
+	GzipRunLengthEncoded
+	GzipFixed
+)
+
 type gzipInit struct {
 	CompressionLevel int32
 	WindowSize       int16
@@ -15,7 +24,6 @@ type gzipInit struct {
 
 //Gzip is a decompressor for gzip type compression. Uses zlib for compression and decompression
 type Gzip struct {
-	wrt *zlib.Writer
 	gzipInit
 	HasCustomWindow bool
 	HasStrategies   bool
@@ -28,7 +36,7 @@ func NewGzipCompressorWithOptions(r io.Reader) (*Gzip, error) {
 	if err != nil {
 		return nil, err
 	}
-	//TODO: proper support for window size and strategies
+	//The window size and strategies don't effect decompression.
 	gzip.HasCustomWindow = gzip.WindowSize != 15
 	gzip.HasStrategies = gzip.Strategies != 0 && gzip.Strategies != 1
 	return &gzip, nil
@@ -49,27 +57,42 @@ func (g *Gzip) Decompress(r io.Reader) ([]byte, error) {
 }
 
 //Compress compresses the given data (as a byte array) and returns the compressed data.
+//If CompressionLevel isn't set, the default of 9 is used (the same as mksquashfs).
+//
+//If more then one of the Strategies are set, each one is tried and the smallest result is used, the same as mksquashfs.
+//compress/zlib only has a huffman only strategy, so the filtered, run length encoded, and fixed strategies use the default strategy.
+//compress/zlib also always uses a 32KB window, so WindowSize is only stored to be written in the compressor options.
+//Any window size can be decompressed the same way, so this only effects how well the data is compressed.
 func (g *Gzip) Compress(data []byte) ([]byte, error) {
-	var buf bytes.Buffer
-	var err error
-	if g.wrt == nil {
-		if g.CompressionLevel == 0 {
-			g.wrt = zlib.NewWriter(&buf)
-		} else {
-			g.wrt, err = zlib.NewWriterLevel(&buf, int(g.CompressionLevel))
-			if err != nil {
-				return nil, err
-			}
-		}
+	level := int(g.CompressionLevel)
+	if level == 0 {
+		level = zlib.BestCompression
 	}
-	wrt, err := zlib.NewWriterLevel(&buf, int(g.CompressionLevel))
-	if err != nil {
-		return nil, err
+	levels := []int{level}
+	if g.Strategies&GzipHuffmanOnly == GzipHuffmanOnly {
+		levels = []int{zlib.HuffmanOnly}
+		if g.Strategies&^GzipHuffmanOnly != 0 {
+			levels = append(levels, level)
+		}
 	}
-	_, err = wrt.Write(data)
-	if err != nil {
-		return nil, err
+	var out []byte
+	for _, level := range levels {
+		var buf bytes.Buffer
+		wrt, err := zlib.NewWriterLevel(&buf, level)
+		if err != nil {
+			return nil, err
+		}
+		_, err = wrt.Write(data)
+		if err != nil {
+			return nil, err
+		}
+		err = wrt.Close()
+		if err != nil {
+			return nil, err
+		}
+		if out == nil || buf.Len() < len(out) {
+			out = buf.Bytes()
+		}
 	}
-	wrt.Close()
-	return buf.Bytes(), nil
+	return out, nil
 }
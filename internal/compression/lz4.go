@@ -1,13 +1,18 @@
 package compression
 
 import (
-	"bytes"
 	"encoding/binary"
 	"io"
 
 	"github.com/pierrec/lz4/v4"
 )
 
+const (
+	lz4MinBuffer = 8192
+	//lz4MaxBuffer is larger then any block (1MB) can decompress to.
+	lz4MaxBuffer = 2 * 1024 * 1024
+)
+
 //Lz4 is a Lz4 Compressor/Decompressor
 type Lz4 struct {
 	HC bool
@@ -28,28 +33,47 @@ func NewLz4CompressorWithOptions(r io.Reader) (*Lz4, error) {
 	return &lz4, nil
 }
 
-//Decompress decompresses all data from r and returns the uncompressed bytes
+//Decompress decompresses all data from r and returns the uncompressed bytes.
+//Squashfs stores raw lz4 blocks (not the lz4 frame format), so the uncompressed size isn't known ahead of time.
 func (l *Lz4) Decompress(r io.Reader) ([]byte, error) {
-	rdr := lz4.NewReader(r)
-	var buf bytes.Buffer
-	_, err := io.Copy(&buf, rdr)
-	return buf.Bytes(), err
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	size := 4 * len(data)
+	if size < lz4MinBuffer {
+		size = lz4MinBuffer
+	}
+	for {
+		out := make([]byte, size)
+		var n int
+		n, err = lz4.UncompressBlock(data, out)
+		if err == nil {
+			return out[:n], nil
+		}
+		if size >= lz4MaxBuffer {
+			return nil, err
+		}
+		size *= 2
+	}
 }
 
 //Compress implements compression.Compress
 func (l *Lz4) Compress(data []byte) ([]byte, error) {
-	var buf bytes.Buffer
-	w := lz4.NewWriter(&buf)
+	out := make([]byte, lz4.CompressBlockBound(len(data)))
+	var n int
+	var err error
 	if l.HC {
-		err := w.Apply(lz4.CompressionLevelOption(lz4.Level9))
-		if err != nil {
-			return nil, err
-		}
+		n, err = lz4.CompressBlockHC(data, out, lz4.Level9, nil, nil)
+	} else {
+		n, err = lz4.CompressBlock(data, out, nil)
 	}
-	_, err := w.Write(data)
 	if err != nil {
 		return nil, err
 	}
-	w.Close()
-	return buf.Bytes(), nil
+	if n == 0 {
+		//data isn't compressible.
+		return data, nil
+	}
+	return out[:n], nil
 }
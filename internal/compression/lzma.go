@@ -25,9 +25,10 @@ func (l *Lzma) Decompress(rdr io.Reader) ([]byte, error) {
 }
 
 //Compress implements compression.Compress
+//The uncompressed size is stored in the header, without an end marker, the same as mksquashfs.
 func (l *Lzma) Compress(data []byte) ([]byte, error) {
 	var buf bytes.Buffer
-	w, err := lzma.NewWriter(&buf)
+	w, err := lzma.WriterConfig{Size: int64(len(data))}.NewWriter(&buf)
 	if err != nil {
 		return nil, err
 	}
@@ -0,0 +1,273 @@
+package compression
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+//The LZO algorithms that mksquashfs can use. All of them produce LZO1X data.
+const (
+	Lzo1x1 = iota
+	Lzo1x1_11
+	Lzo1x1_12
+	Lzo1x1_15
+	Lzo1x999
+)
+
+const (
+	lzoM2MaxLen    = 8
+	lzoM2MaxOffset = 0x0800
+	lzoM3MaxLen    = 33
+	lzoM3MaxOffset = 0x4000
+	lzoM4MaxLen    = 9
+	lzoM4MaxOffset = 0xbfff
+	lzoM3Marker    = 32
+	lzoM4Marker    = 16
+	lzoDictBits    = 14
+)
+
+var (
+	errLzoCorrupt     = errors.New("LZO data is corrupt")
+	errLzoNotConsumed = errors.New("LZO data continues after the end of stream marker")
+)
+
+//Lzo is a LZO1X compressor/decompressor.
+//
+//Algorithm and CompressionLevel are only stored to be written in the compressor options. Compression always uses
+//a LZO1X-1 style compressor, which can be decompressed the same as any of the other algorithms.
+type Lzo struct {
+	Algorithm        int32
+	CompressionLevel int32
+}
+
+//NewLzoCompressorWithOptions creates a new lzo compressor/decompressor with options read from the given reader.
+func NewLzoCompressorWithOptions(r io.Reader) (*Lzo, error) {
+	var lzo Lzo
+	err := binary.Read(r, binary.LittleEndian, &lzo)
+	if err != nil {
+		return nil, err
+	}
+	if lzo.Algorithm < Lzo1x1 || lzo.Algorithm > Lzo1x999 {
+		return nil, errors.New("Unknown LZO algorithm")
+	}
+	return &lzo, nil
+}
+
+//Decompress decompresses all data from r and returns the uncompressed bytes
+func (l *Lzo) Decompress(r io.Reader) ([]byte, error) {
+	in, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	return lzoDecompress(in)
+}
+
+//Compress implements compression.Compress
+func (l *Lzo) Compress(data []byte) ([]byte, error) {
+	return lzoCompress(data), nil
+}
+
+//lzoDecompress decompresses a LZO1X stream. Based on the Linux kernel's lzo1x_decompress_safe.
+func lzoDecompress(in []byte) (out []byte, err error) {
+	out = make([]byte, 0, len(in)*3)
+	ip := 0
+	//every read of in is checked through these, so corrupt data causes an error instead of a panic.
+	readByte := func() int {
+		if ip >= len(in) {
+			err = errLzoCorrupt
+			return 0
+		}
+		ip++
+		return int(in[ip-1])
+	}
+	//readLength reads a length that's been extended with zero bytes.
+	readLength := func(base int) int {
+		length := base
+		for ip < len(in) && in[ip] == 0 {
+			length += 255
+			ip++
+		}
+		return length + readByte()
+	}
+	copyLiterals := func(n int) {
+		if ip+n > len(in) {
+			err = errLzoCorrupt
+			return
+		}
+		out = append(out, in[ip:ip+n]...)
+		ip += n
+	}
+	//state is how many literals were copied by the last instruction, or 4 if it was a literal run.
+	state := 0
+	if len(in) > 0 && in[0] > 17 {
+		t := readByte() - 17
+		copyLiterals(t)
+		if t < 4 {
+			state = t
+		} else {
+			state = 4
+		}
+	}
+	for err == nil {
+		t := readByte()
+		var dist, length, next int
+		switch {
+		case t < 16 && state == 0:
+			if t == 0 {
+				t = readLength(15)
+			}
+			copyLiterals(t + 3)
+			state = 4
+			continue
+		case t < 16 && state != 4:
+			next = t & 3
+			dist = 1 + t>>2 + readByte()<<2
+			length = 2
+		case t < 16:
+			next = t & 3
+			dist = 1 + lzoM2MaxOffset + t>>2 + readByte()<<2
+			length = 3
+		case t >= 64:
+			next = t & 3
+			dist = 1 + (t>>2)&7 + readByte()<<3
+			length = t>>5 + 1
+		case t >= 32:
+			length = t&31 + 2
+			if t&31 == 0 {
+				length = 2 + readLength(31)
+			}
+			le16 := readByte() | readByte()<<8
+			dist = 1 + le16>>2
+			next = le16 & 3
+		default:
+			length = t&7 + 2
+			if t&7 == 0 {
+				length = 2 + readLength(7)
+			}
+			le16 := readByte() | readByte()<<8
+			dist = (t&8)<<11 + le16>>2
+			if err == nil && dist == 0 {
+				//end of stream marker, which must be the last thing in the stream.
+				if length != 3 {
+					return nil, errLzoCorrupt
+				}
+				if ip != len(in) {
+					return nil, errLzoNotConsumed
+				}
+				return out, nil
+			}
+			dist += 0x4000
+			next = le16 & 3
+		}
+		if err != nil {
+			break
+		}
+		if dist > len(out) {
+			return nil, errLzoCorrupt
+		}
+		//matches can overlap with the data they create, so this is done one byte at a time.
+		start := len(out) - dist
+		for i := 0; i < length; i++ {
+			out = append(out, out[start+i])
+		}
+		copyLiterals(next)
+		state = next
+	}
+	return nil, err
+}
+
+//lzoCompress compresses data into a LZO1X stream. Based on the Linux kernel's lzo1x_1_compress.
+func lzoCompress(in []byte) []byte {
+	out := make([]byte, 0, len(in)+len(in)/16+64+3)
+	var dict [1 << lzoDictBits]int32
+	ii := 0 //start of the literals that haven't been written yet
+	//writeLength writes the remainder of a length that's too large to fit in an instruction.
+	writeLength := func(length int) {
+		for length > 255 {
+			length -= 255
+			out = append(out, 0)
+		}
+		out = append(out, byte(length))
+	}
+	writeLiterals := func(end int) {
+		t := end - ii
+		switch {
+		case t == 0:
+			return
+		case len(out) == 0 && t <= 238:
+			out = append(out, byte(17+t))
+		case t <= 3:
+			//stored in the last two bits of the previous match.
+			out[len(out)-2] |= byte(t)
+		case t <= 18:
+			out = append(out, byte(t-3))
+		default:
+			out = append(out, 0)
+			writeLength(t - 18)
+		}
+		out = append(out, in[ii:end]...)
+		ii = end
+	}
+	ip := 4
+	for {
+		ip += 1 + (ip-ii)>>5
+		if ip+4 > len(in) {
+			break
+		}
+		dv := binary.LittleEndian.Uint32(in[ip:])
+		hash := (dv * 0x1824429d) >> (32 - lzoDictBits)
+		mPos := int(dict[hash])
+		dict[hash] = int32(ip)
+		if ip-mPos > lzoM4MaxOffset || dv != binary.LittleEndian.Uint32(in[mPos:]) {
+			continue
+		}
+		for {
+			writeLiterals(ip)
+			mLen := 4
+			for ip+mLen < len(in) && in[ip+mLen] == in[mPos+mLen] {
+				mLen++
+			}
+			mOff := ip - mPos
+			ip += mLen
+			ii = ip
+			switch {
+			case mLen <= lzoM2MaxLen && mOff <= lzoM2MaxOffset:
+				mOff--
+				out = append(out, byte((mLen-1)<<5|(mOff&7)<<2), byte(mOff>>3))
+			case mOff <= lzoM3MaxOffset:
+				mOff--
+				if mLen <= lzoM3MaxLen {
+					out = append(out, byte(lzoM3Marker|(mLen-2)))
+				} else {
+					out = append(out, lzoM3Marker)
+					writeLength(mLen - lzoM3MaxLen)
+				}
+				out = append(out, byte(mOff<<2), byte(mOff>>6))
+			default:
+				mOff -= 0x4000
+				if mLen <= lzoM4MaxLen {
+					out = append(out, byte(lzoM4Marker|(mOff>>11)&8|(mLen-2)))
+				} else {
+					out = append(out, byte(lzoM4Marker|(mOff>>11)&8))
+					writeLength(mLen - lzoM4MaxLen)
+				}
+				out = append(out, byte(mOff<<2), byte(mOff>>6))
+			}
+			//check for another match right away, without skipping ahead.
+			if ip+4 > len(in) {
+				break
+			}
+			dv = binary.LittleEndian.Uint32(in[ip:])
+			hash = (dv * 0x1824429d) >> (32 - lzoDictBits)
+			mPos = int(dict[hash])
+			dict[hash] = int32(ip)
+			if ip-mPos > lzoM4MaxOffset || ip == mPos || dv != binary.LittleEndian.Uint32(in[mPos:]) {
+				break
+			}
+		}
+	}
+	writeLiterals(len(in))
+	//end of stream marker
+	return append(out, lzoM4Marker|1, 0, 0)
+}
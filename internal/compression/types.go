@@ -2,8 +2,10 @@ package compression
 
 import "io"
 
-//Compressor is a squashfs decompressor interface. Allows for easy compression.
+//Compressor is a squashfs compressor interface. Allows for easy compression.
+//Compressors can also decompress, so already written data can be read back.
 type Compressor interface {
+	Decompressor
 	Compress([]byte) ([]byte, error)
 }
 
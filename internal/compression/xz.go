@@ -2,10 +2,41 @@ package compression
 
 import (
 	"bytes"
+	"crypto/sha256"
 	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"hash/crc64"
 	"io"
 
 	"github.com/ulikunitz/xz"
+	"github.com/ulikunitz/xz/lzma"
+)
+
+//The BCJ filters that can be set in Xz.Filters. These are the same values mksquashfs uses for -Xbcj.
+const (
+	XzFilterX86 = 1 << iota
+	XzFilterPowerPC
+	XzFilterIA64
+	XzFilterArm
+	XzFilterArmThumb
+	XzFilterSparc
+)
+
+//xzFilterIDs are the xz filter IDs for each of the XzFilter bits, in order.
+var xzFilterIDs = []uint64{bcjX86, bcjPowerPC, bcjIA64, bcjArm, bcjArmThumb, bcjSparc}
+
+const (
+	xzLzma2FilterID = 0x21
+	xzCheckNone     = 0x00
+	xzCheckCRC32    = 0x01
+	xzCheckCRC64    = 0x04
+	xzCheckSHA256   = 0x0A
+)
+
+var (
+	xzHeaderMagic = []byte{0xFD, '7', 'z', 'X', 'Z', 0x00}
+	xzFooterMagic = []byte{'Y', 'Z'}
 )
 
 type xzInit struct {
@@ -14,8 +45,12 @@ type xzInit struct {
 }
 
 //Xz is a Xz decompressor.
+//
+//When compressing with Filters set, each of the set BCJ filters is tried (along with no filter) and the smallest result is used, the same as mksquashfs.
+//When decompressing, the filters are read from the data itself, so Filters doesn't need to be set.
 type Xz struct {
 	DictionarySize int32
+	Filters        int32
 	HasFilters     bool
 }
 
@@ -28,21 +63,49 @@ func NewXzCompressorWithOptions(rdr io.Reader) (*Xz, error) {
 		return nil, err
 	}
 	x.DictionarySize = init.DictionarySize
-	//TODO: When I can do filters, parse the filters
-	if init.Filters != 0 {
-		x.HasFilters = true
+	x.Filters = init.Filters
+	if init.Filters&^(1<<len(xzFilterIDs)-1) != 0 {
+		return nil, errors.New("XZ compression options has unknown filters")
 	}
+	x.HasFilters = x.Filters != 0
 	return &x, nil
 }
 
 //Decompress decompresses all the data from the rdr and returns the uncompressed bytes.
 func (x *Xz) Decompress(rdr io.Reader) ([]byte, error) {
-	r, err := xz.NewReader(rdr)
+	data, err := io.ReadAll(rdr)
+	if err != nil {
+		return nil, err
+	}
+	hdr, err := readXzBlockHeader(data)
 	if err != nil {
 		return nil, err
 	}
-	r.DictCap = int(x.DictionarySize)
-	err = r.Verify()
+	if hdr.bcj == 0 {
+		var r *xz.Reader
+		r, err = xz.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		r.DictCap = int(x.DictionarySize)
+		err = r.Verify()
+		if err != nil {
+			return nil, err
+		}
+		var buf bytes.Buffer
+		_, err = io.Copy(&buf, r)
+		if err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	}
+	//The xz library doesn't support BCJ filters, so the LZMA2 data is decompressed directly and the filter is applied after.
+	//Since the library isn't reading the stream, the index and check are verified here.
+	compressed, check, size, err := xzBlockData(data, hdr)
+	if err != nil {
+		return nil, err
+	}
+	r, err := lzma.Reader2Config{DictCap: hdr.dictCap}.NewReader2(bytes.NewReader(compressed))
 	if err != nil {
 		return nil, err
 	}
@@ -51,25 +114,326 @@ func (x *Xz) Decompress(rdr io.Reader) ([]byte, error) {
 	if err != nil {
 		return nil, err
 	}
-	return buf.Bytes(), nil
+	out := buf.Bytes()
+	if uint64(len(out)) != size {
+		return nil, errXzCorrupt
+	}
+	bcjFilter(hdr.bcj, out, hdr.bcjStart, false)
+	err = xzVerifyCheck(hdr.check, check, out)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
 }
 
 //Compress implements compression.Compress
 func (x *Xz) Compress(data []byte) ([]byte, error) {
 	var buf bytes.Buffer
-	w, err := xz.NewWriter(&buf)
+	//The kernel only supports CRC32 checks.
+	w, err := xz.WriterConfig{
+		DictCap:  int(x.DictionarySize),
+		CheckSum: xz.CRC32,
+	}.NewWriter(&buf)
 	if err != nil {
 		return nil, err
 	}
-	w.DictCap = int(x.DictionarySize)
-	err = w.Verify()
+	_, err = w.Write(data)
 	if err != nil {
 		return nil, err
 	}
-	_, err = w.Write(data)
+	err = w.Close()
+	if err != nil {
+		return nil, err
+	}
+	out := buf.Bytes()
+	for i, id := range xzFilterIDs {
+		if x.Filters&(1<<i) == 0 {
+			continue
+		}
+		var filtered []byte
+		filtered, err = x.compressWithBCJ(data, id)
+		if err != nil {
+			return nil, err
+		}
+		if len(filtered) < len(out) {
+			out = filtered
+		}
+	}
+	return out, nil
+}
+
+//compressWithBCJ creates a xz stream that uses the given BCJ filter before LZMA2.
+func (x *Xz) compressWithBCJ(data []byte, bcj uint64) ([]byte, error) {
+	filtered := make([]byte, len(data))
+	copy(filtered, data)
+	bcjFilter(bcj, filtered, 0, true)
+	var lzmaData bytes.Buffer
+	w, err := lzma.Writer2Config{DictCap: int(x.DictionarySize)}.NewWriter2(&lzmaData)
+	if err != nil {
+		return nil, err
+	}
+	_, err = w.Write(filtered)
+	if err != nil {
+		return nil, err
+	}
+	err = w.Close()
 	if err != nil {
 		return nil, err
 	}
-	w.Close()
-	return buf.Bytes(), nil
+	dictCap := int(x.DictionarySize)
+	if dictCap == 0 {
+		dictCap = 8 * 1024 * 1024
+	}
+	var out bytes.Buffer
+	//stream header
+	out.Write(xzHeaderMagic)
+	flags := []byte{0x00, xzCheckCRC32}
+	out.Write(flags)
+	binary.Write(&out, binary.LittleEndian, crc32.ChecksumIEEE(flags))
+	//block header
+	blockHdr := []byte{0, 0x01} //size is filled in below. 2 filters.
+	blockHdr = appendXzVLI(blockHdr, bcj)
+	blockHdr = appendXzVLI(blockHdr, 0)
+	blockHdr = appendXzVLI(blockHdr, xzLzma2FilterID)
+	blockHdr = appendXzVLI(blockHdr, 1)
+	blockHdr = append(blockHdr, xzLzma2DictProp(dictCap))
+	for (len(blockHdr)+4)%4 != 0 {
+		blockHdr = append(blockHdr, 0)
+	}
+	blockHdr[0] = byte((len(blockHdr)+4)/4 - 1)
+	out.Write(blockHdr)
+	binary.Write(&out, binary.LittleEndian, crc32.ChecksumIEEE(blockHdr))
+	out.Write(lzmaData.Bytes())
+	for i := lzmaData.Len(); i%4 != 0; i++ {
+		out.WriteByte(0)
+	}
+	binary.Write(&out, binary.LittleEndian, crc32.ChecksumIEEE(data))
+	//index
+	index := []byte{0x00, 0x01}
+	index = appendXzVLI(index, uint64(len(blockHdr)+4+lzmaData.Len()+4))
+	index = appendXzVLI(index, uint64(len(data)))
+	for len(index)%4 != 0 {
+		index = append(index, 0)
+	}
+	index = append(index, 0, 0, 0, 0)
+	binary.LittleEndian.PutUint32(index[len(index)-4:], crc32.ChecksumIEEE(index[:len(index)-4]))
+	out.Write(index)
+	//stream footer
+	footer := make([]byte, 6)
+	binary.LittleEndian.PutUint32(footer, uint32(len(index)/4-1))
+	copy(footer[4:], flags)
+	binary.Write(&out, binary.LittleEndian, crc32.ChecksumIEEE(footer))
+	out.Write(footer)
+	out.Write(xzFooterMagic)
+	return out.Bytes(), nil
+}
+
+var errXzCorrupt = errors.New("XZ data is corrupt")
+
+//xzBlockHeader is the information needed from the first block header of a xz stream.
+type xzBlockHeader struct {
+	size     int    //where the compressed data starts, relative to the beginning of the stream
+	bcj      uint64 //the BCJ filter ID, or 0 if there isn't one
+	bcjStart uint32
+	dictCap  int
+	check    byte //the stream's check type
+}
+
+//readXzBlockHeader reads the stream header and first block header of a xz stream. The CRC32s of both are checked.
+func readXzBlockHeader(data []byte) (hdr xzBlockHeader, err error) {
+	if len(data) < 13 || !bytes.Equal(data[:6], xzHeaderMagic) {
+		return hdr, errXzCorrupt
+	}
+	if data[6] != 0 || crc32.ChecksumIEEE(data[6:8]) != binary.LittleEndian.Uint32(data[8:12]) {
+		return hdr, errXzCorrupt
+	}
+	hdr.check = data[7]
+	//A size of 0 is the index indicator, which means there isn't a block.
+	if data[12] == 0 {
+		return hdr, errXzCorrupt
+	}
+	hdr.size = 12 + (int(data[12])+1)*4
+	if len(data) < hdr.size {
+		return hdr, errXzCorrupt
+	}
+	if crc32.ChecksumIEEE(data[12:hdr.size-4]) != binary.LittleEndian.Uint32(data[hdr.size-4:hdr.size]) {
+		return hdr, errXzCorrupt
+	}
+	block := data[13 : hdr.size-4]
+	if len(block) < 2 {
+		return hdr, errXzCorrupt
+	}
+	flags := block[0]
+	block = block[1:]
+	//compressed and uncompressed sizes. Not needed.
+	for _, bit := range []byte{0x40, 0x80} {
+		if flags&bit == bit {
+			_, block, err = readXzVLI(block)
+			if err != nil {
+				return
+			}
+		}
+	}
+	for i := 0; i <= int(flags&0x3); i++ {
+		var id, propSize uint64
+		id, block, err = readXzVLI(block)
+		if err != nil {
+			return
+		}
+		propSize, block, err = readXzVLI(block)
+		if err != nil {
+			return
+		}
+		if uint64(len(block)) < propSize {
+			return hdr, errXzCorrupt
+		}
+		props := block[:propSize]
+		block = block[propSize:]
+		switch {
+		case id == xzLzma2FilterID:
+			if len(props) != 1 || props[0] > 40 {
+				return hdr, errXzCorrupt
+			}
+			hdr.dictCap = xzLzma2DictSize(props[0])
+		case id >= bcjX86 && id <= bcjSparc:
+			hdr.bcj = id
+			if len(props) == 4 {
+				hdr.bcjStart = binary.LittleEndian.Uint32(props)
+			}
+		default:
+			return hdr, errors.New("XZ data uses an unsupported filter")
+		}
+	}
+	return
+}
+
+//xzCheckSize returns the size of the check field for the check type.
+func xzCheckSize(check byte) (int, error) {
+	switch check {
+	case xzCheckNone:
+		return 0, nil
+	case xzCheckCRC32:
+		return 4, nil
+	case xzCheckCRC64:
+		return 8, nil
+	case xzCheckSHA256:
+		return 32, nil
+	}
+	return 0, errors.New("XZ data uses an unsupported check")
+}
+
+//xzBlockData finds the compressed data and check of the stream's block using the stream's index, which has the block's size.
+//The stream footer and index are checked, and the stream must only have one block (the same as the kernel).
+//The uncompressed size of the block is also returned.
+func xzBlockData(data []byte, hdr xzBlockHeader) (compressed, check []byte, size uint64, err error) {
+	checkSize, err := xzCheckSize(hdr.check)
+	if err != nil {
+		return
+	}
+	if len(data) < hdr.size+12 || !bytes.Equal(data[len(data)-2:], xzFooterMagic) {
+		return nil, nil, 0, errXzCorrupt
+	}
+	footer := data[len(data)-12:]
+	if crc32.ChecksumIEEE(footer[4:10]) != binary.LittleEndian.Uint32(footer) || !bytes.Equal(footer[8:10], data[6:8]) {
+		return nil, nil, 0, errXzCorrupt
+	}
+	indexSize := (int(binary.LittleEndian.Uint32(footer[4:])) + 1) * 4
+	indexStart := len(data) - 12 - indexSize
+	if indexStart < hdr.size {
+		return nil, nil, 0, errXzCorrupt
+	}
+	index := data[indexStart : len(data)-12]
+	if index[0] != 0 || crc32.ChecksumIEEE(index[:indexSize-4]) != binary.LittleEndian.Uint32(index[indexSize-4:]) {
+		return nil, nil, 0, errXzCorrupt
+	}
+	records, rest, err := readXzVLI(index[1:])
+	if err != nil {
+		return
+	}
+	if records != 1 {
+		return nil, nil, 0, errors.New("XZ data has more then one block")
+	}
+	unpadded, rest, err := readXzVLI(rest)
+	if err != nil {
+		return
+	}
+	size, _, err = readXzVLI(rest)
+	if err != nil {
+		return
+	}
+	//The unpadded size is the block header, the compressed data, and the check.
+	compressedEnd := 12 + int(unpadded) - checkSize
+	checkStart := (compressedEnd + 3) &^ 3
+	if unpadded > uint64(len(data)) || compressedEnd < hdr.size || checkStart+checkSize != indexStart {
+		return nil, nil, 0, errXzCorrupt
+	}
+	for _, b := range data[compressedEnd:checkStart] {
+		if b != 0 {
+			return nil, nil, 0, errXzCorrupt
+		}
+	}
+	return data[hdr.size:compressedEnd], data[checkStart:indexStart], size, nil
+}
+
+//xzVerifyCheck checks the uncompressed data against the block's check.
+func xzVerifyCheck(checkType byte, check, data []byte) error {
+	var sum []byte
+	switch checkType {
+	case xzCheckNone:
+		return nil
+	case xzCheckCRC32:
+		sum = make([]byte, 4)
+		binary.LittleEndian.PutUint32(sum, crc32.ChecksumIEEE(data))
+	case xzCheckCRC64:
+		sum = make([]byte, 8)
+		binary.LittleEndian.PutUint64(sum, crc64.Checksum(data, crc64.MakeTable(crc64.ECMA)))
+	case xzCheckSHA256:
+		hash := sha256.Sum256(data)
+		sum = hash[:]
+	}
+	if !bytes.Equal(sum, check) {
+		return errors.New("XZ data's check doesn't match")
+	}
+	return nil
+}
+
+//xzLzma2DictSize decodes the LZMA2 dictionary size property.
+func xzLzma2DictSize(prop byte) int {
+	if prop == 40 {
+		return lzma.MaxDictCap
+	}
+	size := (2 | int(prop&1)) << (prop/2 + 11)
+	if size < lzma.MinDictCap {
+		size = lzma.MinDictCap
+	}
+	return size
+}
+
+//xzLzma2DictProp encodes the smallest LZMA2 dictionary size property that can hold dictCap.
+func xzLzma2DictProp(dictCap int) byte {
+	for prop := byte(0); prop < 40; prop++ {
+		if (2|int(prop&1))<<(prop/2+11) >= dictCap {
+			return prop
+		}
+	}
+	return 40
+}
+
+func readXzVLI(data []byte) (uint64, []byte, error) {
+	var out uint64
+	for i := 0; i < 9 && i < len(data); i++ {
+		out |= uint64(data[i]&0x7F) << (7 * i)
+		if data[i]&0x80 == 0 {
+			return out, data[i+1:], nil
+		}
+	}
+	return 0, nil, errXzCorrupt
+}
+
+func appendXzVLI(data []byte, val uint64) []byte {
+	for val >= 0x80 {
+		data = append(data, byte(val)|0x80)
+		val >>= 7
+	}
+	return append(data, byte(val))
 }
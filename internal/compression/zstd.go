@@ -36,16 +36,18 @@ func (z *Zstd) Decompress(r io.Reader) ([]byte, error) {
 }
 
 //Compress impelements compression.Compress
+//If CompressionLevel isn't set, the default of 15 is used (the same as mksquashfs).
 func (z *Zstd) Compress(data []byte) ([]byte, error) {
-	var buf bytes.Buffer
-	w, err := zstd.NewWriter(&buf, zstd.WithEncoderLevel(zstd.EncoderLevel(z.CompressionLevel)))
-	if err != nil {
-		return nil, err
+	level := int(z.CompressionLevel)
+	if level == 0 {
+		level = 15
 	}
-	_, err = w.Write(data)
+	//Blocks are already compressed in parallel, so the encoder doesn't need to be.
+	//The kernel only allows a window as large as the block size, so the frame is a single segment, which uses the data's size as the window.
+	enc, err := zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(level)), zstd.WithEncoderConcurrency(1), zstd.WithSingleSegment(true))
 	if err != nil {
 		return nil, err
 	}
-	w.Close()
-	return buf.Bytes(), nil
+	defer enc.Close()
+	return enc.EncodeAll(data, nil), nil
 }
@@ -92,3 +92,36 @@ func NewDirectory(base io.Reader, size uint32) (*Directory, error) {
 	}
 	return &dir, nil
 }
+
+//Find reads the directory from rdr, which must be at the start of a header, and returns the entry with the given name.
+//size is the amount of directory data left to read. Entries are sorted by name, so reading stops as soon as the name is passed.
+//If no entry has the given name, nil is returned.
+func Find(rdr io.Reader, size uint32, name string) (*Entry, error) {
+	var read uint32
+	for {
+		var hdr Header
+		if read+uint32(binary.Size(hdr)) > size {
+			return nil, nil
+		}
+		err := binary.Read(rdr, binary.LittleEndian, &hdr)
+		if err != nil {
+			return nil, err
+		}
+		read += uint32(binary.Size(hdr))
+		hdr.Count++
+		for i := uint32(0); i < hdr.Count; i++ {
+			var ent Entry
+			ent, err = NewEntry(rdr)
+			if err != nil {
+				return nil, err
+			}
+			read += uint32(binary.Size(ent.EntryRaw)) + uint32(len(ent.Name))
+			if ent.Name == name {
+				ent.Header = &hdr
+				return &ent, nil
+			} else if ent.Name > name {
+				return nil, nil
+			}
+		}
+	}
+}
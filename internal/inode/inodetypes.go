@@ -129,8 +129,9 @@ func NewFile(rdr io.Reader, blockSize uint32) (File, error) {
 		return inode, err
 	}
 	inode.Fragmented = inode.FragmentIndex != 0xFFFFFFFF
+	//if fragmented, the tail end of the file is stored in the fragment, so no block size is stored for it
 	blocks := inode.Size / blockSize
-	if inode.Size%blockSize > 0 {
+	if !inode.Fragmented && inode.Size%blockSize > 0 {
 		blocks++
 	}
 	inode.BlockSizes = make([]uint32, blocks, blocks)
@@ -164,8 +165,9 @@ func NewExtendedFile(rdr io.Reader, blockSize uint32) (ExtFile, error) {
 		return inode, err
 	}
 	inode.Fragmented = inode.FragmentIndex != 0xFFFFFFFF
+	//if fragmented, the tail end of the file is stored in the fragment, so no block size is stored for it
 	blocks := inode.Size / uint64(blockSize)
-	if inode.Size%uint64(blockSize) > 0 {
+	if !inode.Fragmented && inode.Size%uint64(blockSize) > 0 {
 		blocks++
 	}
 	inode.BlockSizes = make([]uint32, blocks, blocks)
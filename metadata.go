@@ -7,17 +7,14 @@ import (
 	"io"
 )
 
-type metadata struct {
-	raw        uint16
-	size       uint16
-	compressed bool
-}
+//metadataSize is the maximum uncompressed size of a metadata block.
+const metadataSize = 8192
 
 //MetadataReader is a block reader for metadata. It will automatically read the next block, when it reaches the end of a block.
 type metadataReader struct {
 	s          *Reader
-	headers    []*metadata
-	data       []byte
+	blocks     [][]byte //The blocks read so far. They're shared with the cache, so they must never be modified.
+	size       int      //The total size of blocks.
 	offset     int64
 	readOffset int
 }
@@ -27,11 +24,7 @@ func (s *Reader) newMetadataReader(offset int64) (*metadataReader, error) {
 	var br metadataReader
 	br.s = s
 	br.offset = offset
-	err := br.parseMetadata()
-	if err != nil {
-		return nil, err
-	}
-	err = br.readNextDataBlock()
+	err := br.readNextDataBlock()
 	if err != nil {
 		return nil, err
 	}
@@ -63,77 +56,78 @@ func processInodeRef(inodeRef uint64) (tableOffset uint64, metaOffset uint64) {
 	return
 }
 
-func (br *metadataReader) parseMetadata() error {
+//readMetadataBlock returns the decompressed metadata block at the given offset, using the Reader's cache if possible.
+func (s *Reader) readMetadataBlock(offset int64) (*cachedBlock, error) {
+	if block, ok := s.cache.get(offset); ok {
+		return block, nil
+	}
 	var raw uint16
-	err := binary.Read(io.NewSectionReader(br.s.r, br.offset, 2), binary.LittleEndian, &raw)
+	err := binary.Read(io.NewSectionReader(s.r, offset, 2), binary.LittleEndian, &raw)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	br.offset += 2
 	compressed := raw&0x8000 != 0x8000
 	size := raw &^ 0x8000
-	br.headers = append(br.headers, &metadata{
-		raw:        raw,
-		size:       size,
-		compressed: compressed,
-	})
-	return nil
-}
-
-func (br *metadataReader) readNextDataBlock() error {
-	meta := br.headers[len(br.headers)-1]
-	r := io.NewSectionReader(br.s.r, br.offset, int64(meta.size))
-	if meta.compressed {
-		byts, err := br.s.decompressor.Decompress(r)
+	block := &cachedBlock{
+		offset: offset,
+		next:   offset + 2 + int64(size),
+	}
+	r := io.NewSectionReader(s.r, offset+2, int64(size))
+	if compressed {
+		block.data, err = s.decompressor.Decompress(r)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		var buf bytes.Buffer
+		_, err = io.Copy(&buf, r)
 		if err != nil {
-			return err
+			return nil, err
 		}
-		br.offset += int64(meta.size)
-		br.data = append(br.data, byts...)
-		return nil
+		block.data = buf.Bytes()
 	}
-	var buf bytes.Buffer
-	_, err := io.Copy(&buf, r)
+	s.cache.add(block)
+	return block, nil
+}
+
+//readNextDataBlock reads the metadata block at the current offset and adds it to the blocks.
+func (br *metadataReader) readNextDataBlock() error {
+	block, err := br.s.readMetadataBlock(br.offset)
 	if err != nil {
 		return err
 	}
-	br.offset += int64(meta.size)
-	br.data = append(br.data, buf.Bytes()...)
+	br.offset = block.next
+	br.blocks = append(br.blocks, block.data)
+	br.size += len(block.data)
 	return nil
 }
 
-//Read reads bytes into the given byte slice. Returns the amount of data read.
-func (br *metadataReader) Read(p []byte) (int, error) {
-	if br.readOffset+len(p) <= len(br.data) {
-		for i := 0; i < len(p); i++ {
-			p[i] = br.data[br.readOffset+i]
+//blockAt returns the block holding the given position, and the position inside the block. pos must be less then size.
+func (br *metadataReader) blockAt(pos int) ([]byte, int) {
+	start := br.size
+	for i := len(br.blocks) - 1; i >= 0; i-- {
+		start -= len(br.blocks[i])
+		if pos >= start {
+			return br.blocks[i], pos - start
 		}
-		br.readOffset += len(p)
-		return len(p), nil
 	}
+	return nil, 0
+}
+
+//Read reads bytes into the given byte slice. Returns the amount of data read.
+func (br *metadataReader) Read(p []byte) (int, error) {
 	read := 0
 	for read < len(p) {
-		err := br.parseMetadata()
-		if err != nil {
-			br.readOffset += read
-			return read, err
-		}
-		err = br.readNextDataBlock()
-		if err != nil {
-			br.readOffset += read
-			return read, err
-		}
-		for ; read < len(p); read++ {
-			if br.readOffset+read < len(br.data) {
-				p[read] = br.data[br.readOffset+read]
-			} else {
-				break
+		for br.readOffset >= br.size {
+			err := br.readNextDataBlock()
+			if err != nil {
+				return read, err
 			}
 		}
-	}
-	br.readOffset += read
-	if read != len(p) {
-		return read, errors.New("Didn't read enough data")
+		block, pos := br.blockAt(br.readOffset)
+		n := copy(p[read:], block[pos:])
+		read += n
+		br.readOffset += n
 	}
 	return read, nil
 }
@@ -146,39 +140,29 @@ func (br *metadataReader) Seek(offset int64, whence int) (int64, error) {
 	case io.SeekCurrent:
 		br.readOffset += int(offset)
 		for {
-			if br.readOffset < len(br.data) {
+			if br.readOffset < br.size {
 				break
 			}
-			err := br.parseMetadata()
+			err := br.readNextDataBlock()
 			if err != nil {
-				br.readOffset = len(br.data)
-				return int64(br.readOffset), err
-			}
-			err = br.readNextDataBlock()
-			if err != nil {
-				br.readOffset = len(br.data)
+				br.readOffset = br.size
 				return int64(br.readOffset), err
 			}
 		}
 	case io.SeekStart:
 		br.readOffset = int(offset)
 		for {
-			if br.readOffset < len(br.data) {
+			if br.readOffset < br.size {
 				break
 			}
-			err := br.parseMetadata()
-			if err != nil {
-				br.readOffset = len(br.data)
-				return int64(br.readOffset), err
-			}
-			err = br.readNextDataBlock()
+			err := br.readNextDataBlock()
 			if err != nil {
-				br.readOffset = len(br.data)
+				br.readOffset = br.size
 				return int64(br.readOffset), err
 			}
 		}
 	case io.SeekEnd:
-		br.readOffset = len(br.data) - int(offset)
+		br.readOffset = br.size - int(offset)
 		if br.readOffset < 0 {
 			br.readOffset = 0
 			return int64(br.readOffset), errors.New("Trying to seek to a negative value")
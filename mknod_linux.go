@@ -0,0 +1,29 @@
+//go:build linux
+// +build linux
+
+package squashfs
+
+import (
+	"os"
+	"syscall"
+)
+
+//mknod creates a device, FIFO, or socket at path. mode is the file's type and permissions, and dev is the device number as stored in the archive.
+func mknod(path string, mode os.FileMode, dev uint32) error {
+	var typ uint32
+	switch {
+	case mode&os.ModeCharDevice == os.ModeCharDevice:
+		typ = syscall.S_IFCHR
+	case mode&os.ModeDevice == os.ModeDevice:
+		typ = syscall.S_IFBLK
+	case mode&os.ModeNamedPipe == os.ModeNamedPipe:
+		typ = syscall.S_IFIFO
+	case mode&os.ModeSocket == os.ModeSocket:
+		typ = syscall.S_IFSOCK
+	}
+	err := syscall.Mknod(path, typ|uint32(mode.Perm()), int(dev))
+	if err != nil {
+		return &os.PathError{Op: "mknod", Path: path, Err: err}
+	}
+	return nil
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+// +build !linux
+
+package squashfs
+
+import "os"
+
+func mknod(path string, mode os.FileMode, dev uint32) error {
+	return &os.PathError{Op: "mknod", Path: path, Err: errMknodUnsupported}
+}
@@ -22,27 +22,34 @@ var (
 	errIncompatibleCompression = errors.New("Compression type unsupported")
 	//ErrCompressorOptions is returned if compressor options is present. It's not currently supported.
 	errCompressorOptions = errors.New("Compressor options is not currently supported")
-	//ErrOptions is returned when compression options that I haven't tested is set. When this is returned, the Reader is also returned.
+	//ErrOptions was returned when compression options that I haven't tested is set.
+	//
+	//Deprecated: All compression options are now supported, so this is never returned.
 	ErrOptions = errors.New("Possibly incompatible compressor options")
 )
 
-//TODO: implement fs.FS, possibly more FS types for compatibility. Most of this work will mostly be handed off to root anyway so this shouldn't be too difficult.
+//Reader also implements fs.FS, fs.ReadDirFS, fs.StatFS, fs.ReadFileFS, fs.GlobFS, fs.SubFS, and SymlinkFS. See fs.go
 
 //Reader processes and reads a squashfs archive.
 type Reader struct {
-	r            io.ReaderAt
-	decompressor compression.Decompressor
-	root         *File
-	fragOffsets  []uint64
-	idTable      []uint32
-	super        superblock
-	flags        SuperblockFlags
+	r             io.ReaderAt
+	decompressor  compression.Decompressor
+	cache         *blockCache
+	root          *File
+	fragOffsets   []uint64
+	idTable       []uint32
+	xattrOffsets  []uint64
+	exportOffsets []uint64
+	xattrHeader   xattrTableHeader
+	super         superblock
+	flags         SuperblockFlags
 }
 
 //NewSquashfsReader returns a new squashfs.Reader from an io.ReaderAt
 func NewSquashfsReader(r io.ReaderAt) (*Reader, error) {
 	var rdr Reader
 	rdr.r = r
+	rdr.cache = newBlockCache(DefaultCacheSize)
 	err := binary.Read(io.NewSectionReader(rdr.r, 0, int64(binary.Size(rdr.super))), binary.LittleEndian, &rdr.super)
 	if err != nil {
 		return nil, err
@@ -53,40 +60,42 @@ func NewSquashfsReader(r io.ReaderAt) (*Reader, error) {
 	if rdr.super.BlockLog != uint16(math.Log2(float64(rdr.super.BlockSize))) {
 		return nil, errors.New("BlockSize and BlockLog doesn't match. The archive is probably corrupt")
 	}
-	hasUnsupportedOptions := false
 	rdr.flags = rdr.super.GetFlags()
 	if rdr.flags.compressorOptions {
+		//The options are stored as an uncompressed metadata block right after the superblock, so the block's header is skipped.
+		optionsOffset := int64(binary.Size(rdr.super)) + 2
 		switch rdr.super.CompressionType {
 		case GzipCompression:
 			var gzip *compression.Gzip
-			gzip, err = compression.NewGzipCompressorWithOptions(io.NewSectionReader(rdr.r, int64(binary.Size(rdr.super)), 8))
+			gzip, err = compression.NewGzipCompressorWithOptions(io.NewSectionReader(rdr.r, optionsOffset, 8))
 			if err != nil {
 				return nil, err
 			}
-			if gzip.HasCustomWindow || gzip.HasStrategies {
-				hasUnsupportedOptions = true
-			}
 			rdr.decompressor = gzip
+		case LzoCompression:
+			var lzo *compression.Lzo
+			lzo, err = compression.NewLzoCompressorWithOptions(io.NewSectionReader(rdr.r, optionsOffset, 8))
+			if err != nil {
+				return nil, err
+			}
+			rdr.decompressor = lzo
 		case XzCompression:
 			var xz *compression.Xz
-			xz, err = compression.NewXzCompressorWithOptions(io.NewSectionReader(rdr.r, int64(binary.Size(rdr.super)), 8))
+			xz, err = compression.NewXzCompressorWithOptions(io.NewSectionReader(rdr.r, optionsOffset, 8))
 			if err != nil {
 				return nil, err
 			}
-			if xz.HasFilters {
-				return nil, errors.New("XZ compression options has filters. These are not yet supported")
-			}
 			rdr.decompressor = xz
 		case Lz4Compression:
 			var lz4 *compression.Lz4
-			lz4, err = compression.NewLz4CompressorWithOptions(io.NewSectionReader(rdr.r, int64(binary.Size(rdr.super)), 8))
+			lz4, err = compression.NewLz4CompressorWithOptions(io.NewSectionReader(rdr.r, optionsOffset, 8))
 			if err != nil {
 				return nil, err
 			}
 			rdr.decompressor = lz4
 		case ZstdCompression:
 			var zstd *compression.Zstd
-			zstd, err = compression.NewZstdCompressorWithOptions(io.NewSectionReader(rdr.r, int64(binary.Size(rdr.super)), 4))
+			zstd, err = compression.NewZstdCompressorWithOptions(io.NewSectionReader(rdr.r, optionsOffset, 4))
 			if err != nil {
 				return nil, err
 			}
@@ -100,6 +109,8 @@ func NewSquashfsReader(r io.ReaderAt) (*Reader, error) {
 			rdr.decompressor = &compression.Gzip{}
 		case LzmaCompression:
 			rdr.decompressor = &compression.Lzma{}
+		case LzoCompression:
+			rdr.decompressor = &compression.Lzo{Algorithm: compression.Lzo1x999, CompressionLevel: 8}
 		case XzCompression:
 			rdr.decompressor = &compression.Xz{}
 		case Lz4Compression:
@@ -107,7 +118,6 @@ func NewSquashfsReader(r io.ReaderAt) (*Reader, error) {
 		case ZstdCompression:
 			rdr.decompressor = &compression.Zstd{}
 		default:
-			//TODO: all compression types.
 			return nil, errIncompatibleCompression
 		}
 	}
@@ -147,12 +157,41 @@ func NewSquashfsReader(r io.ReaderAt) (*Reader, error) {
 		}
 		unread -= read
 	}
-	if hasUnsupportedOptions {
-		return &rdr, ErrOptions
+	err = rdr.readXattrTable()
+	if err != nil {
+		return nil, err
+	}
+	err = rdr.readExportTable()
+	if err != nil {
+		return nil, err
 	}
 	return &rdr, nil
 }
 
+//compressorOptions returns the compressor options, as they're stored in the archive, or nil if the archive doesn't have any.
+func (r *Reader) compressorOptions() ([]byte, error) {
+	if !r.flags.compressorOptions {
+		return nil, nil
+	}
+	//The options are an uncompressed metadata block, so the header is just the size (with the uncompressed bit).
+	var header uint16
+	err := binary.Read(io.NewSectionReader(r.r, int64(binary.Size(r.super)), 2), binary.LittleEndian, &header)
+	if err != nil {
+		return nil, err
+	}
+	options := make([]byte, header&^0x8000)
+	_, err = r.r.ReadAt(options, int64(binary.Size(r.super))+2)
+	if err != nil {
+		return nil, err
+	}
+	return options, nil
+}
+
+//Compression returns the type of compression used by the archive, such as GzipCompression.
+func (r *Reader) Compression() int {
+	return int(r.super.CompressionType)
+}
+
 //ModTime is the last time the file was modified/created.
 func (r *Reader) ModTime() time.Time {
 	return time.Unix(int64(r.super.CreationTime), 0)
@@ -1,17 +1,29 @@
 package squashfs
 
 import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"math"
+	"math/rand"
 	"net/http"
 	"os"
 	"os/exec"
 	"strconv"
+	"strings"
+	"sync"
+	"syscall"
 	"testing"
 	"time"
 
 	goappimage "github.com/CalebQ42/GoAppImage"
+	"github.com/CalebQ42/squashfs/internal/compression"
+	"github.com/CalebQ42/squashfs/internal/inode"
 )
 
 const (
@@ -113,6 +125,83 @@ func TestUnsquashfs(t *testing.T) {
 	t.Fatal("HI")
 }
 
+//openTestdata opens one of the reference archives in testdata. See testdata/README.md.
+func openTestdata(t *testing.T, name string) (*Reader, error) {
+	fil, err := os.Open("testdata/" + name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { fil.Close() })
+	return NewSquashfsReader(fil)
+}
+
+//readAllFiles returns the contents of every regular file, and the target of every symlink, in the archive. Other files are skipped.
+func readAllFiles(t *testing.T, rdr *Reader) map[string]string {
+	out := make(map[string]string)
+	err := fs.WalkDir(rdr, ".", func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		fil := rdr.GetFileAtPath(path)
+		if fil.IsSymlink() {
+			out[path] = "-> " + fil.SymlinkPath()
+			return nil
+		} else if !fil.IsFile() {
+			return nil
+		}
+		data, err := rdr.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		out[path] = string(data)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return out
+}
+
+func TestReaderCompressors(t *testing.T) {
+	gzipRdr, err := openTestdata(t, "gzip_options.sqfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	gzip := gzipRdr.decompressor.(*compression.Gzip)
+	if gzip.CompressionLevel != 6 || gzip.WindowSize != 12 || !gzip.HasCustomWindow {
+		t.Fatal("Gzip options read wrong:", gzip.CompressionLevel, gzip.WindowSize, gzip.HasCustomWindow)
+	}
+	want := readAllFiles(t, gzipRdr)
+	if len(want) != 6 || want["text.txt"] != strings.Repeat("squashfs ", 150000) || want["dir/link"] != "-> ../small.txt" {
+		t.Fatal("Gzip archive read wrong:", len(want))
+	}
+	for _, name := range []string{"lz4.sqfs", "lzma.sqfs", "lzo.sqfs"} {
+		rdr, err := openTestdata(t, name)
+		if err != nil {
+			t.Fatal(name, err)
+		}
+		got := readAllFiles(t, rdr)
+		if len(got) != len(want) {
+			t.Fatal(name, "has", len(got), "files, expected", len(want))
+		}
+		for path, data := range want {
+			if got[path] != data {
+				t.Fatal(name, path, "doesn't match the gzip archive")
+			}
+		}
+	}
+	rdr, err := openTestdata(t, "lz4.sqfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lz4 := rdr.decompressor.(*compression.Lz4); lz4.HC {
+		t.Fatal("lz4 options read wrong")
+	}
+}
+
 func BenchmarkDragRace(b *testing.B) {
 	wd, err := os.Getwd()
 	if err != nil {
@@ -222,3 +311,838 @@ func TestCreateSquashFromAppImage(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func TestWriteTar(t *testing.T) {
+	tarball, entries := makeTestTar(t)
+	w, err := NewWriterWithOptions(GzipCompression, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.BlockSize = 4096
+	var buf bytes.Buffer
+	_, err = w.ConvertTar(&buf, bytes.NewReader(tarball))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rdr, err := NewSquashfsReader(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	//readTar reads the tar archive and checks that the content of every regular file matches the file in rdr.
+	//Every hard link must point to a file that's in the archive.
+	readTar := func(rdr *Reader, data []byte) map[string]*tar.Header {
+		hdrs := make(map[string]*tar.Header)
+		tr := tar.NewReader(bytes.NewReader(data))
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			hdrs[hdr.Name] = hdr
+			content, err := io.ReadAll(tr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if hdr.Typeflag != tar.TypeReg {
+				continue
+			}
+			want, err := rdr.ReadFile(strings.TrimPrefix(hdr.Name, "./"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(content, want) {
+				t.Errorf("%s content doesn't match", hdr.Name)
+			}
+		}
+		for name, hdr := range hdrs {
+			if hdr.Typeflag == tar.TypeLink && hdrs[hdr.Linkname] == nil {
+				t.Errorf("%s links to %s, which isn't in the tar archive", name, hdr.Linkname)
+			}
+		}
+		return hdrs
+	}
+	var out bytes.Buffer
+	err = rdr.WriteTar(&out, DefaultTarOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	hdrs := readTar(rdr, out.Bytes())
+	//The root and the duplicate etc folder aren't in the output, but dev/ and implicit/ are created by the Writer.
+	if len(hdrs) != len(entries) {
+		t.Errorf("Tar archive has %d entries, wanted %d", len(hdrs), len(entries))
+	}
+	for _, ent := range entries[1 : len(entries)-1] {
+		name := strings.TrimPrefix(ent.hdr.Name, "./")
+		got := hdrs[name]
+		if got == nil {
+			t.Errorf("%s isn't in the tar archive", name)
+			continue
+		}
+		want := ent.hdr
+		if name == "etc/" {
+			want = entries[len(entries)-1].hdr
+		}
+		switch want.Typeflag {
+		case tar.TypeLink:
+			//Hard links point to the first file written with that inode.
+			want.Linkname = "etc/hosts"
+			want.Mode = entries[2].hdr.Mode
+			want.Uid, want.Gid = 10, 20
+		}
+		if got.Typeflag != want.Typeflag || got.Mode != want.Mode || got.Uid != want.Uid || got.Gid != want.Gid ||
+			!got.ModTime.Equal(want.ModTime) || got.Linkname != want.Linkname || got.Devmajor != want.Devmajor || got.Devminor != want.Devminor {
+			t.Errorf("%s is different.\nGot:    %+v\nWanted: %+v", name, got, want)
+		}
+		for key, value := range want.PAXRecords {
+			if strings.HasPrefix(key, "SCHILY.xattr.system.") {
+				continue
+			}
+			if got.PAXRecords[key] != value {
+				t.Errorf("%s has PAX record %s = %q, wanted %q", name, key, got.PAXRecords[key], value)
+			}
+		}
+	}
+	out.Reset()
+	op := DefaultTarOptions()
+	op.HardLinks = false
+	op.Xattrs = false
+	op.Prefix = "./"
+	err = rdr.GetFileAtPath("/etc").WriteTar(&out, op)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hdrs = readTar(rdr, out.Bytes())
+	if len(hdrs) != 4 {
+		t.Errorf("Tar archive of /etc has %d entries, wanted 4", len(hdrs))
+	}
+	for _, name := range []string{"./etc/hosts", "./etc/hosts2"} {
+		if hdrs[name] == nil || hdrs[name].Typeflag != tar.TypeReg {
+			t.Errorf("%s should be a regular file when HardLinks isn't set", name)
+		}
+	}
+	if hdrs["./etc/"] == nil || hdrs["./etc/link"] == nil {
+		t.Error("./etc/ or ./etc/link is missing")
+	}
+	//Converting the tar archive back, then writing it as a tar archive again, should give the same tar archive.
+	out.Reset()
+	err = rdr.WriteTar(&out, DefaultTarOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	firstTar := append([]byte{}, out.Bytes()...)
+	w, err = NewWriterWithOptions(GzipCompression, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf.Reset()
+	_, err = w.ConvertTar(&buf, &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rdr, err = NewSquashfsReader(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	out.Reset()
+	err = rdr.WriteTar(&out, DefaultTarOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(firstTar, out.Bytes()) {
+		t.Error("Converting the tar archive to squashfs and back made a different tar archive")
+	}
+	//Sockets are skipped, so a hard link to a socket isn't written either.
+	ref, err := openTestdata(t, "reference.sqfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	out.Reset()
+	err = ref.WriteTar(&out, DefaultTarOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	hdrs = readTar(ref, out.Bytes())
+	if hdrs["socket"] != nil || hdrs["socket2"] != nil {
+		t.Error("Sockets were written to the tar archive")
+	}
+	//dir/hardlink.txt is written first, so target.txt links to it.
+	if hdrs["target.txt"] == nil || hdrs["target.txt"].Typeflag != tar.TypeLink || hdrs["target.txt"].Linkname != "dir/hardlink.txt" {
+		t.Errorf("target.txt should be a hard link to dir/hardlink.txt: %+v", hdrs["target.txt"])
+	}
+}
+
+func TestExtractSpecial(t *testing.T) {
+	tarball, _ := makeTestTar(t)
+	w, err := NewWriter()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	_, err = w.ConvertTar(&buf, bytes.NewReader(tarball))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rdr, err := NewSquashfsReader(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	//Everything is copied with AddFS to make sure it keeps the devices from the archive.
+	w, err = NewWriter()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = w.AddFS("/", rdr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var copied bytes.Buffer
+	_, err = w.WriteTo(&copied)
+	if err != nil {
+		t.Fatal(err)
+	}
+	copyRdr, err := NewSquashfsReader(bytes.NewReader(copied.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		mode os.FileMode
+		rdev uint64
+	}{
+		{"/dev/null", os.ModeDevice | os.ModeCharDevice | 0666, 0x103},
+		{"/dev/sda1", os.ModeDevice | 0660, 0x10082c},
+		{"/dev/fifo", os.ModeNamedPipe | 0600, 0},
+	}
+	for _, r := range []*Reader{rdr, copyRdr} {
+		for _, test := range tests {
+			fil := r.GetFileAtPath(test.name)
+			if fil == nil {
+				t.Fatal(test.name, "is missing")
+			}
+			if fil.Mode() != test.mode || fil.Rdev() != test.rdev {
+				t.Errorf("%s has mode %v and device %#x. Should be %v and %#x", test.name, fil.Mode(), fil.Rdev(), test.mode, test.rdev)
+			}
+			if fil.IsDevice() != (test.mode&os.ModeDevice != 0) || fil.IsFifo() != (test.mode&os.ModeNamedPipe != 0) || fil.IsSocket() || fil.IsFile() {
+				t.Errorf("%s has the wrong type", test.name)
+			}
+		}
+	}
+
+	out := t.TempDir()
+	errs := rdr.ExtractTo(out)
+	if len(errs) > 0 {
+		t.Fatal(errs)
+	}
+	for _, test := range tests {
+		stat, err := os.Lstat(out + test.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		mode := test.mode
+		if os.Geteuid() != 0 && mode&os.ModeDevice != 0 {
+			//Without root, devices are extracted as empty files.
+			mode = mode.Perm()
+		}
+		if stat.Mode() != mode {
+			t.Errorf("%s was extracted with mode %v. Should be %v", test.name, stat.Mode(), mode)
+		}
+		if sys, ok := stat.Sys().(*syscall.Stat_t); ok && mode&os.ModeDevice != 0 && uint64(sys.Rdev) != test.rdev {
+			t.Errorf("%s was extracted with device %#x. Should be %#x", test.name, sys.Rdev, test.rdev)
+		}
+	}
+}
+
+func TestReaderSymlinks(t *testing.T) {
+	rdr, err := openTestdata(t, "reference.sqfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	//chain/01 is maxSymlinkHops symlinks away from target.txt, and chain/00 is one more.
+	data, err := rdr.ReadFile("chain/01")
+	if err != nil || string(data) != "root target\n" {
+		t.Errorf("Following %d symlinks returned %q, %v", maxSymlinkHops, data, err)
+	}
+	for _, name := range []string{"chain/00", "loop1", "loop2/file.txt"} {
+		_, err = rdr.Open(name)
+		if !errors.Is(err, errTooManySymlinks) {
+			t.Errorf("Opening %s returned %v, wanted %v", name, err, errTooManySymlinks)
+		}
+	}
+	info, err := rdr.Lstat("loop1")
+	if err != nil || info.Mode()&fs.ModeSymlink == 0 {
+		t.Errorf("Lstat of a symlink loop returned %v, %v", info, err)
+	}
+	//Absolute symlinks are resolved from the root of the FS, so the same symlink points to different files in Sub.
+	data, err = rdr.ReadFile("dir/absolute")
+	if err != nil || string(data) != "root target\n" {
+		t.Errorf("dir/absolute returned %q, %v", data, err)
+	}
+	sub, err := rdr.Sub("dir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err = fs.ReadFile(sub, "absolute")
+	if err != nil || string(data) != "dir target\n" {
+		t.Errorf("absolute inside Sub returned %q, %v", data, err)
+	}
+}
+
+func TestFileReadAt(t *testing.T) {
+	rdr, err := openTestdata(t, "reference.sqfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	open := func(name string) *File {
+		fil, err := rdr.Open(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return fil.(*File)
+	}
+	fil := open("blocks.bin")
+	want, err := io.ReadAll(fil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	//Checksum of the file when the archive is mounted by the kernel.
+	if fmt.Sprintf("%x", sha256.Sum256(want)) != "5c868a9f8b4467d0bcfda83be4d342f4a3a2b58c0855eea67124ae8f9d58c785" {
+		t.Fatal("blocks.bin content doesn't match")
+	}
+	//blocks.bin is 3 4KB blocks and a 1000 byte tail in a fragment.
+	for _, test := range []struct {
+		off  int64
+		size int
+		n    int
+		err  error
+	}{
+		{off: 0, size: len(want), n: len(want)},
+		{off: 4000, size: 200, n: 200},    //Across two blocks.
+		{off: 4000, size: 5000, n: 5000},  //Across three blocks.
+		{off: 12200, size: 200, n: 200},   //From the last block into the fragment.
+		{off: 12288, size: 1000, n: 1000}, //Only the fragment.
+		{off: 13000, size: 288, n: 288},   //Ending right at the end of the file.
+		{off: 13200, size: 200, n: 88, err: io.EOF},
+		{off: 13288, size: 10, err: io.EOF},
+		{off: 20000, size: 10, err: io.EOF},
+		{off: -1, size: 10, err: errNegativeOffset},
+	} {
+		p := make([]byte, test.size)
+		n, err := fil.ReadAt(p, test.off)
+		if n != test.n || err != test.err {
+			t.Errorf("ReadAt(%d bytes, %d) returned %d, %v. Wanted %d, %v", test.size, test.off, n, err, test.n, test.err)
+		} else if n > 0 && !bytes.Equal(p[:n], want[test.off:test.off+int64(n)]) {
+			t.Errorf("ReadAt(%d bytes, %d) read the wrong data", test.size, test.off)
+		}
+	}
+	frag := open("fragment.txt")
+	p := make([]byte, 20)
+	n, err := frag.ReadAt(p, 10)
+	if n != 20 || err != nil || string(p) != strings.Repeat("Only a fragment\n", 2)[10:30] {
+		t.Errorf("ReadAt on a fragment only file returned %q, %v", p[:n], err)
+	}
+	//Seek
+	for _, test := range []struct {
+		offset int64
+		whence int
+		pos    int64
+	}{
+		{offset: 4090, whence: io.SeekStart, pos: 4090},
+		{offset: -5, whence: io.SeekCurrent, pos: 4095}, //After reading 10 bytes at 4090.
+		{offset: -10, whence: io.SeekEnd, pos: int64(len(want)) - 10},
+		{offset: 100, whence: io.SeekEnd, pos: int64(len(want)) + 100},
+	} {
+		pos, err := fil.Seek(test.offset, test.whence)
+		if err != nil || pos != test.pos {
+			t.Errorf("Seek(%d, %d) returned %d, %v. Wanted %d", test.offset, test.whence, pos, err, test.pos)
+			continue
+		}
+		n, err := fil.Read(p[:10])
+		wantN := 10
+		if pos+10 > int64(len(want)) {
+			wantN = len(want) - int(pos)
+			if wantN < 0 {
+				wantN = 0
+			}
+		}
+		if n != wantN || (n == 0 && err != io.EOF) || !bytes.Equal(p[:n], want[pos:pos+int64(n)]) {
+			t.Errorf("Read after Seek(%d, %d) returned %d, %v", test.offset, test.whence, n, err)
+		}
+	}
+	if _, err = fil.Seek(-1, io.SeekStart); err != errNegativeOffset {
+		t.Error("Seeking before the start returned", err)
+	}
+	if _, err = fil.Seek(0, 3); err == nil {
+		t.Error("Seeking with an invalid whence didn't return an error")
+	}
+	//Concurrent ReadAt calls share the File's block cache, and the Reader's. Run with -race.
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(seed int64) {
+			defer wg.Done()
+			rnd := rand.New(rand.NewSource(seed))
+			p := make([]byte, 3000)
+			for j := 0; j < 200; j++ {
+				off := rnd.Int63n(int64(len(want)))
+				n, err := fil.ReadAt(p, off)
+				if (err != nil && err != io.EOF) || !bytes.Equal(p[:n], want[off:off+int64(n)]) {
+					t.Errorf("Concurrent ReadAt(%d) returned %d, %v", off, n, err)
+					return
+				}
+			}
+		}(int64(i))
+	}
+	wg.Wait()
+}
+
+func TestReaderXattrs(t *testing.T) {
+	rdr, err := openTestdata(t, "reference.sqfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	shared := strings.Repeat("shared ", 20)
+	for name, want := range map[string]map[string]string{
+		"xattr.txt":  {"user.test": "value", "user.other": "another value", "user.shared": shared},
+		"dir":        {"user.folder": "folder", "user.shared": shared},
+		"target.txt": {},
+	} {
+		fil := rdr.GetFileAtPath(name)
+		if fil == nil {
+			t.Fatal(name, "not found")
+		}
+		xattrs, err := fil.Xattrs()
+		if err != nil {
+			t.Fatal(name, err)
+		}
+		if len(xattrs) != len(want) {
+			t.Errorf("%s has %d xattrs, wanted %d", name, len(xattrs), len(want))
+		}
+		for key, value := range want {
+			if string(xattrs[key]) != value {
+				t.Errorf("%s has %s = %q, wanted %q", name, key, xattrs[key], value)
+			}
+		}
+	}
+	fil := rdr.GetFileAtPath("xattr.txt")
+	value, err := fil.GetXattr("user.test")
+	if err != nil || string(value) != "value" {
+		t.Errorf("GetXattr returned %q, %v", value, err)
+	}
+	if _, err = fil.GetXattr("user.missing"); err != ErrXattrNotFound {
+		t.Error("GetXattr of a missing xattr returned", err)
+	}
+}
+
+func TestReaderExport(t *testing.T) {
+	rdr, err := openTestdata(t, "reference.sqfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	//Every directory's path is rebuilt from it's parent inode numbers, and every file is found by it's own number.
+	err = fs.WalkDir(rdr, ".", func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		in, err := rdr.GetFileAtPath(path).getInode()
+		if err != nil {
+			return err
+		}
+		fil, err := rdr.FileByInodeNumber(in.Number)
+		if err != nil {
+			return fmt.Errorf("%s: %v", path, err)
+		}
+		filIn, err := fil.getInode()
+		if err != nil {
+			return fmt.Errorf("%s: %v", path, err)
+		}
+		if filIn.Number != in.Number || fil.IsDir() != d.IsDir() {
+			t.Errorf("Inode number %d of %s returned %s", in.Number, path, fil.Path())
+		}
+		if !d.IsDir() {
+			return nil
+		}
+		dirPath, err := rdr.PathByInodeNumber(in.Number)
+		if err != nil {
+			return fmt.Errorf("%s: %v", path, err)
+		}
+		if strings.Trim(dirPath, "/") != strings.TrimPrefix(path, ".") {
+			t.Errorf("%s has the path %s", path, dirPath)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	in, err := rdr.GetFileAtPath("dir/sub/deep").getInode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, err := rdr.FileByInodeNumber(in.Number)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dir.Path() != "/dir/sub/deep" {
+		t.Error("dir/sub/deep has the path", dir.Path())
+	}
+	fil := dir.GetFileAtPath("file.txt")
+	if fil == nil {
+		t.Fatal("file.txt not found in the directory returned by FileByInodeNumber")
+	}
+	data, err := io.ReadAll(fil)
+	if err != nil || string(data) != "deep\n" {
+		t.Errorf("file.txt in dir/sub/deep returned %q, %v", data, err)
+	}
+	for _, n := range []uint32{0, rdr.super.InodeCount + 1} {
+		if _, err = rdr.InodeByNumber(n); err != errInodeNumber {
+			t.Errorf("Inode number %d returned %v, wanted %v", n, err, errInodeNumber)
+		}
+	}
+	in, err = rdr.GetFileAtPath("target.txt").getInode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = rdr.PathByInodeNumber(in.Number); err != errNotDirectory {
+		t.Errorf("PathByInodeNumber of a file returned %v, wanted %v", err, errNotDirectory)
+	}
+	rdr, err = openTestdata(t, "lz4.sqfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = rdr.InodeByNumber(1); err != ErrNotExportable {
+		t.Errorf("Archive without an export table returned %v, wanted %v", err, ErrNotExportable)
+	}
+}
+
+func TestReaderDirIndex(t *testing.T) {
+	rdr, err := openTestdata(t, "reference.sqfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	big := rdr.GetFileAtPath("big")
+	if big == nil {
+		t.Fatal("big not found")
+	}
+	//big has more then 256 entries, so it's split across several headers and metadata blocks and has a directory index.
+	in, err := big.getInode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if in.Type != inode.ExtDirType || len(in.Info.(inode.ExtDir).Indexes) < 2 {
+		t.Fatal("big doesn't have a directory index")
+	}
+	children, err := big.GetChildren()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(children) != 1000 {
+		t.Fatal("big has", len(children), "children")
+	}
+	for _, child := range children {
+		want, err := child.getInode()
+		if err != nil {
+			t.Fatal(child.name, err)
+		}
+		fil, err := big.getChild(child.name)
+		if err != nil {
+			t.Fatal(child.name, err)
+		}
+		got, err := fil.getInode()
+		if err != nil {
+			t.Fatal(child.name, err)
+		}
+		if fil.name != child.name || got.Number != want.Number {
+			t.Errorf("Looking up %s returned %s with inode number %d, wanted %d", child.name, fil.name, got.Number, want.Number)
+		}
+	}
+	//Names before, between, and after the entries, including right after the names in the index.
+	missing := []string{"a", "entry", "entry0000a", "entry1000", "zzz"}
+	for _, ind := range in.Info.(inode.ExtDir).Indexes {
+		missing = append(missing, ind.Name+"a")
+	}
+	for _, name := range missing {
+		if _, err = big.getChild(name); err != fs.ErrNotExist {
+			t.Errorf("Looking up %s returned %v, wanted %v", name, err, fs.ErrNotExist)
+		}
+	}
+}
+
+//errReaderAt fails every read that overlaps start to end while fail is set.
+type errReaderAt struct {
+	r     io.ReaderAt
+	start int64
+	end   int64
+	fail  bool
+}
+
+var errTestRead = errors.New("Test read error")
+
+func (e *errReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	if e.fail && off < e.end && off+int64(len(p)) > e.start {
+		return 0, errTestRead
+	}
+	return e.r.ReadAt(p, off)
+}
+
+func TestReaderLazyInodeErrors(t *testing.T) {
+	fil, err := os.Open("testdata/reference.sqfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fil.Close()
+	errRdr := &errReaderAt{r: fil}
+	rdr, err := NewSquashfsReader(errRdr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	//Make every inode read, other then the already read root, fail, but still allow reading directories.
+	_, err = rdr.GetRootFolder()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rdr.SetCacheSize(0)
+	errRdr.start, errRdr.end = int64(rdr.super.InodeTableStart), int64(rdr.super.DirTableStart)
+	errRdr.fail = true
+	entries, err := rdr.ReadDir(".")
+	if err != nil {
+		t.Fatal("Listing a directory read inodes:", err)
+	}
+	var entry fs.DirEntry
+	for _, e := range entries {
+		if e.Name() == "target.txt" {
+			entry = e
+		}
+	}
+	if entry == nil {
+		t.Fatal("target.txt not found")
+	}
+	if entry.IsDir() || entry.Type() != 0 {
+		t.Error("target.txt has the type", entry.Type())
+	}
+	if _, err = entry.Info(); !errors.Is(err, errTestRead) {
+		t.Errorf("Info returned %v, wanted %v", err, errTestRead)
+	}
+	target := entry.(*File)
+	if target.Size() != 0 || target.Mode() != 0 || !target.ModTime().IsZero() {
+		t.Errorf("File without an inode has size %d, mode %v, and mod time %v", target.Size(), target.Mode(), target.ModTime())
+	}
+	if _, err = target.Read(make([]byte, 1)); !errors.Is(err, errTestRead) {
+		t.Errorf("Read returned %v, wanted %v", err, errTestRead)
+	}
+	if _, err = rdr.ReadFile("target.txt"); !errors.Is(err, errTestRead) {
+		t.Errorf("ReadFile returned %v, wanted %v", err, errTestRead)
+	}
+	if _, err = rdr.ReadDir("dir"); !errors.Is(err, errTestRead) {
+		t.Errorf("ReadDir of a subdirectory returned %v, wanted %v", err, errTestRead)
+	}
+	//The error is kept by the File, but new Files read the inode again.
+	errRdr.fail = false
+	if _, err = entry.Info(); !errors.Is(err, errTestRead) {
+		t.Errorf("Info after the error returned %v, wanted %v", err, errTestRead)
+	}
+	data, err := rdr.ReadFile("target.txt")
+	if err != nil || string(data) != "root target\n" {
+		t.Errorf("ReadFile after the error returned %q, %v", data, err)
+	}
+}
+
+func TestBlockCache(t *testing.T) {
+	cache := newBlockCache(300)
+	add := func(offset int64, size int) {
+		cache.add(&cachedBlock{data: make([]byte, size), offset: offset})
+	}
+	cached := func(offsets ...int64) {
+		t.Helper()
+		cache.mut.Lock()
+		defer cache.mut.Unlock()
+		var got []int64
+		for el := cache.lru.Front(); el != nil; el = el.Next() {
+			got = append(got, el.Value.(*cachedBlock).offset)
+		}
+		if fmt.Sprint(got) != fmt.Sprint(offsets) {
+			t.Errorf("Cached blocks are %v, wanted %v", got, offsets)
+		}
+	}
+	add(0, 100)
+	add(100, 100)
+	add(200, 100)
+	if _, ok := cache.get(0); !ok {
+		t.Fatal("Block 0 not cached")
+	}
+	cached(0, 200, 100)
+	//100 is now the least recently used.
+	add(300, 100)
+	cached(300, 0, 200)
+	if _, ok := cache.get(100); ok {
+		t.Error("Evicted block is still cached")
+	}
+	if _, ok := cache.get(200); !ok {
+		t.Fatal("Block 200 not cached")
+	}
+	add(400, 100)
+	cached(400, 200, 300)
+	if stats := cache.stats(); stats != (CacheStats{Hits: 2, Misses: 1, Evictions: 2, Blocks: 3, Size: 300, Budget: 300}) {
+		t.Errorf("Cache stats are %+v", stats)
+	}
+	//Blocks larger then the budget aren't cached.
+	add(500, 301)
+	cached(400, 200, 300)
+	cache.setBudget(100)
+	cached(400)
+	cache.setBudget(0)
+	cached()
+	add(600, 1)
+	cached()
+	if _, ok := cache.get(600); ok {
+		t.Error("Block cached with a budget of 0")
+	}
+	if stats := cache.stats(); stats != (CacheStats{Hits: 2, Misses: 1, Evictions: 5, Blocks: 0, Size: 0, Budget: 0}) {
+		t.Errorf("Cache stats are %+v", stats)
+	}
+	//A cache that starts disabled doesn't keep track of anything.
+	cache = newBlockCache(0)
+	add(0, 0)
+	add(100, 100)
+	if _, ok := cache.get(0); ok {
+		t.Error("Block cached with a budget of 0")
+	}
+	if stats := cache.stats(); stats != (CacheStats{}) {
+		t.Errorf("Cache stats of a disabled cache are %+v", stats)
+	}
+}
+
+func TestReaderCache(t *testing.T) {
+	rdr, err := openTestdata(t, "reference.sqfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := readAllFiles(t, rdr)
+	stats := rdr.CacheStats()
+	if stats.Hits == 0 || stats.Misses == 0 || stats.Blocks == 0 || stats.Size > stats.Budget {
+		t.Errorf("Cache stats after reading every file are %+v", stats)
+	}
+	rdr.SetCacheSize(0)
+	if stats = rdr.CacheStats(); stats.Blocks != 0 || stats.Size != 0 {
+		t.Errorf("Cache stats after disabling the cache are %+v", stats)
+	}
+	hits := stats.Hits
+	got := readAllFiles(t, rdr)
+	if len(got) != len(want) {
+		t.Errorf("Read %d files with the cache disabled, wanted %d", len(got), len(want))
+	}
+	for path, data := range want {
+		if got[path] != data {
+			t.Errorf("%s is different with the cache disabled", path)
+		}
+	}
+	if stats = rdr.CacheStats(); stats.Hits != hits || stats.Blocks != 0 || stats.Size != 0 {
+		t.Errorf("Cache stats after reading with the cache disabled are %+v", stats)
+	}
+}
+
+func TestLzoDecompress(t *testing.T) {
+	//LZO1X streams put together by hand from the format description in the Linux kernel's Documentation/staging/lzo.rst,
+	//so the decompressor isn't only tested with data from our compressor. Every stream ends with 11 00 00 (end of stream).
+	//testdata/lzo.sqfs has larger ones, which the kernel can mount.
+	for _, test := range []struct {
+		name   string
+		stream string
+		want   string
+	}{
+		//First byte 17+5: copy 5 literals.
+		{"literals", "16 48656c6c6f 110000", "Hello"},
+		//First byte 17+3: copy 3 literals. 27: M3 match of length 2+7 with the distance in the next 2 bytes, (3-1)<<2.
+		{"M3", "14 616263 27 0800 110000", "abcabcabcabc"},
+		//71: M2 match of length 3+1, distance ((71>>2)&7)+(00<<3)+1 = 5, followed by 71&3 = 1 literal.
+		{"M2 with literal", "16 6162636458 71 00 59 110000", "abcdXabcdY"},
+		//An overlapping M3 match, repeating the one literal. 31: length 2+17, distance 1.
+		{"overlapping", "12 61 31 0000 110000", strings.Repeat("a", 20)},
+		//20: M3 match with the length in the next byte, 33+0x42.
+		{"long M3", "12 61 20 42 0000 110000", strings.Repeat("a", 100)},
+	} {
+		stream, err := hex.DecodeString(strings.ReplaceAll(test.stream, " ", ""))
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := (&compression.Lzo{}).Decompress(bytes.NewReader(stream))
+		if err != nil || string(data) != test.want {
+			t.Errorf("%s: decompressed to %q, %v. Wanted %q", test.name, data, err, test.want)
+		}
+	}
+	for _, test := range []struct {
+		name   string
+		stream string
+	}{
+		{"no end of stream", "14 616263 27 0800"},
+		{"distance before the start", "12 61 21 1000 110000"},
+		{"literals past the end", "16 48656c"},
+		{"data after the end of stream", "16 48656c6c6f 110000 00"},
+		{"end of stream with a length", "16 48656c6c6f 120000"},
+	} {
+		stream, _ := hex.DecodeString(strings.ReplaceAll(test.stream, " ", ""))
+		data, err := (&compression.Lzo{}).Decompress(bytes.NewReader(stream))
+		if err == nil {
+			t.Errorf("%s: decompressed to %q without an error", test.name, data)
+		}
+	}
+}
+
+func TestXzDecompress(t *testing.T) {
+	//Made by the xz command line tool. See testdata/README.md.
+	want, err := os.ReadFile("testdata/bcj.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"bcj_x86_crc32.xz", "bcj_arm_crc64.xz", "bcj_x86_sha256.xz", "sha256.xz"} {
+		stream, err := os.ReadFile("testdata/" + name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := (&compression.Xz{}).Decompress(bytes.NewReader(stream))
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		if !bytes.Equal(data, want) {
+			t.Errorf("%s decompressed to the wrong data", name)
+		}
+		//Every part of the stream is covered by a CRC32 or the check, so changing any byte should return an error instead of the wrong data.
+		//Some changes, such as to the size of a LZMA2 chunk, don't change the data. The headers, and the check, index, and footer at
+		//the end are all tested, but only some of the compressed data.
+		corrupt := make([]byte, len(stream))
+		errs, tested := 0, 0
+		for i := 0; i < len(stream); i++ {
+			if i > 64 && i < len(stream)-128 {
+				i += 63
+			}
+			tested++
+			copy(corrupt, stream)
+			corrupt[i] ^= 0x01
+			data, err = (&compression.Xz{}).Decompress(bytes.NewReader(corrupt))
+			if err == nil && !bytes.Equal(data, want) {
+				t.Errorf("%s: changing byte %d of %d returned the wrong data without an error", name, i, len(stream))
+				break
+			} else if err != nil {
+				errs++
+			}
+		}
+		if errs < tested-8 {
+			t.Errorf("%s: only %d of %d changed bytes returned an error", name, errs, tested)
+		}
+	}
+	//The stream header followed by an index indicator instead of a block, whose "CRC32" of nothing is 0, and a truncated block header.
+	stream, err := os.ReadFile("testdata/sha256.xz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, data := range map[string][]byte{
+		"index instead of a block": append(append([]byte{}, stream[:12]...), 0, 0, 0, 0),
+		"truncated block header":   stream[:14],
+	} {
+		_, err = (&compression.Xz{}).Decompress(bytes.NewReader(data))
+		if err == nil {
+			t.Errorf("%s didn't return an error", name)
+		}
+	}
+}
@@ -0,0 +1,163 @@
+package squashfs
+
+import (
+	"archive/tar"
+	"io"
+	"time"
+
+	"github.com/CalebQ42/squashfs/internal/inode"
+)
+
+//TarOptions holds the options used by WriteTar.
+type TarOptions struct {
+	//Prefix is added to the beginning of every name in the tar archive, such as "./".
+	Prefix string
+	//If set, extended attributes are written as PAX records (the same way as GNU tar).
+	Xattrs bool
+	//If set, files that share the same inode are written as hard links. Otherwise, each one is written as a separate file.
+	HardLinks bool
+}
+
+//DefaultTarOptions returns TarOptions that keep xattrs and hard links.
+func DefaultTarOptions() TarOptions {
+	return TarOptions{
+		Xattrs:    true,
+		HardLinks: true,
+	}
+}
+
+//WriteTar writes everything in the archive to w as a tar archive using the given options.
+//The root folder itself isn't written, so names are relative to the root (such as "usr/bin/").
+//Sockets can't be stored in tar archives, so they're skipped.
+func (r *Reader) WriteTar(w io.Writer, op TarOptions) error {
+	root, err := r.GetRootFolder()
+	if err != nil {
+		return err
+	}
+	return root.WriteTar(w, op)
+}
+
+//WriteTar writes the File to w as a tar archive. If the File is a folder, everything inside of it is also written.
+//Names are relative to the File's parent folder (such as "folder/file").
+//
+//Permissions, ownership, modification times, symlinks, hard links, devices, FIFOs, and (if op.Xattrs is set) xattrs are kept.
+//Sockets can't be stored in tar archives, so they're skipped.
+func (f *File) WriteTar(w io.Writer, op TarOptions) error {
+	tw := tar.NewWriter(w)
+	err := f.writeTar(tw, op.Prefix+f.name, op, make(map[uint32]string))
+	if err != nil {
+		return err
+	}
+	return tw.Close()
+}
+
+//writeTar writes the File, and it's children, to tw with the given name. links is the name of every inode that's been written,
+//by inode number, so hard links can point to the first file that was written.
+func (f *File) writeTar(tw *tar.Writer, name string, op TarOptions, links map[uint32]string) error {
+	in, err := f.getInode()
+	if err != nil {
+		return err
+	}
+	//The root folder has no name, so it's not written, but it's children are.
+	if f.name != "" {
+		hdr := &tar.Header{
+			Name:    name,
+			Mode:    int64(in.Header.Permissions),
+			Uid:     f.UID(),
+			Gid:     f.GID(),
+			ModTime: time.Unix(int64(in.Header.ModifiedTime), 0),
+		}
+		linked := false
+		if first, ok := links[in.Header.Number]; ok && op.HardLinks && !f.IsDir() {
+			hdr.Typeflag = tar.TypeLink
+			hdr.Linkname = first
+			linked = true
+		} else {
+			switch in.Type {
+			case inode.DirType, inode.ExtDirType:
+				hdr.Typeflag = tar.TypeDir
+				hdr.Name += "/"
+			case inode.FileType, inode.ExtFileType:
+				hdr.Typeflag = tar.TypeReg
+				hdr.Size = f.Size()
+			case inode.SymType, inode.ExtSymType:
+				hdr.Typeflag = tar.TypeSymlink
+				hdr.Linkname = f.SymlinkPath()
+			case inode.BlockDevType, inode.ExtBlockDeviceType, inode.CharDevType, inode.ExtCharDeviceType:
+				hdr.Typeflag = tar.TypeBlock
+				if in.Type == inode.CharDevType || in.Type == inode.ExtCharDeviceType {
+					hdr.Typeflag = tar.TypeChar
+				}
+				hdr.Devmajor, hdr.Devminor = decodeDevice(deviceNumber(in))
+			case inode.FifoType, inode.ExtFifoType:
+				hdr.Typeflag = tar.TypeFifo
+			default:
+				return nil
+			}
+			//Only files that are written can be linked to.
+			links[in.Header.Number] = name
+		}
+		if op.Xattrs && !linked {
+			xattrs, err := f.Xattrs()
+			if err != nil {
+				return err
+			}
+			for key, value := range xattrs {
+				if hdr.PAXRecords == nil {
+					hdr.PAXRecords = make(map[string]string)
+				}
+				hdr.PAXRecords[paxXattrPrefix+key] = string(value)
+			}
+		}
+		err = tw.WriteHeader(hdr)
+		if err != nil {
+			return err
+		}
+		if hdr.Typeflag == tar.TypeReg {
+			fil := f.handle()
+			err = fil.initReader()
+			if err != nil {
+				return err
+			}
+			_, err = fil.reader.WriteTo(tw)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	if !f.IsDir() {
+		return nil
+	}
+	children, err := f.GetChildren()
+	if err != nil {
+		return err
+	}
+	for _, child := range children {
+		childName := op.Prefix + child.name
+		if f.name != "" {
+			childName = name + "/" + child.name
+		}
+		err = child.writeTar(tw, childName, op, links)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//deviceNumber returns the device number of a device's inode.
+func deviceNumber(in *inode.Inode) uint32 {
+	switch info := in.Info.(type) {
+	case inode.Device:
+		return info.Device
+	case inode.ExtDevice:
+		return info.Device.Device
+	default:
+		return 0
+	}
+}
+
+//decodeDevice returns the major and minor numbers of a device number from an archive. The opposite of encodeDevice.
+func decodeDevice(device uint32) (major, minor int64) {
+	return int64(device&0xfff00) >> 8, int64(device&0xff | (device>>12)&0xfff00)
+}
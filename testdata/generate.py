@@ -0,0 +1,418 @@
+#!/usr/bin/env python3
+"""Generates the reference archives in this folder. See README.md.
+
+Usage: MKSQUASHFS=/path/to/mksquashfs XZ=/path/to/xz python3 generate.py
+"""
+import ctypes
+import os
+import random
+import socket
+import struct
+import subprocess
+import sys
+import tempfile
+import zlib
+
+HERE = os.path.dirname(os.path.abspath(__file__))
+MKSQUASHFS = os.environ.get("MKSQUASHFS", "mksquashfs")
+XZ = os.environ.get("XZ", "xz")
+MTIME = 1234567890
+
+GZIP, LZMA, LZO, LZ4 = 1, 2, 3, 5
+UNCOMPRESSED_BLOCK = 1 << 24
+COMPRESSOR_OPTIONS = 0x0400
+UNCOMPRESSED_INODES = 0x0001
+NO_TABLE = 0xFFFFFFFFFFFFFFFF
+
+
+def build_compression_tree(root):
+    """Files for the compression fixtures: a large compressible file, an incompressible file, and a few small ones."""
+    rnd = random.Random(1)
+    os.makedirs(os.path.join(root, "dir"))
+    with open(os.path.join(root, "text.txt"), "wb") as f:
+        f.write(b"squashfs " * 150000)
+    with open(os.path.join(root, "random.bin"), "wb") as f:
+        f.write(bytes(rnd.getrandbits(8) for _ in range(70000)))
+    with open(os.path.join(root, "small.txt"), "wb") as f:
+        f.write(b"A small file\n")
+    #Short matches that are close together (words), and long matches that are far apart (the repeated random data).
+    far = bytes(rnd.getrandbits(8) for _ in range(10000))
+    words = b" ".join(rnd.choice([b"squash", b"block", b"inode", b"fragment", b"xattr", b"lzo", b"table"]) + b"%d" % rnd.randrange(10)
+                      for _ in range(3000))
+    with open(os.path.join(root, "mixed.bin"), "wb") as f:
+        f.write(far + words + far)
+    with open(os.path.join(root, "dir", "nested.txt"), "wb") as f:
+        f.write(b"Nested " * 1000)
+    os.symlink("../small.txt", os.path.join(root, "dir", "link"))
+
+
+def build_reference_tree(root):
+    """Files for reference.sqfs: a bit of everything mksquashfs supports."""
+    rnd = random.Random(2)
+    os.makedirs(os.path.join(root, "dir", "sub", "deep"))
+    os.makedirs(os.path.join(root, "big"))
+    with open(os.path.join(root, "dir", "sub", "deep", "file.txt"), "wb") as f:
+        f.write(b"deep\n")
+    with open(os.path.join(root, "target.txt"), "wb") as f:
+        f.write(b"root target\n")
+    with open(os.path.join(root, "dir", "target.txt"), "wb") as f:
+        f.write(b"dir target\n")
+    #Three full blocks and a tail that's stored in a fragment, and a file that's only a fragment.
+    with open(os.path.join(root, "blocks.bin"), "wb") as f:
+        f.write(bytes(rnd.getrandbits(8) for _ in range(3 * 4096 + 1000)))
+    with open(os.path.join(root, "fragment.txt"), "wb") as f:
+        f.write(b"Only a fragment\n" * 10)
+    os.symlink("/target.txt", os.path.join(root, "dir", "absolute"))
+    os.symlink("loop2", os.path.join(root, "loop1"))
+    os.symlink("loop1", os.path.join(root, "loop2"))
+    #41 symlinks in a row, one more then the Reader follows.
+    os.makedirs(os.path.join(root, "chain"))
+    for i in range(40):
+        os.symlink("%02d" % (i + 1), os.path.join(root, "chain", "%02d" % i))
+    os.symlink("../target.txt", os.path.join(root, "chain", "40"))
+    #Enough entries that the directory has an index.
+    for i in range(1000):
+        open(os.path.join(root, "big", "entry%04d" % i), "wb").close()
+    with open(os.path.join(root, "xattr.txt"), "wb") as f:
+        f.write(b"xattrs\n")
+    os.setxattr(os.path.join(root, "xattr.txt"), "user.test", b"value")
+    os.setxattr(os.path.join(root, "xattr.txt"), "user.other", b"another value")
+    os.setxattr(os.path.join(root, "dir"), "user.folder", b"folder")
+    #mksquashfs stores values used more then once out of line.
+    os.setxattr(os.path.join(root, "xattr.txt"), "user.shared", b"shared " * 20)
+    os.setxattr(os.path.join(root, "dir"), "user.shared", b"shared " * 20)
+    os.mkfifo(os.path.join(root, "fifo"))
+    sock = socket.socket(socket.AF_UNIX)
+    sock.bind(os.path.join(root, "socket"))
+    sock.close()
+    os.link(os.path.join(root, "socket"), os.path.join(root, "socket2"))
+    os.link(os.path.join(root, "target.txt"), os.path.join(root, "dir", "hardlink.txt"))
+
+
+def build_bcj(out_dir):
+    """bcj.bin has x86 calls (E8 and a relative address) and ARM branches (words ending in EB) for the BCJ filters to change.
+    It's compressed by xz with different filters and checks."""
+    rnd = random.Random(3)
+    data = bytearray()
+    while len(data) < 4096:
+        data += b"\x55\x48\x89\xe5\xe8" + struct.pack("<i", rnd.randrange(-5000, 5000))
+        data += bytes(rnd.getrandbits(8) for _ in range(rnd.randrange(3, 12)))
+    del data[4096:]
+    while len(data) < 8192:
+        data += struct.pack("<II", 0xEB000000 | rnd.randrange(1 << 16), rnd.choice([0xE1A00000, 0xE3A00001, 0xE5912000]))
+    with open(os.path.join(out_dir, "bcj.bin"), "wb") as f:
+        f.write(data)
+    for name, args in (("bcj_x86_crc32.xz", ["--x86", "--lzma2=preset=6", "--check=crc32", "-T1"]),
+                       ("bcj_arm_crc64.xz", ["--arm", "--lzma2=preset=6", "--check=crc64", "-T1"]),
+                       #Multi-threaded compression stores the sizes in the block header.
+                       ("bcj_x86_sha256.xz", ["--x86", "--lzma2=preset=6", "--check=sha256", "-T2", "--block-size=16384"]),
+                       ("sha256.xz", ["--check=sha256", "-T1"])):
+        with open(os.path.join(out_dir, name), "wb") as f:
+            subprocess.run([XZ, "--format=xz", "-c"] + args, input=bytes(data), stdout=f, check=True)
+
+
+def set_mtimes(root):
+    for dirpath, dirnames, filenames in os.walk(root, topdown=False):
+        for name in dirnames + filenames:
+            os.utime(os.path.join(dirpath, name), (MTIME, MTIME), follow_symlinks=False)
+    os.utime(root, (MTIME, MTIME))
+
+
+def mksquashfs(src, out, *args):
+    """Runs mksquashfs. Some builds of mksquashfs 4.3 crash without a pseudo definition, so one for a folder that's already
+    in the tree (which mksquashfs ignores) is always given."""
+    if os.path.exists(out):
+        os.remove(out)
+    args = ["-noappend", "-no-progress", "-p", "dir d 755 0 0"] + list(args)
+    subprocess.run([MKSQUASHFS, src, out] + args, check=True, stdout=subprocess.DEVNULL)
+    #mksquashfs 4.3 can't set the creation time, and leaves the unused field of the xattr table's header uninitialized, so they're set
+    #afterwards to keep the archives the same each time they're generated.
+    with open(out, "r+b") as f:
+        f.seek(8)
+        f.write(struct.pack("<I", MTIME))
+        f.seek(56)
+        xattr_start = struct.unpack("<Q", f.read(8))[0]
+        if xattr_start != NO_TABLE:
+            f.seek(xattr_start + 12)
+            f.write(bytes(4))
+
+
+liblz4 = ctypes.CDLL("liblz4.so.1")
+liblzma = ctypes.CDLL("liblzma.so.5")
+
+
+def lz4_compress(data):
+    """Compresses a raw lz4 block, the same as mksquashfs."""
+    out = ctypes.create_string_buffer(liblz4.LZ4_compressBound(len(data)))
+    size = liblz4.LZ4_compress_default(data, out, len(data), len(out))
+    if size <= 0:
+        raise RuntimeError("lz4 compression failed")
+    return out.raw[:size]
+
+
+class LzmaOptions(ctypes.Structure):
+    _fields_ = [
+        ("dict_size", ctypes.c_uint32), ("preset_dict", ctypes.c_void_p), ("preset_dict_size", ctypes.c_uint32),
+        ("lc", ctypes.c_uint32), ("lp", ctypes.c_uint32), ("pb", ctypes.c_uint32), ("mode", ctypes.c_int),
+        ("nice_len", ctypes.c_uint32), ("mf", ctypes.c_int), ("depth", ctypes.c_uint32),
+        ("ext_flags", ctypes.c_uint32), ("ext_size_low", ctypes.c_uint32), ("ext_size_high", ctypes.c_uint32),
+        ("reserved_int4", ctypes.c_uint32), ("reserved_enum1", ctypes.c_int), ("reserved_enum2", ctypes.c_int),
+        ("reserved_enum3", ctypes.c_int), ("reserved_enum4", ctypes.c_int),
+        ("reserved_ptr1", ctypes.c_void_p), ("reserved_ptr2", ctypes.c_void_p),
+    ]
+
+
+class LzmaFilter(ctypes.Structure):
+    _fields_ = [("id", ctypes.c_uint64), ("options", ctypes.c_void_p)]
+
+
+LZMA_FILTER_LZMA1EXT = 0x4000000000000002
+LZMA_VLI_UNKNOWN = NO_TABLE
+
+
+def lzma_compress(data, dict_size):
+    """Compresses the data the same way as mksquashfs' lzma compressor: the 5 byte LZMA properties, the uncompressed size
+    as 8 bytes, then the LZMA data without an end marker (lc=3, lp=0, pb=2)."""
+    opts = LzmaOptions()
+    if liblzma.lzma_lzma_preset(ctypes.byref(opts), 5):
+        raise RuntimeError("lzma_lzma_preset failed")
+    opts.dict_size = dict_size
+    opts.lc, opts.lp, opts.pb = 3, 0, 2
+    #The uncompressed size is known, so no end marker is written.
+    opts.ext_flags = 0
+    opts.ext_size_low = len(data) & 0xFFFFFFFF
+    opts.ext_size_high = len(data) >> 32
+    filters = (LzmaFilter * 2)(LzmaFilter(LZMA_FILTER_LZMA1EXT, ctypes.cast(ctypes.byref(opts), ctypes.c_void_p)),
+                               LzmaFilter(LZMA_VLI_UNKNOWN, None))
+    out = ctypes.create_string_buffer(len(data) + len(data) // 2 + 1024)
+    pos = ctypes.c_size_t(0)
+    ret = liblzma.lzma_raw_buffer_encode(filters, None, data, ctypes.c_size_t(len(data)), out, ctypes.byref(pos), ctypes.c_size_t(len(out)))
+    if ret != 0:
+        raise RuntimeError("lzma_raw_buffer_encode failed: %d" % ret)
+    props = bytes([(2 * 5 + 0) * 9 + 3]) + struct.pack("<I", dict_size)
+    return props + struct.pack("<Q", len(data)) + out.raw[:pos.value]
+
+
+def lzo_length(extra):
+    """Encodes a length that doesn't fit in an instruction's bits: zero bytes for every 255, then the (non-zero) remainder."""
+    out = bytearray()
+    while extra > 255:
+        out.append(0)
+        extra -= 255
+    out.append(extra)
+    return bytes(out)
+
+
+def lzo_compress(data):
+    """A simple LZO1X compressor, written from the format description in the Linux kernel's Documentation/staging/lzo.rst
+    instead of being ported from an existing compressor, so that the decompressor is tested against data it didn't make.
+    Uses all of the match types: M2 for short and close matches, M3, and M4 for far matches."""
+    out = bytearray()
+    table = {}
+    pos = lit = 0
+    last = None  #Index of the byte that holds the last match's literal count, so up to 3 literals can be added to it.
+
+    def literals(end):
+        run = data[lit:end]
+        if not run:
+            return
+        if len(run) <= 3 and last is not None:
+            out[last] |= len(run)
+        elif not out:
+            #The first instruction can be a literal run of any length.
+            if len(run) <= 238:
+                out.append(17 + len(run))
+            else:
+                out.append(0)
+                out.extend(lzo_length(len(run) - 18))
+        elif len(run) <= 18:
+            out.append(len(run) - 3)
+        else:
+            out.append(0)
+            out.extend(lzo_length(len(run) - 18))
+        out.extend(run)
+
+    while pos + 4 <= len(data):
+        key = data[pos:pos + 4]
+        cand = table.get(key)
+        table[key] = pos
+        if cand is None or pos - cand > 0xBFFF:
+            pos += 1
+            continue
+        length = 4
+        while pos + length < len(data) and data[cand + length] == data[pos + length]:
+            length += 1
+        dist = pos - cand
+        if 0 < len(data[lit:pos]) <= 3 and last is None:
+            #Up to 3 literals can only be put after a match, so they're included in the literal run before it.
+            pos += 1
+            continue
+        literals(pos)
+        if length <= 8 and dist <= 0x0800:
+            d = dist - 1
+            last = len(out)
+            out.append(((length - 1) << 5) | ((d & 7) << 2))
+            out.append(d >> 3)
+        elif dist <= 0x4000:
+            d = dist - 1
+            if length <= 33:
+                out.append(32 | (length - 2))
+            else:
+                out.append(32)
+                out.extend(lzo_length(length - 33))
+            last = len(out)
+            out.extend(struct.pack("<H", d << 2))
+        else:
+            d = dist - 0x4000
+            h = (d >> 14) & 1
+            if length <= 9:
+                out.append(16 | (h << 3) | (length - 2))
+            else:
+                out.append(16 | (h << 3))
+                out.extend(lzo_length(length - 9))
+            last = len(out)
+            out.extend(struct.pack("<H", (d & 0x3FFF) << 2))
+        pos += length
+        lit = pos
+    literals(len(data))
+    #End of stream: a M4 match with a distance of 16384.
+    out.extend(b"\x11\x00\x00")
+    return bytes(out)
+
+
+def metadata_blocks(img, start, end):
+    """Returns the payload of the uncompressed metadata blocks between start and end, and the file offset of each payload byte."""
+    payload = bytearray()
+    offsets = []
+    pos = start
+    while pos < end:
+        hdr = struct.unpack_from("<H", img, pos)[0]
+        if hdr & 0x8000 == 0:
+            raise RuntimeError("Metadata must be uncompressed (-noI)")
+        size = hdr & 0x7FFF
+        payload += img[pos + 2:pos + 2 + size]
+        offsets += range(pos + 2, pos + 2 + size)
+        pos += 2 + size
+    return payload, offsets
+
+
+def file_inodes(img, block_size):
+    """Yields (blocks_start offset, block sizes offset, block count) for every file inode."""
+    inode_start, dir_start = struct.unpack_from("<QQ", img, 64)
+    data, offsets = metadata_blocks(img, inode_start, dir_start)
+    pos = 0
+    while pos < len(data):
+        typ = struct.unpack_from("<H", data, pos)[0]
+        pos += 16
+        if typ == 1:
+            pos += 16
+        elif typ == 2:
+            start, frag, _, size = struct.unpack_from("<IIII", data, pos)
+            count = size // block_size if frag != 0xFFFFFFFF else (size + block_size - 1) // block_size
+            yield offsets[pos], 4, [offsets[pos + 16 + 4 * i] for i in range(count)]
+            pos += 16 + 4 * count
+        elif typ == 3:
+            pos += 8 + struct.unpack_from("<I", data, pos + 4)[0]
+        elif typ == 8:
+            count = struct.unpack_from("<H", data, pos + 16)[0]
+            pos += 24
+            for _ in range(count):
+                pos += 13 + struct.unpack_from("<I", data, pos + 8)[0]
+        elif typ == 9:
+            size, _, _, frag = struct.unpack_from("<QQII", data, pos + 8)
+            count = size // block_size if frag != 0xFFFFFFFF else (size + block_size - 1) // block_size
+            yield offsets[pos], 8, [offsets[pos + 40 + 4 * i] for i in range(count)]
+            pos += 40 + 4 * count
+        elif typ in (4, 5):
+            pos += 8
+        elif typ in (6, 7):
+            pos += 4
+        else:
+            raise RuntimeError("Unsupported inode type %d" % typ)
+
+
+def transcode(src, out, compressor):
+    """Recompresses the data blocks of a gzip archive made by mksquashfs with -noI -no-fragments -no-xattrs -no-exports,
+    keeping everything else as mksquashfs wrote it."""
+    with open(src, "rb") as f:
+        img = bytearray(f.read())
+    block_size = struct.unpack_from("<I", img, 12)[0]
+    inode_start = struct.unpack_from("<Q", img, 64)[0]
+    options = b""
+    if compressor == LZ4:
+        #mksquashfs always writes lz4's options: version 1 (legacy) and no flags.
+        options = struct.pack("<HII", 0x8000 | 8, 1, 0)
+    data = bytearray()
+    moved = {}
+    for start_off, start_size, block_offs in file_inodes(img, block_size):
+        start = int.from_bytes(img[start_off:start_off + start_size], "little")
+        if start not in moved:
+            moved[start] = (96 + len(options) + len(data), [])
+            pos = start
+            for off in block_offs:
+                size = struct.unpack_from("<I", img, off)[0]
+                raw = bytes(img[pos:pos + (size & ~UNCOMPRESSED_BLOCK)])
+                pos += size & ~UNCOMPRESSED_BLOCK
+                if size == 0:
+                    moved[start][1].append(0)
+                    continue
+                if not size & UNCOMPRESSED_BLOCK:
+                    raw = zlib.decompress(raw)
+                comp = {LZ4: lz4_compress, LZO: lzo_compress}.get(compressor, lambda raw: lzma_compress(raw, block_size))(raw)
+                if len(comp) < len(raw):
+                    data += comp
+                    moved[start][1].append(len(comp))
+                else:
+                    data += raw
+                    moved[start][1].append(len(raw) | UNCOMPRESSED_BLOCK)
+        new_start, sizes = moved[start]
+        img[start_off:start_off + start_size] = new_start.to_bytes(start_size, "little")
+        for off, size in zip(block_offs, sizes):
+            struct.pack_into("<I", img, off, size)
+    delta = 96 + len(options) + len(data) - inode_start
+    super_block = img[:96]
+    tables = img[inode_start:struct.unpack_from("<Q", img, 40)[0]]
+    #Table locations, and the lookup tables that point to metadata blocks, are moved by delta.
+    id_start, xattr_start, _, _, frag_start, export_start = struct.unpack_from("<QQQQQQ", super_block, 48)
+    id_count = struct.unpack_from("<H", super_block, 26)[0]
+    frag_count = struct.unpack_from("<I", super_block, 16)[0]
+    if xattr_start != NO_TABLE or export_start != NO_TABLE:
+        raise RuntimeError("Xattrs and export tables aren't supported")
+    for table, count in ((id_start, (id_count * 4 + 8191) // 8192), (frag_start, (frag_count * 16 + 8191) // 8192)):
+        for i in range(count):
+            off = table - inode_start + i * 8
+            struct.pack_into("<Q", tables, off, struct.unpack_from("<Q", tables, off)[0] + delta)
+    for field in range(40, 96, 8):
+        value = struct.unpack_from("<Q", super_block, field)[0]
+        if value != NO_TABLE:
+            struct.pack_into("<Q", super_block, field, value + delta)
+    struct.pack_into("<H", super_block, 20, compressor)
+    if options:
+        struct.pack_into("<H", super_block, 24, struct.unpack_from("<H", super_block, 24)[0] | COMPRESSOR_OPTIONS)
+    result = bytes(super_block) + options + bytes(data) + bytes(tables)
+    result += bytes(-len(result) % 4096)
+    with open(out, "wb") as f:
+        f.write(result)
+
+
+def main():
+    build_bcj(HERE)
+    with tempfile.TemporaryDirectory() as tmp:
+        tree = os.path.join(tmp, "compression")
+        build_compression_tree(tree)
+        set_mtimes(tree)
+        mksquashfs(tree, os.path.join(HERE, "gzip_options.sqfs"), "-b", "1M", "-all-root", "-Xcompression-level", "6", "-Xwindow-size", "12")
+        base = os.path.join(tmp, "base.sqfs")
+        mksquashfs(tree, base, "-b", "1M", "-all-root", "-noI", "-no-fragments", "-no-xattrs", "-no-exports")
+        transcode(base, os.path.join(HERE, "lz4.sqfs"), LZ4)
+        transcode(base, os.path.join(HERE, "lzma.sqfs"), LZMA)
+        transcode(base, os.path.join(HERE, "lzo.sqfs"), LZO)
+        tree = os.path.join(tmp, "reference")
+        build_reference_tree(tree)
+        set_mtimes(tree)
+        mksquashfs(tree, os.path.join(HERE, "reference.sqfs"), "-b", "4096", "-all-root", "-always-use-fragments", "-xattrs",
+                   "-processors", "1")
+
+
+if __name__ == "__main__":
+    sys.exit(main())
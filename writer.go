@@ -6,28 +6,47 @@ import (
 	"log"
 	"os"
 	"path"
-	"sort"
 	"strings"
-	"syscall"
+	"time"
 
 	"github.com/CalebQ42/squashfs/internal/compression"
 )
 
-//Writer is used to creaste squashfs archives. Currently unusable.
-//TODO: Make usable
+//Writer is used to creaste squashfs archives.
+//Files and folders are added with the Add functions and the archive is created with WriteTo or WriteToFilename.
 type Writer struct {
-	compressor      compression.Compressor
-	structure       map[string][]*fileHolder
-	symlinkTable    map[string]string //[oldpath]newpath
-	uidGUIDTable    []int
-	compressionType int
+	compressor       compression.Compressor
+	structure        map[string][]*fileHolder
+	symlinkTable     map[string]string //[oldpath]newpath
+	compressionType  int
+	xzDictionarySize uint32                 //Set with SetXzOptions. 0 means the block size.
+	root             *fileHolder            //The root folder's metadata, if it was added. Otherwise the root folder has 0755 permissions.
+	base             *appendBase            //The archive being appended to. Set by NewAppendWriter.
+	hardLinks        map[fileID]*fileHolder //The first file added with AddFileTo for each fileID with more then one hard link.
 	//BlockSize is how large the data blocks are. Can be between 4096 (4KB) and 1048576 (1 MB).
 	//If BlockSize is not inside that range, it will be set to within the range before writing.
 	//Default is 1048576.
 	BlockSize uint32
 	//Flags are the SuperblockFlags used when writing the archive.
-	//Currently Duplicates, Exportable, UncompressedXattr, NoXattr values are ignored
-	Flags       SuperblockFlags
+	//By default, only Duplicates is set.
+	//If Exportable is set, an export table is written so files can be found by their inode number, such as when the archive is exported with NFS.
+	//If NoXattr is set, extended attributes aren't written.
+	Flags SuperblockFlags
+	//CompressionWorkers is how many blocks are compressed at the same time. If 0, runtime.NumCPU() is used.
+	CompressionWorkers int
+	//MaxInFlightBlocks is the most data blocks held in memory while waiting to be compressed and written. If 0, four times CompressionWorkers is used.
+	//Blocks are always written in the same order, no matter the amount of workers or blocks in flight.
+	MaxInFlightBlocks int
+	//CreationTime is the archive's creation time. It's also used as the modification time of files and folders that don't have one.
+	//If it's not set, SOURCE_DATE_EPOCH is used if it's set in the environment, otherwise the time the archive is written is used.
+	//
+	//Files and folders are always written in the same order with the same inode numbers, so as long as CreationTime
+	//(or SOURCE_DATE_EPOCH) is set, identical inputs create identical archives.
+	CreationTime time.Time
+	//ClampModTimes makes any modification times after the creation time be set to the creation time.
+	ClampModTimes bool
+	//AllRoot makes every file and folder owned by uid and gid 0.
+	AllRoot     bool
 	allowErrors bool
 }
 
@@ -37,16 +56,31 @@ func NewWriter() (*Writer, error) {
 }
 
 //NewWriterWithOptions creates a new squashfs.Writer with the given options.
-//compressionType can be of any types, except LZO (which this library doesn't have support for yet)
+//compressionType can be of any types.
 //allowErrors determines if, when adding folders, it allows errors encountered with it's sub-directories and instead logs the errors.
 func NewWriterWithOptions(compressionType int, allowErrors bool) (*Writer, error) {
-	if compressionType < 0 || compressionType > 6 {
+	var compressor compression.Compressor
+	switch compressionType {
+	case GzipCompression:
+		gzip := &compression.Gzip{}
+		gzip.CompressionLevel = 9
+		gzip.WindowSize = 15
+		compressor = gzip
+	case LzmaCompression:
+		compressor = &compression.Lzma{}
+	case LzoCompression:
+		compressor = &compression.Lzo{Algorithm: compression.Lzo1x1}
+	case XzCompression:
+		compressor = &compression.Xz{}
+	case Lz4Compression:
+		compressor = &compression.Lz4{}
+	case ZstdCompression:
+		compressor = &compression.Zstd{CompressionLevel: 15}
+	default:
 		return nil, errors.New("Incorrect compression type")
 	}
-	if compressionType == 3 {
-		return nil, errors.New("LZO compression is not (currently) supported")
-	}
 	return &Writer{
+		compressor: compressor,
 		structure: map[string][]*fileHolder{
 			"/": make([]*fileHolder, 0),
 		},
@@ -54,19 +88,28 @@ func NewWriterWithOptions(compressionType int, allowErrors bool) (*Writer, error
 		compressionType: compressionType,
 		allowErrors:     allowErrors,
 		BlockSize:       uint32(1048576),
+		Flags: SuperblockFlags{
+			Duplicates: true,
+		},
 	}, nil
 }
 
 //fileHolder holds the necessary information about a given file inside of a squashfs
 type fileHolder struct {
 	reader      io.Reader
+	xattrs      map[string][]byte
+	modTime     time.Time //If not set, the time the archive is written is used.
 	path        string
 	name        string
 	symLocation string
 	UID         int
 	GUID        int
+	link        *fileHolder //If set, the file is a hard link to link.
+	raw         *rawFile    //If set, the file's data is in another archive and can be copied without decompressing it.
 	perm        int
 	size        uint32
+	rdev        uint32      //The device number of a device, encoded the same way as in the archive.
+	special     os.FileMode //The type of a device, FIFO, or socket. 0 for anything else.
 	folder      bool
 	symlink     bool
 }
@@ -86,89 +129,132 @@ func (w *Writer) AddFileToFolder(folder string, file *os.File) error {
 }
 
 //AddFileTo adds the given file to the squashfs archive at the given filepath.
+//If the file has the same device and inode number as a file that was already added, it's added as a hard link to it.
+//If the file is a folder, everything in it is also added. If allowErrors isn't set, nothing is added if there's an error.
 func (w *Writer) AddFileTo(filepath string, file *os.File) error {
 	filepath = path.Clean(filepath)
 	if !strings.HasPrefix(filepath, "/") {
 		filepath = "/" + filepath
 	}
-	if w.Contains(filepath) {
-		return errors.New("File already exists at " + filepath)
+	links := make(map[fileID]*fileHolder)
+	holders, err := w.fileHolders(filepath, file, links)
+	if err != nil {
+		return err
+	}
+	//Nothing can fail from here on, so files from the archive being appended to are only now removed.
+	for _, holder := range holders {
+		w.replaceBase(holder.path+holder.name, holder.folder)
+	}
+	for _, holder := range holders {
+		w.structure[holder.path] = append(w.structure[holder.path], holder)
+	}
+	if w.hardLinks == nil {
+		w.hardLinks = make(map[fileID]*fileHolder)
+	}
+	for id, holder := range links {
+		w.hardLinks[id] = holder
+	}
+	return nil
+}
+
+//fileHolders creates the fileHolders for file, and everything in it if it's a folder, without adding them to w.
+//links is the first holder of each fileID that's been created, which aren't in w.hardLinks yet.
+func (w *Writer) fileHolders(filepath string, file *os.File, links map[fileID]*fileHolder) ([]*fileHolder, error) {
+	if !w.replaceable(filepath) {
+		return nil, errors.New("File already exists at " + filepath)
 	}
 	var holder fileHolder
 	holder.path, holder.name = path.Split(filepath)
 	holder.reader = file
-	stat, err := file.Stat()
+	//Lstat so symlinks are kept as symlinks.
+	stat, err := os.Lstat(file.Name())
 	if err != nil {
-		return err
+		stat, err = file.Stat()
+		if err != nil {
+			return nil, err
+		}
 	}
+	holder.modTime = stat.ModTime()
 	holder.folder = stat.IsDir()
 	holder.symlink = (stat.Mode()&os.ModeSymlink == os.ModeSymlink)
 	holder.perm = int(stat.Mode().Perm())
-	//Thanks to https://stackoverflow.com/questions/58179647/getting-uid-and-gid-of-a-file for uid and guid getting
-	if stat, ok := stat.Sys().(*syscall.Stat_t); ok {
-		holder.UID = int(stat.Uid)
-		holder.GUID = int(stat.Gid)
-	}
-	if sort.SearchInts(w.uidGUIDTable, holder.UID) == len(w.uidGUIDTable) {
-		w.uidGUIDTable = append(w.uidGUIDTable, holder.UID)
-		sort.Ints(w.uidGUIDTable)
+	xattrs, err := lgetxattrs(file.Name())
+	if err != nil {
+		return nil, err
 	}
-	if sort.SearchInts(w.uidGUIDTable, holder.GUID) == len(w.uidGUIDTable) {
-		w.uidGUIDTable = append(w.uidGUIDTable, holder.GUID)
-		sort.Ints(w.uidGUIDTable)
+	//Only xattrs with prefixes supported by squashfs are kept.
+	for name, value := range xattrs {
+		if _, _, ok := xattrPrefix(name); ok {
+			if holder.xattrs == nil {
+				holder.xattrs = make(map[string][]byte)
+			}
+			holder.xattrs[name] = value
+		}
 	}
+	holder.UID, holder.GUID = fsOwner(stat)
+	holders := []*fileHolder{&holder}
 	if holder.symlink {
 		target, err := os.Readlink(file.Name())
 		if err != nil {
-			return err
+			return nil, err
 		}
 		holder.symLocation = target
 	} else if holder.folder {
 		subDirNames, err := file.Readdirnames(-1)
 		if err != nil {
-			return err
+			return nil, err
 		}
-		dirsAdded := make([]string, 0)
 		for _, subDir := range subDirNames {
-			fil, err := os.Open(file.Name() + subDir)
-			if err != nil {
-				return err
+			fil, err := os.Open(file.Name() + "/" + subDir)
+			var sub []*fileHolder
+			if err == nil {
+				sub, err = w.fileHolders(path.Join(filepath, subDir), fil, links)
 			}
-			err = w.AddFileToFolder(holder.path+"/"+holder.name, fil)
 			if err != nil && !w.allowErrors {
-				for _, dir := range dirsAdded {
-					w.Remove(dir)
-				}
-				return err
+				return nil, err
 			} else if err != nil {
-				log.Println("Error while adding", fil.Name())
+				log.Println("Error while adding", file.Name()+"/"+subDir)
 				log.Println(err)
+				continue
 			}
-			if !w.allowErrors {
-				dirsAdded = append(dirsAdded, holder.path+"/"+holder.name)
-			}
+			holders = append(holders, sub...)
 		}
 	} else if !stat.Mode().IsRegular() {
-		return errors.New("Unsupported file type " + file.Name())
+		return nil, errors.New("Unsupported file type " + file.Name())
 	}
-	w.structure[holder.path] = append(w.structure[holder.path], &holder)
-	return nil
+	if id, ok := fsFileID(stat); ok {
+		first, ok := links[id]
+		if !ok {
+			first, ok = w.hardLinks[id]
+		}
+		if ok {
+			//The data is read from the first file, so this one isn't needed.
+			holder.link = first
+			holder.reader = nil
+			file.Close()
+		} else {
+			links[id] = &holder
+		}
+	}
+	return holders, nil
 }
 
 //AddReaderTo adds the data from the given reader to the archive as a file located at the given filepath.
-//Data from the reader is not read until the squashfs archive is writen.
+//Data from the reader is not read until the squashfs archive is writen. The file is given 0644 permissions.
+//Folders that the file is in are created with 0755 permissions if they aren't added.
 //If the given reader implements io.Closer, it will be closed after it is fully read.
 func (w *Writer) AddReaderTo(filepath string, reader io.Reader) error {
 	filepath = path.Clean(filepath)
 	if !strings.HasPrefix(filepath, "/") {
 		filepath = "/" + filepath
 	}
-	if w.Contains(filepath) {
+	if !w.replaceBase(filepath, false) {
 		return errors.New("File already exists at " + filepath)
 	}
 	var holder fileHolder
 	holder.path, holder.name = path.Split(filepath)
 	holder.reader = reader
+	holder.perm = 0644
 	w.structure[holder.path] = append(w.structure[holder.path], &holder)
 	return nil
 }
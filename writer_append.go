@@ -0,0 +1,234 @@
+package squashfs
+
+import (
+	"errors"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+//appendBase is the archive that a Writer made with NewAppendWriter adds files to.
+type appendBase struct {
+	f       *os.File
+	rdr     *Reader
+	holders map[*fileHolder]bool //Everything that was already in the archive.
+}
+
+//NewAppendWriter opens the archive in f so files can be added to it without rewriting the whole archive, similar to appending with mksquashfs.
+//The Writer uses the archive's compression, BlockSize, and flags (the same as NewWriterFromReader) and everything already in the archive is added to it.
+//f must be opened for reading and writing.
+//
+//Files added with AddFileTo, AddReaderTo, AddFS, and AddArchive replace any file already in the archive at the same path. If both are
+//folders, the folder's metadata is replaced and the new files are merged with it's contents.
+//
+//Once everything is added, Append writes the changes to f.
+func NewAppendWriter(f *os.File) (*Writer, error) {
+	rdr, err := NewSquashfsReader(f)
+	if err != nil {
+		return nil, err
+	}
+	w, err := newWriterLike(rdr)
+	if err != nil {
+		return nil, err
+	}
+	//The archive's creation time is updated when it's appended to.
+	w.CreationTime = time.Time{}
+	err = w.AddArchive("/", rdr)
+	if err != nil {
+		return nil, err
+	}
+	w.base = &appendBase{
+		f:       f,
+		rdr:     rdr,
+		holders: make(map[*fileHolder]bool),
+	}
+	for _, holders := range w.structure {
+		for _, holder := range holders {
+			w.base.holders[holder] = true
+		}
+	}
+	return w, nil
+}
+
+//Append writes the changes to the archive opened with NewAppendWriter. The data blocks and fragment blocks already in the archive are kept as is,
+//and new data, followed by all the tables (inodes, directories, and such), is written after the end of the archive.
+//
+//The superblock is written last, once everything else is synced to disk, so until then f still holds the original archive. If Append returns
+//an error, f is truncated back to it's original size. The original tables are left in the archive, unused, so each Append makes the archive
+//larger by their size. Writing the archive again with NewWriterFromReader removes them.
+//
+//The compressor options stored in the archive, and BlockSize, can't be changed. Once Append is called, the Writer shouldn't be used again.
+func (w *Writer) Append() error {
+	if w.base == nil {
+		return errors.New("Writer wasn't made with NewAppendWriter")
+	}
+	rdr := w.base.rdr
+	if w.BlockSize != rdr.super.BlockSize {
+		return errors.New("BlockSize can't be changed when appending")
+	}
+	options, err := rdr.compressorOptions()
+	if err != nil {
+		return err
+	}
+	frags, err := rdr.fragmentEntries()
+	if err != nil {
+		return err
+	}
+	stat, err := w.base.f.Stat()
+	if err != nil {
+		return err
+	}
+	w.setXzDictionary()
+	tmp := &appendFile{
+		f:   w.base.f,
+		end: stat.Size(),
+		pos: stat.Size(),
+	}
+	out := &archiveWriter{
+		f:      tmp,
+		offset: uint64(stat.Size()),
+		end:    uint64(stat.Size()),
+	}
+	_, err = w.finishArchive(out, options, func(a *archive) error {
+		a.sources[rdr] = &rawSource{
+			copy:    true,
+			inPlace: true,
+		}
+		a.frags.entries = frags
+		return nil
+	})
+	w.base = nil
+	if err != nil {
+		//The original archive hasn't been touched, so only what was written after it needs to be removed.
+		tmp.f.Truncate(stat.Size())
+		return err
+	}
+	return tmp.commit(int64(out.offset))
+}
+
+//appendFile is what Append writes to. Nothing before end, the end of the original archive, is written except for the superblock,
+//which is kept in memory until commit is called.
+type appendFile struct {
+	f     *os.File
+	end   int64
+	pos   int64
+	super []byte
+}
+
+func (a *appendFile) Write(p []byte) (int, error) {
+	if a.pos < a.end {
+		if a.pos != 0 || int64(len(p)) > a.end {
+			return 0, errors.New("Can't write over the original archive")
+		}
+		a.super = append([]byte{}, p...)
+		a.pos += int64(len(p))
+		return len(p), nil
+	}
+	n, err := a.f.WriteAt(p, a.pos)
+	a.pos += int64(n)
+	return n, err
+}
+
+func (a *appendFile) ReadAt(p []byte, off int64) (int, error) {
+	return a.f.ReadAt(p, off)
+}
+
+func (a *appendFile) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += a.pos
+	default:
+		return a.pos, errors.New("Unsupported whence")
+	}
+	if offset < 0 {
+		return a.pos, errors.New("Negative offset")
+	}
+	a.pos = offset
+	return offset, nil
+}
+
+func (a *appendFile) Truncate(size int64) error {
+	if size < a.end {
+		return errors.New("Can't truncate the original archive")
+	}
+	return a.f.Truncate(size)
+}
+
+//commit syncs everything that's been written and then writes the superblock, which makes f use the new tables.
+func (a *appendFile) commit(size int64) error {
+	err := a.f.Sync()
+	if err != nil {
+		return err
+	}
+	_, err = a.f.WriteAt(a.super, 0)
+	if err != nil {
+		return err
+	}
+	err = a.f.Sync()
+	if err != nil {
+		return err
+	}
+	_, err = a.f.Seek(size, io.SeekStart)
+	return err
+}
+
+//replaceable returns if a file can be added at filepath, either because there's nothing there or because replaceBase can remove it.
+func (w *Writer) replaceable(filepath string) bool {
+	existing := w.holderAt(filepath)
+	return existing == nil || (w.base != nil && w.base.holders[existing])
+}
+
+//replaceBase removes the file at filepath, so it can be replaced, if it's from the archive being appended to. If the file is a folder and folder
+//isn't set, everything inside of it is also removed. Returns false if there's a file at filepath that can't be replaced.
+func (w *Writer) replaceBase(filepath string, folder bool) bool {
+	if !w.replaceable(filepath) {
+		return false
+	}
+	existing := w.holderAt(filepath)
+	if existing == nil {
+		return true
+	}
+	removed := map[*fileHolder]bool{existing: true}
+	for i, holder := range w.structure[existing.path] {
+		if holder == existing {
+			w.structure[existing.path] = append(w.structure[existing.path][:i], w.structure[existing.path][i+1:]...)
+			break
+		}
+	}
+	if existing.folder && !folder {
+		for dir, holders := range w.structure {
+			if strings.HasPrefix(dir, filepath+"/") {
+				for _, holder := range holders {
+					removed[holder] = true
+				}
+				delete(w.structure, dir)
+			}
+		}
+	}
+	//Hard links to a removed file now use the first of them that's left instead.
+	firsts := make(map[*fileHolder]*fileHolder)
+	for _, holders := range w.structure {
+		for _, holder := range holders {
+			if !removed[holder.link] {
+				continue
+			}
+			target := holder.link
+			if first, ok := firsts[target]; ok {
+				holder.link = first
+				continue
+			}
+			firsts[target] = holder
+			holder.link = nil
+			holder.reader = target.reader
+			holder.raw = target.raw
+			holder.xattrs = target.xattrs
+			holder.symlink = target.symlink
+			holder.symLocation = target.symLocation
+			holder.special = target.special
+			holder.rdev = target.rdev
+		}
+	}
+	return true
+}
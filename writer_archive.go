@@ -0,0 +1,358 @@
+package squashfs
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path"
+	"time"
+
+	"github.com/CalebQ42/squashfs/internal/compression"
+	"github.com/CalebQ42/squashfs/internal/inode"
+)
+
+//rawFile is where a file's data is stored in another archive.
+type rawFile struct {
+	rdr        *Reader
+	fil        *File //The file in rdr. Only read if the data is needed uncompressed.
+	blockStart uint64
+	blockSizes []uint32
+	size       uint64
+	fragIndex  uint32 //The index of the file's fragment in rdr's fragment table, or 0xFFFFFFFF if it doesn't have one.
+	fragOffset uint32
+}
+
+//rawSource is another archive that files are being copied from.
+type rawSource struct {
+	copied   map[uint64]*writeEntry //Entries whose data has been copied, by where their data starts in the archive. Used to keep duplicates.
+	copy     bool                   //If the archive's compressed data can be copied as is.
+	inPlace  bool                   //If the archive is the one being appended to, so it's data doesn't need to be copied.
+	fragBase uint32                 //The index of the archive's first fragment block in the new fragment table.
+}
+
+//NewWriterFromReader creates a Writer that uses the same compression type, compressor options, BlockSize, flags, and creation time as rdr,
+//with everything in rdr already added. Compressor options that can't be used when compressing (see SetGzipOptions and SetLzoOptions) are
+//replaced with the defaults.
+//
+//If nothing is changed, the archive's data is copied without being decompressed, otherwise the data is recompressed. To use a different
+//compression type, use NewWriterWithOptions and AddArchive instead.
+func NewWriterFromReader(rdr *Reader) (*Writer, error) {
+	w, err := newWriterLike(rdr)
+	if err != nil {
+		return nil, err
+	}
+	err = w.AddArchive("/", rdr)
+	if err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+//newWriterLike creates an empty Writer with the same settings as rdr.
+func newWriterLike(rdr *Reader) (*Writer, error) {
+	w, err := NewWriterWithOptions(int(rdr.super.CompressionType), false)
+	if err != nil {
+		return nil, err
+	}
+	w.BlockSize = rdr.super.BlockSize
+	w.CreationTime = rdr.ModTime()
+	w.Flags = SuperblockFlags{
+		UncompressedInodes:    rdr.flags.UncompressedInodes,
+		UncompressedData:      rdr.flags.UncompressedData,
+		UncompressedFragments: rdr.flags.UncompressedFragments,
+		NoFragments:           rdr.flags.NoFragments,
+		AlwaysFragments:       rdr.flags.AlwaysFragments,
+		Duplicates:            rdr.flags.Duplicates,
+		Exportable:            rdr.flags.Exportable,
+		UncompressedXattr:     rdr.flags.UncompressedXattr,
+		NoXattr:               rdr.flags.NoXattr,
+		UncompressedIDs:       rdr.flags.UncompressedIDs,
+	}
+	if !rdr.flags.compressorOptions {
+		return w, nil
+	}
+	switch c := rdr.decompressor.(type) {
+	case *compression.Gzip:
+		//The window size and strategies that can't be used when compressing are replaced with the defaults.
+		err = w.SetGzipOptions(int(c.CompressionLevel), 15, int(c.Strategies)&(GzipDefault|GzipHuffmanOnly))
+	case *compression.Lzo:
+		//Only Lzo1x1, the default, can be used when compressing.
+	case *compression.Xz:
+		err = w.SetXzOptions(int(c.DictionarySize), int(c.Filters))
+	case *compression.Lz4:
+		err = w.SetLz4Options(c.HC)
+	case *compression.Zstd:
+		err = w.SetZstdOptions(int(c.CompressionLevel))
+	}
+	if err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+//clone returns a copy of w that can be changed, and written, without changing w. The fileHolders are shared, since they aren't changed
+//once they're added.
+func (w *Writer) clone() *Writer {
+	c := *w
+	c.structure = make(map[string][]*fileHolder, len(w.structure))
+	for dir, holders := range w.structure {
+		c.structure[dir] = append([]*fileHolder{}, holders...)
+	}
+	c.symlinkTable = make(map[string]string, len(w.symlinkTable))
+	for oldPath, newPath := range w.symlinkTable {
+		c.symlinkTable[oldPath] = newPath
+	}
+	if w.hardLinks != nil {
+		c.hardLinks = make(map[fileID]*fileHolder, len(w.hardLinks))
+		for id, holder := range w.hardLinks {
+			c.hardLinks[id] = holder
+		}
+	}
+	//Writing changes some of the compressor's options, such as xz's dictionary size.
+	switch comp := w.compressor.(type) {
+	case *compression.Gzip:
+		cp := *comp
+		c.compressor = &cp
+	case *compression.Lzo:
+		cp := *comp
+		c.compressor = &cp
+	case *compression.Xz:
+		cp := *comp
+		c.compressor = &cp
+	case *compression.Lz4:
+		cp := *comp
+		c.compressor = &cp
+	case *compression.Zstd:
+		cp := *comp
+		c.compressor = &cp
+	}
+	return &c
+}
+
+//AddArchive adds everything in rdr to the archive inside the folder at prefix. Permissions, ownership, modification times, symlinks, hard links,
+//devices, FIFOs, sockets, and xattrs are all kept. If prefix is "/", rdr's root folder is used as the archive's root folder.
+//
+//When the archive is written, if it uses the same compression type, compressor options, and BlockSize as rdr (and the same UncompressedData,
+//UncompressedFragments, and NoFragments flags), the data blocks and fragment blocks are copied as is, without decompressing them.
+//Otherwise, the data is decompressed and compressed again. Either way, rdr must not be closed until the archive is written.
+//
+//If w was made with NewAppendWriter, files from rdr replace the files already in the archive the same as AddFileTo.
+func (w *Writer) AddArchive(prefix string, rdr *Reader) error {
+	prefix = path.Clean("/" + prefix)
+	root, err := rdr.GetRootFolder()
+	if err != nil {
+		return err
+	}
+	var holders []*fileHolder
+	var rootHolder *fileHolder
+	links := make(map[uint32]*fileHolder)
+	var add func(fil *File, filepath string) error
+	add = func(fil *File, filepath string) error {
+		if filepath != "/" && !w.replaceable(filepath) {
+			return errors.New("File already exists at " + filepath)
+		}
+		holder, err := archiveHolder(fil, filepath, links)
+		if err != nil {
+			return err
+		}
+		if filepath == "/" {
+			rootHolder = holder
+		} else {
+			holders = append(holders, holder)
+		}
+		if !fil.IsDir() {
+			return nil
+		}
+		children, err := fil.GetChildren()
+		if err != nil {
+			return err
+		}
+		for _, child := range children {
+			err = add(child, path.Join(filepath, child.name))
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	err = add(root, prefix)
+	if err != nil {
+		return err
+	}
+	if rootHolder != nil {
+		w.root = rootHolder
+	}
+	//Nothing can fail from here on, so files from the archive being appended to are only now removed.
+	for _, holder := range holders {
+		w.replaceBase(holder.path+holder.name, holder.folder)
+	}
+	for _, holder := range holders {
+		w.structure[holder.path] = append(w.structure[holder.path], holder)
+	}
+	return nil
+}
+
+//archiveHolder creates the fileHolder for a File from another archive. links is the first holder of each inode number,
+//so files that share an inode are added as hard links.
+func archiveHolder(fil *File, filepath string, links map[uint32]*fileHolder) (*fileHolder, error) {
+	in, err := fil.getInode()
+	if err != nil {
+		return nil, err
+	}
+	holder := &fileHolder{
+		modTime: time.Unix(int64(in.Header.ModifiedTime), 0),
+		perm:    int(in.Header.Permissions),
+		UID:     fil.UID(),
+		GUID:    fil.GID(),
+	}
+	holder.path, holder.name = path.Split(filepath)
+	if !fil.IsDir() {
+		if first, ok := links[in.Header.Number]; ok {
+			holder.link = first
+			return holder, nil
+		}
+		links[in.Header.Number] = holder
+	}
+	xattrs, err := fil.Xattrs()
+	if err != nil {
+		return nil, err
+	}
+	if len(xattrs) > 0 {
+		holder.xattrs = xattrs
+	}
+	switch in.Type {
+	case inode.DirType, inode.ExtDirType:
+		holder.folder = true
+	case inode.FileType:
+		info := in.Info.(inode.File)
+		holder.reader = fil.handle()
+		holder.raw = &rawFile{
+			rdr:        fil.r,
+			fil:        fil,
+			blockStart: uint64(info.BlockStart),
+			blockSizes: info.BlockSizes,
+			size:       uint64(info.Size),
+			fragIndex:  info.FragmentIndex,
+			fragOffset: info.FragmentOffset,
+		}
+	case inode.ExtFileType:
+		info := in.Info.(inode.ExtFile)
+		holder.reader = fil.handle()
+		holder.raw = &rawFile{
+			rdr:        fil.r,
+			fil:        fil,
+			blockStart: info.BlockStart,
+			blockSizes: info.BlockSizes,
+			size:       info.Size,
+			fragIndex:  info.FragmentIndex,
+			fragOffset: info.FragmentOffset,
+		}
+	case inode.SymType, inode.ExtSymType:
+		holder.symlink = true
+		holder.symLocation = fil.SymlinkPath()
+	case inode.CharDevType, inode.ExtCharDeviceType:
+		holder.special = os.ModeDevice | os.ModeCharDevice
+		holder.rdev = deviceNumber(in)
+	case inode.BlockDevType, inode.ExtBlockDeviceType:
+		holder.special = os.ModeDevice
+		holder.rdev = deviceNumber(in)
+	case inode.FifoType, inode.ExtFifoType:
+		holder.special = os.ModeNamedPipe
+	case inode.SocketType, inode.ExtSocketType:
+		holder.special = os.ModeSocket
+	default:
+		return nil, errors.New("Unsupported inode type at " + filepath)
+	}
+	return holder, nil
+}
+
+//source returns the rawSource of rdr. The first time an archive is seen, it's checked if it's data can be copied as is, and if it can,
+//all of it's fragment blocks are copied.
+func (a *archive) source(rdr *Reader) (*rawSource, error) {
+	if src, ok := a.sources[rdr]; ok {
+		return src, nil
+	}
+	src := &rawSource{copied: make(map[uint64]*writeEntry)}
+	a.sources[rdr] = src
+	like, err := newWriterLike(rdr)
+	if err != nil {
+		//If a Writer can't use rdr's options, the data can't be copied.
+		return src, nil
+	}
+	like.setXzDictionary()
+	src.copy = like.compressionType == a.w.compressionType && like.BlockSize == a.w.BlockSize &&
+		bytes.Equal(like.compressorOptions(), a.options) &&
+		like.Flags.UncompressedData == a.w.Flags.UncompressedData &&
+		like.Flags.UncompressedFragments == a.w.Flags.UncompressedFragments &&
+		like.Flags.NoFragments == a.w.Flags.NoFragments
+	if !src.copy || rdr.super.FragCount == 0 {
+		return src, nil
+	}
+	entries, err := rdr.fragmentEntries()
+	if err != nil {
+		return nil, err
+	}
+	return src, a.pipe.add(func() error {
+		src.fragBase, err = a.frags.addRaw(rdr.r, entries)
+		return err
+	})
+}
+
+//copyRawData copies the entry's data blocks from the archive they're stored in, without decompressing them.
+//If the same data blocks have already been copied (such as duplicate files), they're used instead. If the data is in the archive being appended to,
+//it's left where it is.
+func (a *archive) copyRawData(ent *writeEntry, src *rawSource) error {
+	raw := ent.holder.raw
+	ent.size = raw.size
+	ent.blockSizes = raw.blockSizes
+	ent.fragIndex = 0xFFFFFFFF
+	ent.fragOffset = raw.fragOffset
+	var dataSize int64
+	for i, size := range raw.blockSizes {
+		if size == 0 {
+			//Sparse blocks are always full blocks, unless it's the end of the file.
+			blockSize := uint64(a.w.BlockSize)
+			if i == len(raw.blockSizes)-1 && raw.fragIndex == 0xFFFFFFFF && raw.size%blockSize != 0 {
+				blockSize = raw.size % blockSize
+			}
+			ent.sparse += blockSize
+		}
+		dataSize += int64(actualDataSize(size))
+	}
+	if src.inPlace {
+		ent.blockStart = raw.blockStart
+		ent.fragIndex = raw.fragIndex
+		return a.pipe.add(func() error {
+			a.addDuplicate(ent)
+			return nil
+		})
+	}
+	dup := src.copied[raw.blockStart]
+	if dataSize > 0 && dup == nil {
+		src.copied[raw.blockStart] = ent
+	}
+	return a.pipe.add(func() error {
+		if raw.fragIndex != 0xFFFFFFFF {
+			ent.fragIndex = src.fragBase + raw.fragIndex
+		}
+		if dataSize > 0 && dup != nil {
+			ent.blockStart = dup.blockStart
+			return nil
+		}
+		ent.blockStart = a.out.offset
+		_, err := io.Copy(a.out, io.NewSectionReader(raw.rdr.r, int64(raw.blockStart), dataSize))
+		if err != nil {
+			return err
+		}
+		a.addDuplicate(ent)
+		return nil
+	})
+}
+
+//addDuplicate adds an entry whose data was copied, or kept in place, to the duplicate finder, so files written later can use it's data.
+func (a *archive) addDuplicate(ent *writeEntry) {
+	if a.w.Flags.Duplicates && ent.size > 0 {
+		a.dups.addRaw(ent)
+	}
+}
@@ -1,15 +1,181 @@
 package squashfs
 
-//TODO: Allow settings the options
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
 
-// func (w *Writer) SetGzipOptions() error {}
+	"github.com/CalebQ42/squashfs/internal/compression"
+)
 
-// func (w *Writer) SetLzmaOptions() error {}
+//The gzip strategies that can be in an archive's compressor options. Only GzipDefault and GzipHuffmanOnly can be used with SetGzipOptions.
+//If more then one is set, each one is tried and the smallest result is used.
+const (
+	GzipDefault          = compression.GzipDefault
+	GzipFiltered         = compression.GzipFiltered
+	GzipHuffmanOnly      = compression.GzipHuffmanOnly
+	GzipRunLengthEncoded = compression.GzipRunLengthEncoded
+	GzipFixed            = compression.GzipFixed
+)
 
-// func (w *Writer) SetLzoOptions() error {}
+//The LZO algorithms that can be in an archive's compressor options. Only Lzo1x1 can be used with SetLzoOptions.
+const (
+	Lzo1x1    = compression.Lzo1x1
+	Lzo1x1_11 = compression.Lzo1x1_11
+	Lzo1x1_12 = compression.Lzo1x1_12
+	Lzo1x1_15 = compression.Lzo1x1_15
+	Lzo1x999  = compression.Lzo1x999
+)
 
-// func (w *Writer) SetXzOptions() error {}
+//The xz BCJ filters that can be used with SetXzOptions.
+//If any are set, each one is tried (along with no filter) and the smallest result is used.
+const (
+	XzFilterX86      = compression.XzFilterX86
+	XzFilterPowerPC  = compression.XzFilterPowerPC
+	XzFilterIA64     = compression.XzFilterIA64
+	XzFilterArm      = compression.XzFilterArm
+	XzFilterArmThumb = compression.XzFilterArmThumb
+	XzFilterSparc    = compression.XzFilterSparc
+)
 
-// func (w *Writer) SetLz4Options() error {}
+var (
+	//errWrongCompression is returned when setting the options of a different compression type then the Writer uses.
+	errWrongCompression = errors.New("Options are for a different compression type")
+)
 
-// func (w *Writer) SetZstdOptions() error {}
+//SetGzipOptions sets the options used for gzip compression.
+//level is between 1 and 9 (default 9). windowSize must be 15, since data is always compressed with a 15 bit window.
+//strategies are GzipDefault and GzipHuffmanOnly OR'd together, or 0 to only use the default strategy. The other strategies aren't supported
+//when compressing.
+func (w *Writer) SetGzipOptions(level, windowSize, strategies int) error {
+	gzip, ok := w.compressor.(*compression.Gzip)
+	if !ok {
+		return errWrongCompression
+	}
+	if level < 1 || level > 9 {
+		return errors.New("Gzip compression level must be between 1 and 9")
+	}
+	if windowSize != 15 {
+		return errors.New("Gzip window size must be 15")
+	}
+	if strategies&^(GzipDefault|GzipHuffmanOnly) != 0 {
+		return errors.New("Only the default and huffman only gzip strategies are supported")
+	}
+	gzip.CompressionLevel = int32(level)
+	gzip.WindowSize = int16(windowSize)
+	gzip.Strategies = int16(strategies)
+	return nil
+}
+
+//SetLzoOptions sets the options used for LZO compression.
+//Data is always compressed with Lzo1x1 (the default when writing), so algorithm must be Lzo1x1 and level must be 0.
+//Since mksquashfs defaults to Lzo1x999, the options are always written to LZO archives.
+func (w *Writer) SetLzoOptions(algorithm, level int) error {
+	lzo, ok := w.compressor.(*compression.Lzo)
+	if !ok {
+		return errWrongCompression
+	}
+	if algorithm != Lzo1x1 {
+		return errors.New("Only the lzo1x_1 LZO algorithm is supported")
+	}
+	if level != 0 {
+		return errors.New("LZO compression level is only used with lzo1x_999")
+	}
+	lzo.Algorithm = int32(algorithm)
+	lzo.CompressionLevel = int32(level)
+	return nil
+}
+
+//SetXzOptions sets the options used for xz compression.
+//dictionarySize must be at least 8192 and either a power of 2, or a power of 2 plus half of itself (such as 12288). If dictionarySize is 0 or larger
+//then the block size, the block size is used.
+//filters are the XzFilters OR'd together, or 0 to not use any.
+func (w *Writer) SetXzOptions(dictionarySize, filters int) error {
+	xz, ok := w.compressor.(*compression.Xz)
+	if !ok {
+		return errWrongCompression
+	}
+	if dictionarySize != 0 {
+		//Either 2^n or 2^n + 2^(n-1)
+		low := dictionarySize & -dictionarySize
+		if dictionarySize < 8192 || (dictionarySize != low && dictionarySize != low*3) {
+			return errors.New("Xz dictionary size must be at least 8192 and either a power of 2 or a power of 2 plus half of itself")
+		}
+	}
+	if filters&^(XzFilterX86|XzFilterPowerPC|XzFilterIA64|XzFilterArm|XzFilterArmThumb|XzFilterSparc) != 0 {
+		return errors.New("Unknown xz filters")
+	}
+	w.xzDictionarySize = uint32(dictionarySize)
+	xz.Filters = int32(filters)
+	xz.HasFilters = filters != 0
+	return nil
+}
+
+//SetLz4Options sets whether lz4 uses it's high compression mode.
+func (w *Writer) SetLz4Options(highCompression bool) error {
+	lz4, ok := w.compressor.(*compression.Lz4)
+	if !ok {
+		return errWrongCompression
+	}
+	lz4.HC = highCompression
+	return nil
+}
+
+//SetZstdOptions sets the compression level used for zstd compression. level is between 1 and 22 (default 15).
+func (w *Writer) SetZstdOptions(level int) error {
+	zstd, ok := w.compressor.(*compression.Zstd)
+	if !ok {
+		return errWrongCompression
+	}
+	if level < 1 || level > 22 {
+		return errors.New("Zstd compression level must be between 1 and 22")
+	}
+	zstd.CompressionLevel = int32(level)
+	return nil
+}
+
+//compressorOptions returns the compressor options that are written after the superblock, or nil if the default options are used.
+//lz4 options are always returned, since the kernel doesn't mount lz4 archives without them.
+func (w *Writer) compressorOptions() []byte {
+	var options interface{}
+	switch c := w.compressor.(type) {
+	case *compression.Gzip:
+		if c.CompressionLevel != 9 || c.WindowSize != 15 || c.Strategies != 0 {
+			options = struct {
+				CompressionLevel int32
+				WindowSize       int16
+				Strategies       int16
+			}{c.CompressionLevel, c.WindowSize, c.Strategies}
+		}
+	case *compression.Lzo:
+		if c.Algorithm != Lzo1x999 || c.CompressionLevel != 8 {
+			level := c.CompressionLevel
+			if c.Algorithm != Lzo1x999 {
+				//The level is only used for Lzo1x999, otherwise mksquashfs expects it to be 0.
+				level = 0
+			}
+			options = [2]int32{c.Algorithm, level}
+		}
+	case *compression.Xz:
+		if c.DictionarySize != int32(w.BlockSize) || c.Filters != 0 {
+			options = [2]int32{c.DictionarySize, c.Filters}
+		}
+	case *compression.Lz4:
+		var flags int32
+		if c.HC {
+			flags = 1
+		}
+		//The version is always 1.
+		options = [2]int32{1, flags}
+	case *compression.Zstd:
+		if c.CompressionLevel != 15 {
+			options = c.CompressionLevel
+		}
+	}
+	if options == nil {
+		return nil
+	}
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.LittleEndian, options)
+	return buf.Bytes()
+}
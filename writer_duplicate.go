@@ -0,0 +1,128 @@
+package squashfs
+
+import (
+	"bytes"
+	"hash/crc32"
+	"io"
+)
+
+//dupKey is used to find files that might have the same content.
+type dupKey struct {
+	size     uint64
+	checksum uint32
+}
+
+//duplicateFinder keeps track of the files that have been written so files with the same content can share the same data.
+//Possible duplicates are found by their size and checksum, then their written data is compared.
+type duplicateFinder struct {
+	out   *archiveWriter
+	frags *fragmentWriter
+	files map[dupKey][]*writeEntry
+	raw   map[uint64][]*writeEntry //Entries whose data was copied from another archive, by size. They're added to files once their checksum is needed.
+}
+
+func newDuplicateFinder(out *archiveWriter, frags *fragmentWriter) *duplicateFinder {
+	return &duplicateFinder{
+		out:   out,
+		frags: frags,
+		files: make(map[dupKey][]*writeEntry),
+		raw:   make(map[uint64][]*writeEntry),
+	}
+}
+
+//add adds an entry whose data has been written, so later files can be compared to it.
+func (d *duplicateFinder) add(ent *writeEntry, checksum uint32) {
+	key := dupKey{
+		size:     ent.size,
+		checksum: checksum,
+	}
+	d.files[key] = append(d.files[key], ent)
+}
+
+//addRaw adds an entry whose data was copied from another archive without decompressing it. Since it's checksum isn't known,
+//it's only calculated, by reading the file, if a file with the same size is written.
+func (d *duplicateFinder) addRaw(ent *writeEntry) {
+	d.raw[ent.size] = append(d.raw[ent.size], ent)
+}
+
+//checksumRaw calculates the checksums of the copied entries with the given size and adds them to files.
+func (d *duplicateFinder) checksumRaw(size uint64) error {
+	for _, ent := range d.raw[size] {
+		checksum := crc32.NewIEEE()
+		_, err := io.Copy(checksum, ent.holder.raw.fil.handle())
+		if err != nil {
+			return err
+		}
+		d.add(ent, checksum.Sum32())
+	}
+	delete(d.raw, size)
+	return nil
+}
+
+//find returns an already written entry with the same content as ent, or nil if there isn't one.
+//ent's data blocks must already be written and tail is the data that will be put in a fragment.
+func (d *duplicateFinder) find(ent *writeEntry, checksum uint32, tail []byte) (*writeEntry, error) {
+	err := d.checksumRaw(ent.size)
+	if err != nil {
+		return nil, err
+	}
+	key := dupKey{
+		size:     ent.size,
+		checksum: checksum,
+	}
+	for _, other := range d.files[key] {
+		same, err := d.same(ent, other, tail)
+		if err != nil {
+			return nil, err
+		}
+		if same {
+			return other, nil
+		}
+	}
+	return nil, nil
+}
+
+//same compares ent's written data blocks and fragment with other's.
+func (d *duplicateFinder) same(ent, other *writeEntry, tail []byte) (bool, error) {
+	if len(ent.blockSizes) != len(other.blockSizes) || (len(tail) > 0) != (other.fragIndex != 0xFFFFFFFF) {
+		return false, nil
+	}
+	var dataSize int64
+	for i, size := range ent.blockSizes {
+		if size != other.blockSizes[i] {
+			return false, nil
+		}
+		dataSize += int64(actualDataSize(size))
+	}
+	if len(tail) > 0 {
+		otherTail, err := d.frags.read(other.fragIndex, other.fragOffset, len(tail))
+		if err != nil {
+			return false, err
+		}
+		if !bytes.Equal(tail, otherTail) {
+			return false, nil
+		}
+	}
+	//The same data always compresses the same, so the compressed blocks can be compared directly.
+	a := make([]byte, 65536)
+	b := make([]byte, 65536)
+	for done := int64(0); done < dataSize; {
+		size := dataSize - done
+		if size > int64(len(a)) {
+			size = int64(len(a))
+		}
+		n, err := d.out.ReadAt(a[:size], int64(ent.blockStart)+done)
+		if n < int(size) {
+			return false, err
+		}
+		n, err = d.out.ReadAt(b[:size], int64(other.blockStart)+done)
+		if n < int(size) {
+			return false, err
+		}
+		if !bytes.Equal(a[:size], b[:size]) {
+			return false, nil
+		}
+		done += size
+	}
+	return true, nil
+}
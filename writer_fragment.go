@@ -0,0 +1,116 @@
+package squashfs
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+//fragmentWriter packs the ends of files, and small files, into shared fragment blocks.
+type fragmentWriter struct {
+	w       *Writer
+	out     *archiveWriter
+	buf     []byte //The current, unfinished, fragment block.
+	entries []fragmentEntry
+	//The last fragment block that was read back, so comparing many duplicates doesn't need to decompress the same block again.
+	lastRead      []byte
+	lastReadIndex uint32
+}
+
+func (w *Writer) newFragmentWriter(out *archiveWriter) *fragmentWriter {
+	return &fragmentWriter{
+		w:   w,
+		out: out,
+	}
+}
+
+//add adds data (which must be smaller then the block size) to a fragment block and returns the fragment's index and the offset of the data inside of it.
+func (f *fragmentWriter) add(data []byte) (index uint32, offset uint32, err error) {
+	if len(f.buf)+len(data) > int(f.w.BlockSize) {
+		err = f.flush()
+		if err != nil {
+			return
+		}
+	}
+	index = uint32(len(f.entries))
+	offset = uint32(len(f.buf))
+	f.buf = append(f.buf, data...)
+	return
+}
+
+//flush writes the current fragment block, if it has any data.
+func (f *fragmentWriter) flush() error {
+	if len(f.buf) == 0 {
+		return nil
+	}
+	start := f.out.offset
+	size, err := f.w.writeBlock(f.out, f.buf, f.w.Flags.UncompressedFragments)
+	if err != nil {
+		return err
+	}
+	f.entries = append(f.entries, fragmentEntry{
+		Start: start,
+		Size:  size,
+	})
+	f.buf = f.buf[:0]
+	return nil
+}
+
+//addRaw copies already compressed fragment blocks, described by entries, from r and returns the index of the first one.
+//The current fragment block is written first, so the copied blocks stay in the same order.
+func (f *fragmentWriter) addRaw(r io.ReaderAt, entries []fragmentEntry) (uint32, error) {
+	err := f.flush()
+	if err != nil {
+		return 0, err
+	}
+	base := uint32(len(f.entries))
+	for _, entry := range entries {
+		start := f.out.offset
+		_, err = io.Copy(f.out, io.NewSectionReader(r, int64(entry.Start), int64(actualDataSize(entry.Size))))
+		if err != nil {
+			return 0, err
+		}
+		f.entries = append(f.entries, fragmentEntry{
+			Start: start,
+			Size:  entry.Size,
+		})
+	}
+	return base, nil
+}
+
+//read returns size bytes, starting at offset, from the given fragment block. If the block has already been written, it's read back from the archive.
+func (f *fragmentWriter) read(index uint32, offset uint32, size int) ([]byte, error) {
+	var block []byte
+	switch {
+	case index == uint32(len(f.entries)):
+		block = f.buf
+	case f.lastRead != nil && index == f.lastReadIndex:
+		block = f.lastRead
+	default:
+		entry := f.entries[index]
+		sec := io.NewSectionReader(f.out, int64(entry.Start), int64(actualDataSize(entry.Size)))
+		var err error
+		if entry.Size&(1<<24) == 1<<24 {
+			block, err = io.ReadAll(sec)
+		} else {
+			block, err = f.w.compressor.Decompress(sec)
+		}
+		if err != nil {
+			return nil, err
+		}
+		f.lastRead = block
+		f.lastReadIndex = index
+	}
+	if len(block) < int(offset)+size {
+		return nil, errors.New("Fragment is smaller then expected")
+	}
+	return block[offset : int(offset)+size], nil
+}
+
+//table returns the fragment table's data. Should only be called after the last fragment block is flushed.
+func (f *fragmentWriter) table() []byte {
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.LittleEndian, f.entries)
+	return buf.Bytes()
+}
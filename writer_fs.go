@@ -0,0 +1,210 @@
+package squashfs
+
+import (
+	"errors"
+	"io/fs"
+	"log"
+	"path"
+	"syscall"
+)
+
+//FileOwner can be implemented by the fs.FileInfo of a file (or the value returned by it's Sys function) to give the file's owner when using AddFS.
+//File implements FileOwner, so a Reader keeps it's ownership when added with AddFS.
+type FileOwner interface {
+	UID() int
+	GID() int
+}
+
+//SymlinkFS is a fs.FS that can read symlinks. If the fs.FS given to AddFS implements it, symlinks are added as symlinks.
+//Reader implements it. os.DirFS only implements it when built with Go 1.25 or newer (where it's ReadLink is from fs.ReadLinkFS),
+//so with older versions AddFS can't add symlinks from it.
+type SymlinkFS interface {
+	fs.FS
+	ReadLink(name string) (string, error)
+}
+
+//fsFileReader opens a file from a fs.FS the first time it's read, so only the file being written is open.
+type fsFileReader struct {
+	fsys fs.FS
+	fil  fs.File
+	name string
+}
+
+func (f *fsFileReader) Read(p []byte) (int, error) {
+	if f.fil == nil {
+		var err error
+		f.fil, err = f.fsys.Open(f.name)
+		if err != nil {
+			return 0, err
+		}
+	}
+	return f.fil.Read(p)
+}
+
+func (f *fsFileReader) Close() error {
+	if f.fil == nil {
+		return nil
+	}
+	return f.fil.Close()
+}
+
+//fsOwner returns the uid and gid of a file from it's fs.FileInfo using FileOwner, or syscall.Stat_t (such as when using os.DirFS).
+//If neither are available, the file is owned by root.
+func fsOwner(info fs.FileInfo) (int, int) {
+	if owner, ok := info.(FileOwner); ok {
+		return owner.UID(), owner.GID()
+	}
+	switch sys := info.Sys().(type) {
+	case FileOwner:
+		return sys.UID(), sys.GID()
+	//Thanks to https://stackoverflow.com/questions/58179647/getting-uid-and-gid-of-a-file for uid and guid getting
+	case *syscall.Stat_t:
+		return int(sys.Uid), int(sys.Gid)
+	}
+	return 0, 0
+}
+
+//fsRdev returns the device number of a device from it's fs.FileInfo, encoded the same way as in squashfs archives. The device number is found
+//using a Rdev method (such as File's), or syscall.Stat_t (such as when using os.DirFS). If neither are available, 0 is returned.
+func fsRdev(info fs.FileInfo) uint32 {
+	var rdev uint64
+	if dev, ok := info.(interface{ Rdev() uint64 }); ok {
+		rdev = dev.Rdev()
+	} else if sys, ok := info.Sys().(*syscall.Stat_t); ok {
+		rdev = uint64(sys.Rdev)
+	}
+	//Rdev is encoded the same way as glibc's makedev.
+	major := (rdev>>8)&0xfff | (rdev>>32)&^0xfff
+	minor := rdev&0xff | (rdev>>12)&0xffffff00
+	return encodeDevice(int64(major), int64(minor))
+}
+
+//fileID is a file's device and inode number on the file system it's from. For files from a Reader, rdr is set instead of dev.
+type fileID struct {
+	rdr *Reader
+	dev uint64
+	ino uint64
+}
+
+//fsFileID returns the fileID of a file from it's fs.FileInfo using syscall.Stat_t, or the inode number if it's a File. Returns false if it's a folder,
+//it's fileID isn't available, or it only has one hard link, since then it doesn't need to be tracked.
+func fsFileID(info fs.FileInfo) (fileID, bool) {
+	if info.IsDir() {
+		return fileID{}, false
+	}
+	//A File's Sys creates it's reader, so the inode is used directly.
+	if fil, ok := info.(*File); ok {
+		in, err := fil.getInode()
+		if err != nil || hardLinks(in) < 2 {
+			return fileID{}, false
+		}
+		return fileID{rdr: fil.r, ino: uint64(in.Header.Number)}, true
+	}
+	sys, ok := info.Sys().(*syscall.Stat_t)
+	if !ok || sys.Nlink < 2 {
+		return fileID{}, false
+	}
+	return fileID{dev: uint64(sys.Dev), ino: uint64(sys.Ino)}, true
+}
+
+//AddFS adds everything in fsys to the archive inside the folder at prefix, keeping permissions, modification times, and (using FileOwner) ownership.
+//Symlinks are only kept as symlinks if fsys implements SymlinkFS. Devices, FIFOs, and sockets are kept. Files are not opened until the archive is written.
+//
+//If prefix is "/", the root folder of fsys is used as the archive's root folder, so it's permissions and such are kept.
+//Files with the same device and inode number (such as when using os.DirFS), or that share an inode in a Reader, are added as hard links.
+//If allowErrors is set, files that can't be added are skipped and the error is logged. Otherwise nothing is added if there's an error.
+//
+//If w was made with NewAppendWriter, files from fsys replace the files already in the archive the same as AddFileTo.
+func (w *Writer) AddFS(prefix string, fsys fs.FS) error {
+	prefix = path.Clean("/" + prefix)
+	var holders []*fileHolder
+	var root *fileHolder
+	links := make(map[fileID]*fileHolder)
+	err := fs.WalkDir(fsys, ".", func(name string, d fs.DirEntry, err error) error {
+		if err == nil {
+			var holder *fileHolder
+			holder, err = w.fsHolder(fsys, prefix, name, d, links)
+			if holder != nil && holder.name == "" {
+				root = holder
+			} else if holder != nil {
+				holders = append(holders, holder)
+			}
+		}
+		if err != nil && w.allowErrors && name != "." {
+			log.Println("Error while adding", name)
+			log.Println(err)
+			if d != nil && d.IsDir() {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if root != nil {
+		w.root = root
+	}
+	//Nothing can fail from here on, so files from the archive being appended to are only now removed.
+	for _, holder := range holders {
+		w.replaceBase(holder.path+holder.name, holder.folder)
+	}
+	for _, holder := range holders {
+		w.structure[holder.path] = append(w.structure[holder.path], holder)
+	}
+	return nil
+}
+
+//fsHolder creates the fileHolder for the file at name in fsys. If the file is the root of fsys and prefix is "/", the holder is for the archive's
+//root folder and has an empty name. links is the first holder of each fileID, so files that share an inode are added as hard links.
+func (w *Writer) fsHolder(fsys fs.FS, prefix, name string, d fs.DirEntry, links map[fileID]*fileHolder) (*fileHolder, error) {
+	filepath := path.Join(prefix, name)
+	if filepath != "/" && !w.replaceable(filepath) {
+		return nil, errors.New("File already exists at " + filepath)
+	}
+	info, err := d.Info()
+	if err != nil {
+		return nil, err
+	}
+	var holder fileHolder
+	holder.path, holder.name = path.Split(filepath)
+	holder.modTime = info.ModTime()
+	holder.perm = int(info.Mode().Perm())
+	holder.UID, holder.GUID = fsOwner(info)
+	switch {
+	case info.IsDir():
+		holder.folder = true
+	case info.Mode()&fs.ModeSymlink == fs.ModeSymlink:
+		symFS, ok := fsys.(SymlinkFS)
+		if !ok {
+			return nil, errors.New("Can't read symlink " + name)
+		}
+		holder.symlink = true
+		holder.symLocation, err = symFS.ReadLink(name)
+		if err != nil {
+			return nil, err
+		}
+	case info.Mode().IsRegular():
+		holder.reader = &fsFileReader{
+			fsys: fsys,
+			name: name,
+		}
+	case info.Mode()&(fs.ModeDevice|fs.ModeNamedPipe|fs.ModeSocket) != 0:
+		holder.special = info.Mode() & (fs.ModeDevice | fs.ModeCharDevice | fs.ModeNamedPipe | fs.ModeSocket)
+		if info.Mode()&fs.ModeDevice == fs.ModeDevice {
+			holder.rdev = fsRdev(info)
+		}
+	default:
+		return nil, errors.New("Unsupported file type " + name)
+	}
+	if id, ok := fsFileID(info); ok {
+		if first, ok := links[id]; ok {
+			holder.link = first
+			holder.reader = nil
+		} else {
+			links[id] = &holder
+		}
+	}
+	return &holder, nil
+}
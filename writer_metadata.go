@@ -0,0 +1,59 @@
+package squashfs
+
+import "bytes"
+
+//metadataWriter writes data into metadata blocks, such as the inode and directory tables.
+//The blocks are kept in memory until the table is written.
+type metadataWriter struct {
+	w            *Writer
+	out          bytes.Buffer //Finished metadata blocks.
+	buf          []byte       //Data for the current, unfinished, block.
+	uncompressed bool
+}
+
+func (w *Writer) newMetadataWriter(uncompressed bool) *metadataWriter {
+	return &metadataWriter{
+		w:            w,
+		uncompressed: uncompressed,
+	}
+}
+
+//position returns the current position in the same format as an inode reference.
+//The upper bits are the offset of the current block (relative to the start of the table) and the lower 16 bits are the offset inside the block.
+func (m *metadataWriter) position() uint64 {
+	return uint64(m.out.Len())<<16 | uint64(len(m.buf))
+}
+
+//Write adds the data to the table. Once a block is full it's compressed.
+func (m *metadataWriter) Write(p []byte) (int, error) {
+	m.buf = append(m.buf, p...)
+	for len(m.buf) >= metadataSize {
+		err := m.flush(metadataSize)
+		if err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+//flush writes the first size bytes of buf as a metadata block.
+func (m *metadataWriter) flush(size int) error {
+	block, err := m.w.metadataBlock(m.buf[:size], m.uncompressed)
+	if err != nil {
+		return err
+	}
+	m.out.Write(block)
+	m.buf = append(m.buf[:0], m.buf[size:]...)
+	return nil
+}
+
+//Bytes finishes the last block and returns the complete table.
+func (m *metadataWriter) Bytes() ([]byte, error) {
+	if len(m.buf) > 0 {
+		err := m.flush(len(m.buf))
+		if err != nil {
+			return nil, err
+		}
+	}
+	return m.out.Bytes(), nil
+}
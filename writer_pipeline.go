@@ -0,0 +1,132 @@
+package squashfs
+
+import "runtime"
+
+//blockPipeline compresses blocks in parallel, while still writing them in the order they're added.
+//Functions can also be added, which are called once everything added before them is written, but before anything added after them.
+type blockPipeline struct {
+	w     *Writer
+	out   *archiveWriter
+	jobs  chan *pipelineItem
+	queue []*pipelineItem //Items that are added, but not yet written, in the order they were added.
+	max   int
+}
+
+//pipelineItem is either a block or a function in a blockPipeline.
+type pipelineItem struct {
+	fn           func() error //If set, the item is a function instead of a block.
+	written      func(size uint32) error
+	done         chan struct{} //Closed once the block is compressed.
+	err          error
+	data         []byte
+	uncompressed bool
+	compressed   bool
+}
+
+func (w *Writer) newBlockPipeline(out *archiveWriter) *blockPipeline {
+	workers := w.CompressionWorkers
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+	max := w.MaxInFlightBlocks
+	if max <= 0 {
+		max = 4 * workers
+	}
+	p := &blockPipeline{
+		w:    w,
+		out:  out,
+		jobs: make(chan *pipelineItem, max),
+		max:  max,
+	}
+	for i := 0; i < workers; i++ {
+		go p.work()
+	}
+	return p
+}
+
+func (p *blockPipeline) work() {
+	for item := range p.jobs {
+		if !item.uncompressed {
+			item.data, item.compressed, item.err = p.w.compressData(item.data)
+		}
+		close(item.done)
+	}
+}
+
+//addBlock adds a block to be compressed, unless uncompressed is set, and written. Once the block is written, written is called
+//with the block's size, as stored in an inode or fragment entry. data shouldn't be modified after it's added.
+func (p *blockPipeline) addBlock(data []byte, uncompressed bool, written func(size uint32) error) error {
+	err := p.makeRoom()
+	if err != nil {
+		return err
+	}
+	item := &pipelineItem{
+		written:      written,
+		done:         make(chan struct{}),
+		data:         data,
+		uncompressed: uncompressed,
+	}
+	p.queue = append(p.queue, item)
+	p.jobs <- item
+	return nil
+}
+
+//add adds a function that's called once everything added before it is written.
+func (p *blockPipeline) add(fn func() error) error {
+	err := p.makeRoom()
+	if err != nil {
+		return err
+	}
+	p.queue = append(p.queue, &pipelineItem{fn: fn})
+	return nil
+}
+
+//makeRoom writes items until there's room for another item in the queue.
+func (p *blockPipeline) makeRoom() error {
+	for len(p.queue) >= p.max {
+		err := p.next()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//next waits for the first item in the queue, then writes it or calls it's function.
+func (p *blockPipeline) next() error {
+	item := p.queue[0]
+	p.queue[0] = nil
+	p.queue = p.queue[1:]
+	if item.fn != nil {
+		return item.fn()
+	}
+	<-item.done
+	if item.err != nil {
+		return item.err
+	}
+	_, err := p.out.Write(item.data)
+	if err != nil {
+		return err
+	}
+	size := uint32(len(item.data))
+	if !item.compressed {
+		size |= 1 << 24
+	}
+	return item.written(size)
+}
+
+//flush writes everything that's been added.
+func (p *blockPipeline) flush() error {
+	for len(p.queue) > 0 {
+		err := p.next()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//close stops the pipeline's workers. Anything that hasn't been written is discarded.
+func (p *blockPipeline) close() {
+	close(p.jobs)
+}
@@ -0,0 +1,122 @@
+package squashfs
+
+import (
+	"archive/tar"
+	"errors"
+	"io"
+	"os"
+	"path"
+	"strings"
+)
+
+//paxXattrPrefix is the prefix of PAX records that hold xattrs.
+const paxXattrPrefix = "SCHILY.xattr."
+
+//ConvertTar converts the tar archive read from tarball to a squashfs archive, written to write. This is similar to tar2sqfs.
+//Data is written as the tar archive is read, so tarball doesn't need to be seekable and it's not extracted anywhere first.
+//
+//w's settings (such as compression and BlockSize) are used, and anything already added to w is also included. w itself isn't changed,
+//so files from the tar archive aren't added to it, but readers added with AddReaderTo are read. w can't be made with NewAppendWriter.
+//
+//Regular files, folders, symlinks, hard links, devices, and FIFOs are supported, along with their permissions, owner, modification time,
+//and xattrs (stored as PAX records). If the tar archive includes it's root folder ("./"), it's metadata is used for the archive's root folder.
+//If a path is in the tar archive more then once, an error is returned, unless they're both folders, in which case the last one's metadata is used.
+func (w *Writer) ConvertTar(write io.Writer, tarball io.Reader) (int64, error) {
+	if w.base != nil {
+		return 0, errors.New("ConvertTar can't be used with a Writer made with NewAppendWriter")
+	}
+	conv := w.clone()
+	return conv.write(write, func(a *archive) error {
+		return conv.addTar(a, tar.NewReader(tarball))
+	})
+}
+
+//addTar adds everything in the tar archive to w. Regular files have their data written immediately.
+func (w *Writer) addTar(a *archive, rdr *tar.Reader) error {
+	for {
+		hdr, err := rdr.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		filepath := path.Clean("/" + hdr.Name)
+		holder := &fileHolder{
+			modTime: hdr.ModTime,
+			perm:    int(hdr.Mode & 07777),
+			UID:     hdr.Uid,
+			GUID:    hdr.Gid,
+		}
+		holder.path, holder.name = path.Split(filepath)
+		for key, value := range hdr.PAXRecords {
+			if !strings.HasPrefix(key, paxXattrPrefix) {
+				continue
+			}
+			//Only xattrs with prefixes supported by squashfs are kept.
+			name := strings.TrimPrefix(key, paxXattrPrefix)
+			if _, _, ok := xattrPrefix(name); ok {
+				if holder.xattrs == nil {
+					holder.xattrs = make(map[string][]byte)
+				}
+				holder.xattrs[name] = []byte(value)
+			}
+		}
+		switch hdr.Typeflag {
+		case tar.TypeReg, tar.TypeRegA:
+			holder.reader = rdr
+		case tar.TypeDir:
+			holder.folder = true
+		case tar.TypeSymlink:
+			holder.symlink = true
+			holder.symLocation = hdr.Linkname
+		case tar.TypeLink:
+			holder.link = w.holderAt(path.Clean("/" + hdr.Linkname))
+			if holder.link == nil {
+				return errors.New("Hard link to a file that isn't in the archive at " + filepath)
+			}
+		case tar.TypeChar:
+			holder.special = os.ModeDevice | os.ModeCharDevice
+			holder.rdev = encodeDevice(hdr.Devmajor, hdr.Devminor)
+		case tar.TypeBlock:
+			holder.special = os.ModeDevice
+			holder.rdev = encodeDevice(hdr.Devmajor, hdr.Devminor)
+		case tar.TypeFifo:
+			holder.special = os.ModeNamedPipe
+		case tar.TypeXGlobalHeader:
+			continue
+		default:
+			return errors.New("Unsupported tar entry type " + string(hdr.Typeflag) + " at " + filepath)
+		}
+		if filepath == "/" {
+			if !holder.folder {
+				return errors.New("Tar archive's root isn't a folder")
+			}
+			w.root = holder
+			continue
+		}
+		if existing := w.holderAt(filepath); existing != nil {
+			if !existing.folder || !holder.folder {
+				return errors.New("File already exists at " + filepath)
+			}
+			//A folder's children are found by their path, so the folder can simply be replaced.
+			for i, other := range w.structure[holder.path] {
+				if other == existing {
+					w.structure[holder.path][i] = holder
+				}
+			}
+			continue
+		}
+		w.structure[holder.path] = append(w.structure[holder.path], holder)
+		if holder.reader != nil {
+			err = a.writeData(holder)
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
+
+//encodeDevice encodes a device's major and minor numbers the same way the kernel does for squashfs archives.
+func encodeDevice(major, minor int64) uint32 {
+	return uint32(minor&0xff | (major&0xfff)<<8 | (minor&^0xff)<<12)
+}
@@ -0,0 +1,1714 @@
+package squashfs
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"math/rand"
+	"os"
+	pathpkg "path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"testing/fstest"
+	"testing/iotest"
+	"time"
+
+	"github.com/CalebQ42/squashfs/internal/compression"
+	"github.com/CalebQ42/squashfs/internal/inode"
+)
+
+//makeTestDir creates a folder with a bit of everything to test the Writer with.
+func makeTestDir(t *testing.T) string {
+	dir := filepath.Join(t.TempDir(), "dir")
+	big := make([]byte, 3*4096+100)
+	rnd := rand.New(rand.NewSource(42))
+	for i := range big {
+		//compressible, but not too much.
+		big[i] = byte(rnd.Intn(16))
+	}
+	files := map[string][]byte{
+		"a.txt":              []byte("hello squashfs"),
+		"big.bin":            big,
+		"sparse.bin":         append(make([]byte, 2*4096), []byte("end")...),
+		"empty.txt":          {},
+		"sub/nested.txt":     []byte("nested"),
+		"sub/deeper/abc.txt": []byte(strings.Repeat("abc", 5000)),
+	}
+	for name, data := range files {
+		err := os.MkdirAll(filepath.Dir(filepath.Join(dir, name)), 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = os.WriteFile(filepath.Join(dir, name), data, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := os.Mkdir(filepath.Join(dir, "sub", "empty"), 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Symlink("a.txt", filepath.Join(dir, "link"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+//writeTestArchive writes an archive using w and opens it.
+func writeTestArchive(t *testing.T, w *Writer) *Reader {
+	var buf bytes.Buffer
+	_, err := w.WriteTo(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rdr, err := NewSquashfsReader(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rdr
+}
+
+//checkSameTree checks that everything in the folder on disk is in the archive, at archiveDir, with the same content.
+func checkSameTree(t *testing.T, rdr *Reader, dir, archiveDir string) {
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(dir, path)
+		archivePath := archiveDir + "/" + filepath.ToSlash(rel)
+		if rel == "." {
+			archivePath = archiveDir
+		}
+		fil := rdr.GetFileAtPath(archivePath)
+		if fil == nil {
+			t.Errorf("%s not found in archive", archivePath)
+			return nil
+		}
+		if fil.Mode() != info.Mode() {
+			t.Errorf("%s has mode %v, wanted %v", archivePath, fil.Mode(), info.Mode())
+		}
+		switch {
+		case info.Mode()&os.ModeSymlink == os.ModeSymlink:
+			target, _ := os.Readlink(path)
+			if fil.SymlinkPath() != target {
+				t.Errorf("%s points to %s, wanted %s", archivePath, fil.SymlinkPath(), target)
+			}
+		case info.Mode().IsRegular():
+			want, _ := os.ReadFile(path)
+			got, err := io.ReadAll(fil)
+			if err != nil {
+				t.Errorf("reading %s: %v", archivePath, err)
+			} else if !bytes.Equal(got, want) {
+				t.Errorf("%s content doesn't match", archivePath)
+			}
+			if fil.Size() != info.Size() {
+				t.Errorf("%s has size %d, wanted %d", archivePath, fil.Size(), info.Size())
+			}
+			if !fil.ModTime().Equal(info.ModTime().Truncate(1e9)) {
+				t.Errorf("%s has mod time %v, wanted %v", archivePath, fil.ModTime(), info.ModTime())
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWriterRoundTrip(t *testing.T) {
+	dir := makeTestDir(t)
+	for comp, name := range map[int]string{
+		GzipCompression: "gzip",
+		LzmaCompression: "lzma",
+		LzoCompression:  "lzo",
+		XzCompression:   "xz",
+		Lz4Compression:  "lz4",
+		ZstdCompression: "zstd",
+	} {
+		t.Run(name, func(t *testing.T) {
+			w, err := NewWriterWithOptions(comp, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			w.BlockSize = 4096
+			fil, err := os.Open(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = w.AddFileTo("/dir", fil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = w.AddReaderTo("/implicit/deep/file.txt", strings.NewReader("implicit folders"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			rdr := writeTestArchive(t, w)
+			if rdr.super.CompressionType != uint16(comp) {
+				t.Fatal("wrong compression type", rdr.super.CompressionType)
+			}
+			checkSameTree(t, rdr, dir, "/dir")
+			data, err := rdr.ReadFile("implicit/deep/file.txt")
+			if err != nil || string(data) != "implicit folders" {
+				t.Fatal("implicit/deep/file.txt:", string(data), err)
+			}
+			if mode := rdr.GetFileAtPath("/implicit").Mode(); mode != os.ModeDir|0755 {
+				t.Error("implicit folder has mode", mode)
+			}
+			err = fstest.TestFS(rdr, "dir/a.txt", "dir/big.bin", "dir/sub/deeper/abc.txt", "dir/link", "implicit/deep/file.txt")
+			if err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestWriterLargeDirectory(t *testing.T) {
+	w, err := NewWriter()
+	if err != nil {
+		t.Fatal(err)
+	}
+	//Enough files that the directory listing spans multiple metadata blocks and needs multiple headers and indexes.
+	const count = 3000
+	name := func(i int) string {
+		return fmt.Sprintf("%sfile%05d", strings.Repeat("x", i%50), i)
+	}
+	for i := 0; i < count; i++ {
+		err = w.AddReaderTo("/big/"+name(i), strings.NewReader(strconv.Itoa(i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	rdr := writeTestArchive(t, w)
+	dir := rdr.GetFileAtPath("/big")
+	if dir == nil {
+		t.Fatal("Can't find /big")
+	}
+	in, err := dir.getInode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if in.Type != inode.ExtDirType {
+		t.Error("/big should be an extended directory, got type", in.Type)
+	}
+	entries, err := rdr.ReadDir("big")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != count {
+		t.Fatal("wrong number of entries", len(entries))
+	}
+	for i := 0; i < count; i += 7 {
+		data, err := rdr.ReadFile("big/" + name(i))
+		if err != nil {
+			t.Fatal(name(i), err)
+		}
+		if string(data) != strconv.Itoa(i) {
+			t.Fatal(name(i), "has wrong content", string(data))
+		}
+	}
+	if rdr.GetFileAtPath("/big/doesnotexist") != nil {
+		t.Error("Found a file that doesn't exist")
+	}
+}
+
+func TestWriterFragments(t *testing.T) {
+	dir := makeTestDir(t)
+	for name, flags := range map[string]SuperblockFlags{
+		"default":      {},
+		"none":         {NoFragments: true},
+		"always":       {AlwaysFragments: true},
+		"uncompressed": {AlwaysFragments: true, UncompressedFragments: true},
+	} {
+		t.Run(name, func(t *testing.T) {
+			w, err := NewWriterWithOptions(GzipCompression, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			w.BlockSize = 4096
+			w.Flags = flags
+			fil, err := os.Open(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = w.AddFileTo("/dir", fil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			rdr := writeTestArchive(t, w)
+			if flags.NoFragments && rdr.super.FragCount != 0 {
+				t.Error("NoFragments is set, but the archive has", rdr.super.FragCount, "fragments")
+			} else if !flags.NoFragments && rdr.super.FragCount == 0 {
+				t.Error("Archive has no fragments")
+			}
+			checkSameTree(t, rdr, dir, "/dir")
+			in, err := rdr.GetFileAtPath("/dir/big.bin").getInode()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if fragmented := in.Info.(inode.File).Fragmented; fragmented != flags.AlwaysFragments {
+				t.Error("big.bin fragmented:", fragmented)
+			}
+		})
+	}
+}
+
+func TestWriterSmallFiles(t *testing.T) {
+	sizes := make(map[bool]int)
+	for _, noFrags := range []bool{false, true} {
+		w, err := NewWriter()
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Flags.NoFragments = noFrags
+		for i := 0; i < 500; i++ {
+			err = w.AddReaderTo(fmt.Sprintf("/etc/conf%d.conf", i), strings.NewReader(fmt.Sprintf("option%d = true\nvalue = %d\n", i, i*i)))
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		var buf bytes.Buffer
+		_, err = w.WriteTo(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sizes[noFrags] = buf.Len()
+		rdr, err := NewSquashfsReader(bytes.NewReader(buf.Bytes()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 500; i += 13 {
+			data, err := rdr.ReadFile(fmt.Sprintf("etc/conf%d.conf", i))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(data) != fmt.Sprintf("option%d = true\nvalue = %d\n", i, i*i) {
+				t.Fatal("Wrong content:", string(data))
+			}
+		}
+	}
+	if sizes[false]*2 > sizes[true] {
+		t.Error("Fragments should make small files much smaller. With fragments:", sizes[false], "Without:", sizes[true])
+	}
+}
+
+func TestWriterDuplicates(t *testing.T) {
+	big := make([]byte, 16000)
+	rand.New(rand.NewSource(1)).Read(big)
+	different := append([]byte{}, big...)
+	different[len(different)-1] = 'x'
+	files := map[string][]byte{
+		"/a/small.txt":     []byte("small file"),
+		"/b/small.txt":     []byte("small file"),
+		"/c/small.txt":     []byte("small file"),
+		"/a/big.bin":       big,
+		"/b/big.bin":       big,
+		"/a/different.bin": different,
+		"/a/sparse.bin":    make([]byte, 3*4096),
+		"/b/sparse.bin":    make([]byte, 3*4096),
+		"/z/last.bin":      big,
+	}
+	sizes := make(map[bool]uint64)
+	for _, dups := range []bool{false, true} {
+		w, err := NewWriter()
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.BlockSize = 4096
+		w.Flags.Duplicates = dups
+		w.Flags.AlwaysFragments = true
+		for name, data := range files {
+			err = w.AddReaderTo(name, bytes.NewReader(data))
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		//Written to a file, so the leftover data of /z/last.bin has to be truncated.
+		fil, err := os.Create(filepath.Join(t.TempDir(), "dups.sqfs"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer fil.Close()
+		n, err := w.WriteTo(fil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		stat, _ := fil.Stat()
+		if stat.Size() != n {
+			t.Error("File is", stat.Size(), "bytes, but", n, "bytes were written")
+		}
+		rdr, err := NewSquashfsReader(fil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sizes[dups] = rdr.super.BytesUsed
+		for name, want := range files {
+			data, err := rdr.ReadFile(name[1:])
+			if err != nil {
+				t.Fatal(name, err)
+			}
+			if !bytes.Equal(data, want) {
+				t.Error(name, "content doesn't match")
+			}
+		}
+		if !dups {
+			continue
+		}
+		info := func(name string) inode.File {
+			in, err := rdr.GetFileAtPath(name).getInode()
+			if err != nil {
+				t.Fatal(name, err)
+			}
+			return in.Info.(inode.File)
+		}
+		for _, pair := range [][2]string{
+			{"/a/small.txt", "/c/small.txt"},
+			{"/a/big.bin", "/b/big.bin"},
+			{"/a/big.bin", "/z/last.bin"},
+		} {
+			a, b := info(pair[0]), info(pair[1])
+			if a.BlockStart != b.BlockStart || a.FragmentIndex != b.FragmentIndex || a.FragmentOffset != b.FragmentOffset {
+				t.Error(pair[0], "and", pair[1], "don't share their data")
+			}
+		}
+		if a, b := info("/a/big.bin"), info("/a/different.bin"); a.FragmentIndex == b.FragmentIndex && a.FragmentOffset == b.FragmentOffset {
+			t.Error("/a/different.bin shares it's data with /a/big.bin")
+		}
+	}
+	if sizes[true] >= sizes[false] {
+		t.Error("Removing duplicates didn't make the archive smaller.", sizes[true], ">=", sizes[false])
+	}
+}
+
+func TestWriterParallel(t *testing.T) {
+	dir := makeTestDir(t)
+	rnd := rand.New(rand.NewSource(7))
+	files := make([][]byte, 50)
+	for i := range files {
+		files[i] = make([]byte, rnd.Intn(20000))
+		for j := range files[i] {
+			files[i][j] = byte(rnd.Intn(4))
+		}
+	}
+	var firstData []byte
+	for _, settings := range [][2]int{{1, 1}, {8, 3}, {4, 100}, {0, 0}} {
+		w, err := NewWriterWithOptions(ZstdCompression, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.BlockSize = 4096
+		w.CompressionWorkers = settings[0]
+		w.MaxInFlightBlocks = settings[1]
+		fil, err := os.Open(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = w.AddFileTo("/dir", fil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i, data := range files {
+			err = w.AddReaderTo(fmt.Sprintf("/files/%02d", i), bytes.NewReader(data))
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		var buf bytes.Buffer
+		_, err = w.WriteTo(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rdr, err := NewSquashfsReader(bytes.NewReader(buf.Bytes()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkSameTree(t, rdr, dir, "/dir")
+		for i, want := range files {
+			data, err := rdr.ReadFile(fmt.Sprintf("files/%02d", i))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(data, want) {
+				t.Errorf("files/%02d content doesn't match", i)
+			}
+		}
+		//The data blocks and fragments should always be the same, no matter how many workers are used.
+		data := buf.Bytes()[:rdr.super.InodeTableStart]
+		data = data[binary.Size(rdr.super):]
+		if firstData == nil {
+			firstData = data
+		} else if !bytes.Equal(data, firstData) {
+			t.Error("Data is different with", settings[0], "workers and", settings[1], "blocks in flight")
+		}
+	}
+}
+
+func TestWriterCompressorOptions(t *testing.T) {
+	dir := makeTestDir(t)
+	//zlibLevel checks the compression level stored in the zlib header of the archive's first metadata block.
+	zlibLevel := func(level byte) func(rdr *Reader) bool {
+		return func(rdr *Reader) bool {
+			hdr := make([]byte, 4)
+			_, err := rdr.r.ReadAt(hdr, int64(rdr.super.InodeTableStart))
+			//0x78 is deflate with a 15 bit window.
+			return err == nil && hdr[1]&0x80 == 0 && hdr[2] == 0x78 && hdr[3]>>6 == level
+		}
+	}
+	tests := []struct {
+		name    string
+		comp    int
+		set     func(w *Writer) error
+		options bool
+		check   func(rdr *Reader) bool //Checks the options read from the archive, and if possible that the data uses them.
+	}{
+		{"gzip default", GzipCompression, func(w *Writer) error { return nil }, false, zlibLevel(3)},
+		{"gzip", GzipCompression, func(w *Writer) error { return w.SetGzipOptions(6, 15, GzipDefault) }, true, func(rdr *Reader) bool {
+			c := rdr.decompressor.(*compression.Gzip)
+			return c.CompressionLevel == 6 && c.WindowSize == 15 && c.Strategies == GzipDefault && zlibLevel(2)(rdr)
+		}},
+		{"gzip huffman only", GzipCompression, func(w *Writer) error { return w.SetGzipOptions(9, 15, GzipHuffmanOnly) }, true, func(rdr *Reader) bool {
+			c := rdr.decompressor.(*compression.Gzip)
+			return c.CompressionLevel == 9 && c.Strategies == GzipHuffmanOnly && zlibLevel(0)(rdr)
+		}},
+		//mksquashfs defaults to Lzo1x999, so the options are always written.
+		{"lzo default", LzoCompression, func(w *Writer) error { return nil }, true, func(rdr *Reader) bool {
+			c := rdr.decompressor.(*compression.Lzo)
+			return c.Algorithm == Lzo1x1 && c.CompressionLevel == 0
+		}},
+		{"lzo", LzoCompression, func(w *Writer) error { return w.SetLzoOptions(Lzo1x1, 0) }, true, func(rdr *Reader) bool {
+			c := rdr.decompressor.(*compression.Lzo)
+			return c.Algorithm == Lzo1x1 && c.CompressionLevel == 0
+		}},
+		{"xz default", XzCompression, func(w *Writer) error { return w.SetXzOptions(0, 0) }, false, nil},
+		{"xz", XzCompression, func(w *Writer) error { return w.SetXzOptions(8192, XzFilterX86|XzFilterArm) }, true, func(rdr *Reader) bool {
+			c := rdr.decompressor.(*compression.Xz)
+			return c.DictionarySize == 8192 && c.Filters == XzFilterX86|XzFilterArm
+		}},
+		{"lz4", Lz4Compression, func(w *Writer) error { return w.SetLz4Options(true) }, true, func(rdr *Reader) bool {
+			return rdr.decompressor.(*compression.Lz4).HC
+		}},
+		{"zstd", ZstdCompression, func(w *Writer) error { return w.SetZstdOptions(3) }, true, func(rdr *Reader) bool {
+			return rdr.decompressor.(*compression.Zstd).CompressionLevel == 3
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			w, err := NewWriterWithOptions(test.comp, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			w.BlockSize = 16384
+			err = test.set(w)
+			if err != nil {
+				t.Fatal(err)
+			}
+			fil, err := os.Open(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = w.AddFileTo("/dir", fil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			rdr := writeTestArchive(t, w)
+			if rdr.flags.compressorOptions != test.options {
+				t.Error("compressorOptions flag is", rdr.flags.compressorOptions)
+			}
+			if test.check != nil && !test.check(rdr) {
+				t.Errorf("Archive has the options %+v", rdr.decompressor)
+			}
+			checkSameTree(t, rdr, dir, "/dir")
+		})
+	}
+	w, err := NewWriter()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w.SetXzOptions(0, 0) == nil {
+		t.Error("Setting xz options on a gzip Writer should fail")
+	}
+	//compress/zlib can't use a different window size, or the filtered, run length encoded, or fixed strategies.
+	for _, args := range [][3]int{{0, 15, 0}, {9, 16, 0}, {9, 12, 0}, {9, 15, 1 << 8}, {9, 15, GzipFiltered}, {9, 15, GzipDefault | GzipRunLengthEncoded}, {9, 15, GzipFixed}} {
+		if w.SetGzipOptions(args[0], args[1], args[2]) == nil {
+			t.Error("Invalid gzip options", args, "were allowed")
+		}
+	}
+	w, err = NewWriterWithOptions(LzoCompression, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	//The data is always compressed with Lzo1x1.
+	for _, args := range [][2]int{{Lzo1x999, 8}, {Lzo1x1_15, 0}, {Lzo1x1, 1}} {
+		if w.SetLzoOptions(args[0], args[1]) == nil {
+			t.Error("Invalid LZO options", args, "were allowed")
+		}
+	}
+	w, err = NewWriterWithOptions(XzCompression, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, size := range []int{4096, 10000, 8192 * 5} {
+		if w.SetXzOptions(size, 0) == nil {
+			t.Error("Invalid xz dictionary size", size, "was allowed")
+		}
+	}
+	//Archives with options that can't be used when compressing can still be copied, using the closest options that can be.
+	for _, name := range []string{"gzip_options.sqfs", "lzo.sqfs"} {
+		src, err := openTestdata(t, name)
+		if err != nil {
+			t.Fatal(name, err)
+		}
+		w, err = NewWriterFromReader(src)
+		if err != nil {
+			t.Fatal(name, err)
+		}
+		switch c := w.compressor.(type) {
+		case *compression.Gzip:
+			if c.CompressionLevel != 6 || c.WindowSize != 15 {
+				t.Errorf("%s: Writer has the options %+v", name, c)
+			}
+		case *compression.Lzo:
+			if c.Algorithm != Lzo1x1 {
+				t.Errorf("%s: Writer has the options %+v", name, c)
+			}
+		}
+		want := readAllFiles(t, src)
+		got := readAllFiles(t, writeTestArchive(t, w))
+		if fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Errorf("%s: copy doesn't match", name)
+		}
+	}
+}
+
+func TestWriterExportTable(t *testing.T) {
+	w, err := NewWriter()
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Flags.Exportable = true
+	//Enough files that the export table needs more then one metadata block.
+	for i := 0; i < 1500; i++ {
+		err = w.AddReaderTo(fmt.Sprintf("/dir%d/file%d", i%10, i), strings.NewReader(strconv.Itoa(i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	rdr := writeTestArchive(t, w)
+	if !rdr.flags.Exportable {
+		t.Fatal("Archive isn't exportable")
+	}
+	numbers := make(map[uint32]string)
+	err = fs.WalkDir(rdr, ".", func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		in, err := rdr.GetFileAtPath(path).getInode()
+		if err != nil {
+			return err
+		}
+		if _, ok := numbers[in.Number]; ok {
+			return fmt.Errorf("%s and %s have the same inode number", path, numbers[in.Number])
+		}
+		numbers[in.Number] = path
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(numbers) != int(rdr.super.InodeCount) {
+		t.Fatal("Found", len(numbers), "inodes, but the archive has", rdr.super.InodeCount)
+	}
+	for n, path := range numbers {
+		if n < 1 || n > rdr.super.InodeCount {
+			t.Fatal(path, "has inode number", n)
+		}
+		fil, err := rdr.FileByInodeNumber(n)
+		if err != nil {
+			t.Fatal(path, err)
+		}
+		if fil.IsDir() {
+			dirPath, err := rdr.PathByInodeNumber(n)
+			if err != nil {
+				t.Fatal(path, err)
+			}
+			if dirPath = strings.Trim(dirPath, "/"); dirPath != strings.TrimPrefix(path, ".") {
+				t.Error(path, "has path", dirPath)
+			}
+			continue
+		}
+		data, err := io.ReadAll(fil)
+		if err != nil {
+			t.Fatal(path, err)
+		}
+		if "file"+string(data) != pathpkg.Base(path) {
+			t.Error("Inode number", n, "should be", path, "but has the content", string(data))
+		}
+	}
+}
+
+func TestWriterXattrs(t *testing.T) {
+	dir := makeTestDir(t)
+	//If the filesystem doesn't support user xattrs, only the explicitly set xattrs are tested.
+	diskXattrs := lsetxattr(filepath.Join(dir, "a.txt"), "user.disk", []byte("from disk")) == nil
+	if diskXattrs {
+		err := lsetxattr(filepath.Join(dir, "sub"), "user.folder", []byte("folder xattr"))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	w, err := NewWriter()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fil, err := os.Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = w.AddFileTo("/dir", fil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	large := bytes.Repeat([]byte("large value "), 100)
+	shared := map[string][]byte{
+		"user.shared":       []byte("same for all"),
+		"security.selinux":  []byte("system_u:object_r:etc_t:s0"),
+		"trusted.overlay.x": large,
+	}
+	for i := 0; i < 100; i++ {
+		name := fmt.Sprintf("/mem/file%d", i)
+		err = w.AddReaderTo(name, strings.NewReader(name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = w.SetXattrs(name, shared)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	unique := map[string][]byte{
+		"user.other":        []byte("different"),
+		"trusted.overlay.x": large,
+		"user.empty":        {},
+	}
+	err = w.SetXattrs("/dir/link", unique)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w.SetXattrs("/mem/file0", map[string][]byte{"system.posix_acl_access": {}}) == nil {
+		t.Error("Setting an unsupported xattr should fail")
+	}
+	if w.SetXattrs("/doesnotexist", shared) == nil {
+		t.Error("Setting xattrs on a file that doesn't exist should fail")
+	}
+	rdr := writeTestArchive(t, w)
+	checkSameTree(t, rdr, dir, "/dir")
+	check := func(name string, want map[string][]byte) {
+		t.Helper()
+		got, err := rdr.GetFileAtPath(name).Xattrs()
+		if err != nil {
+			t.Fatal(name, err)
+		}
+		if len(got) != len(want) {
+			t.Error(name, "has", len(got), "xattrs, but should have", len(want))
+		}
+		for key, value := range want {
+			if !bytes.Equal(got[key], value) {
+				t.Errorf("%s has %s = %q, wanted %q", name, key, got[key], value)
+			}
+		}
+	}
+	for i := 0; i < 100; i += 9 {
+		check(fmt.Sprintf("/mem/file%d", i), shared)
+	}
+	check("/dir/link", unique)
+	check("/dir/empty.txt", nil)
+	if diskXattrs {
+		check("/dir/a.txt", map[string][]byte{"user.disk": []byte("from disk")})
+		check("/dir/sub", map[string][]byte{"user.folder": []byte("folder xattr")})
+	}
+	//The 100 files with the same xattrs should all share them.
+	if max := uint32(4); rdr.xattrHeader.IDCount > max {
+		t.Error("Xattrs aren't deduplicated. There are", rdr.xattrHeader.IDCount, "xattr ids")
+	}
+	w, err = NewWriter()
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Flags.NoXattr = true
+	err = w.AddReaderTo("/mem/file0", strings.NewReader("no xattrs"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = w.SetXattrs("/mem/file0", shared)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rdr = writeTestArchive(t, w)
+	if rdr.super.XattrTableStart != noXattrTable {
+		t.Error("NoXattr is set, but xattrs were written")
+	}
+	check("/mem/file0", nil)
+}
+
+func TestWriterReproducible(t *testing.T) {
+	epoch := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	files := make([]string, 20)
+	for i := range files {
+		files[i] = fmt.Sprintf("/files/%02d/file", i)
+	}
+	write := func(reverse bool) []byte {
+		w, err := NewWriterWithOptions(ZstdCompression, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.BlockSize = 4096
+		w.CreationTime = epoch
+		w.ClampModTimes = true
+		w.AllRoot = true
+		//A new folder each time, so the mod times are different.
+		fil, err := os.Open(makeTestDir(t))
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = w.AddFileTo("/dir", fil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := range files {
+			name := files[i]
+			if reverse {
+				name = files[len(files)-1-i]
+			}
+			err = w.AddReaderTo(name, strings.NewReader(name))
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		var buf bytes.Buffer
+		_, err = w.WriteTo(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return buf.Bytes()
+	}
+	first := write(false)
+	if !bytes.Equal(first, write(true)) {
+		t.Fatal("Archives with the same content aren't the same")
+	}
+	rdr, err := NewSquashfsReader(bytes.NewReader(first))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !rdr.ModTime().Equal(epoch) {
+		t.Error("Creation time is", rdr.ModTime(), "wanted", epoch)
+	}
+	if len(rdr.idTable) != 1 || rdr.idTable[0] != 0 {
+		t.Error("ID table is", rdr.idTable, "wanted only 0")
+	}
+	err = fs.WalkDir(rdr, ".", func(path string, _ fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		fil := rdr.GetFileAtPath(path)
+		if !fil.ModTime().Equal(epoch) {
+			t.Errorf("%s has mod time %v, wanted %v", path, fil.ModTime(), epoch)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWriterSourceDateEpoch(t *testing.T) {
+	//SOURCE_DATE_EPOCH might already be set, so it's put back afterwards. This means the test can't be run in parallel.
+	if old, ok := os.LookupEnv("SOURCE_DATE_EPOCH"); ok {
+		defer os.Setenv("SOURCE_DATE_EPOCH", old)
+	} else {
+		defer os.Unsetenv("SOURCE_DATE_EPOCH")
+	}
+	os.Setenv("SOURCE_DATE_EPOCH", "1234567890")
+	w, err := NewWriter()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = w.AddReaderTo("/file", strings.NewReader("epoch"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rdr := writeTestArchive(t, w)
+	if rdr.ModTime().Unix() != 1234567890 {
+		t.Error("Creation time is", rdr.ModTime(), "wanted 1234567890")
+	}
+	if rdr.GetFileAtPath("/file").ModTime().Unix() != 1234567890 {
+		t.Error("File without a mod time doesn't use SOURCE_DATE_EPOCH")
+	}
+	os.Setenv("SOURCE_DATE_EPOCH", "not a number")
+	_, err = w.WriteTo(io.Discard)
+	if err == nil {
+		t.Error("Invalid SOURCE_DATE_EPOCH didn't return an error")
+	}
+}
+
+//testOwner is used as fstest.MapFile.Sys to give files an owner.
+type testOwner struct {
+	uid, gid int
+}
+
+func (o testOwner) UID() int { return o.uid }
+func (o testOwner) GID() int { return o.gid }
+
+func TestWriterAddFS(t *testing.T) {
+	modTime := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+	mapFS := fstest.MapFS{
+		"hello.txt":       {Data: []byte("hello"), Mode: 0600, ModTime: modTime, Sys: testOwner{1000, 100}},
+		"sub":             {Mode: fs.ModeDir | 0750, ModTime: modTime, Sys: testOwner{1000, 1000}},
+		"sub/data.bin":    {Data: bytes.Repeat([]byte("data"), 3000), Mode: 0644, ModTime: modTime},
+		"sub/link":        {Data: []byte("data.bin"), Mode: fs.ModeSymlink | 0777, ModTime: modTime},
+		"sub/empty/x.txt": {Data: []byte{}, Mode: 0444, ModTime: modTime},
+	}
+	w, err := NewWriterWithOptions(GzipCompression, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.BlockSize = 4096
+	err = w.AddFS("/map", mapFS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := makeTestDir(t)
+	err = w.AddFS("disk", os.DirFS(dir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w.AddFS("/map", mapFS) == nil {
+		t.Error("Adding the same files twice didn't return an error")
+	}
+	rdr := writeTestArchive(t, w)
+	checkSameTree(t, rdr, dir, "/disk")
+	checkMapFS := func(rdr *Reader, prefix string) {
+		err := fs.WalkDir(mapFS, ".", func(name string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			want := mapFS[name]
+			if want == nil {
+				//Folders that are only implied by the MapFS.
+				return nil
+			}
+			fil := rdr.GetFileAtPath(pathpkg.Join(prefix, name))
+			if fil == nil {
+				t.Errorf("%s not found in archive", name)
+				return nil
+			}
+			if fil.Mode() != want.Mode {
+				t.Errorf("%s has mode %v, wanted %v", name, fil.Mode(), want.Mode)
+			}
+			if !fil.ModTime().Equal(want.ModTime) {
+				t.Errorf("%s has mod time %v, wanted %v", name, fil.ModTime(), want.ModTime)
+			}
+			owner, _ := want.Sys.(testOwner)
+			if fil.UID() != owner.uid || fil.GID() != owner.gid {
+				t.Errorf("%s is owned by %d:%d, wanted %d:%d", name, fil.UID(), fil.GID(), owner.uid, owner.gid)
+			}
+			switch {
+			case fil.IsSymlink():
+				if fil.SymlinkPath() != string(want.Data) {
+					t.Errorf("%s points to %s, wanted %s", name, fil.SymlinkPath(), want.Data)
+				}
+			case fil.IsFile():
+				data, err := io.ReadAll(fil)
+				if err != nil {
+					t.Errorf("reading %s: %v", name, err)
+				} else if !bytes.Equal(data, want.Data) {
+					t.Errorf("%s content doesn't match", name)
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	checkMapFS(rdr, "/map")
+	target, err := rdr.ReadLink("map/sub/link")
+	if err != nil || target != "data.bin" {
+		t.Errorf("ReadLink returned %q, %v, wanted data.bin", target, err)
+	}
+	info, err := rdr.Lstat("map/sub/link")
+	if err != nil || info.Mode()&fs.ModeSymlink == 0 {
+		t.Errorf("Lstat didn't return the symlink: %v", err)
+	}
+	//Another archive made from the first one should be the same.
+	w, err = NewWriterWithOptions(ZstdCompression, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = w.AddFS("/", rdr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	copied := writeTestArchive(t, w)
+	checkSameTree(t, copied, dir, "/disk")
+	checkMapFS(copied, "/map")
+	//Files that share an inode in a Reader are added as hard links.
+	ref, err := openTestdata(t, "reference.sqfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w, err = NewWriter()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = w.AddFS("/", ref)
+	if err != nil {
+		t.Fatal(err)
+	}
+	linked := writeTestArchive(t, w)
+	for _, names := range [][2]string{{"target.txt", "dir/hardlink.txt"}, {"socket", "socket2"}} {
+		a, err := linked.GetFileAtPath(names[0]).getInode()
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := linked.GetFileAtPath(names[1]).getInode()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if a.Number != b.Number || hardLinks(a) != 2 {
+			t.Errorf("%s and %s don't share an inode", names[0], names[1])
+		}
+	}
+	//When added at "/", the root of fsys is the archive's root folder.
+	w, err = NewWriterWithOptions(GzipCompression, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = w.AddFS("/", fstest.MapFS{
+		".":         {Mode: fs.ModeDir | 0700, ModTime: modTime, Sys: testOwner{1000, 100}},
+		"hello.txt": mapFS["hello.txt"],
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	root, err := writeTestArchive(t, w).GetRootFolder()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if root.Mode() != fs.ModeDir|0700 || !root.ModTime().Equal(modTime) || root.UID() != 1000 || root.GID() != 100 {
+		t.Errorf("Root folder has mode %v, mod time %v, and owner %d:%d", root.Mode(), root.ModTime(), root.UID(), root.GID())
+	}
+}
+
+//testTarEntry is an entry of the tar archive made by makeTestTar.
+type testTarEntry struct {
+	hdr  tar.Header
+	data []byte
+}
+
+//testTarModTime is the modification time of everything in the tar archive made by makeTestTar.
+var testTarModTime = time.Date(2019, 3, 4, 5, 6, 7, 0, time.UTC)
+
+//makeTestTar creates a tar archive with a bit of everything that can be converted to squashfs.
+func makeTestTar(t *testing.T) ([]byte, []testTarEntry) {
+	big := make([]byte, 10000)
+	rand.New(rand.NewSource(3)).Read(big)
+	entries := []testTarEntry{
+		{hdr: tar.Header{Typeflag: tar.TypeDir, Name: "./", Mode: 0755}},
+		{hdr: tar.Header{Typeflag: tar.TypeDir, Name: "./etc/", Mode: 0750, Uid: 10, Gid: 20}},
+		{hdr: tar.Header{Typeflag: tar.TypeReg, Name: "./etc/hosts", Mode: 0644, Uid: 10, Gid: 20}, data: []byte("127.0.0.1 localhost\n")},
+		{hdr: tar.Header{Typeflag: tar.TypeReg, Name: "./big.bin", Mode: 04755}, data: big},
+		{hdr: tar.Header{Typeflag: tar.TypeReg, Name: "implicit/file.txt", Mode: 0600}, data: []byte("implicit")},
+		{hdr: tar.Header{Typeflag: tar.TypeSymlink, Name: "./etc/link", Linkname: "hosts", Mode: 0777}},
+		{hdr: tar.Header{Typeflag: tar.TypeLink, Name: "./etc/hosts2", Linkname: "./etc/hosts"}},
+		{hdr: tar.Header{Typeflag: tar.TypeLink, Name: "./hosts3", Linkname: "etc/hosts2"}},
+		{hdr: tar.Header{Typeflag: tar.TypeChar, Name: "./dev/null", Mode: 0666, Devmajor: 1, Devminor: 3}},
+		{hdr: tar.Header{Typeflag: tar.TypeBlock, Name: "./dev/sda1", Mode: 0660, Devmajor: 8, Devminor: 300}},
+		{hdr: tar.Header{Typeflag: tar.TypeFifo, Name: "./dev/fifo", Mode: 0600}},
+		{hdr: tar.Header{Typeflag: tar.TypeReg, Name: "./xattr.txt", Mode: 0644, PAXRecords: map[string]string{
+			"SCHILY.xattr.user.test":         "value",
+			"SCHILY.xattr.security.selinux":  "system_u:object_r:etc_t:s0",
+			"SCHILY.xattr.system.posix_acl_": "unsupported",
+		}}, data: []byte("xattrs")},
+		//Later folders replace the metadata of earlier ones.
+		{hdr: tar.Header{Typeflag: tar.TypeDir, Name: "./etc", Mode: 0700, Uid: 10, Gid: 20}},
+	}
+	var tarball bytes.Buffer
+	tw := tar.NewWriter(&tarball)
+	for i := range entries {
+		entries[i].hdr.ModTime = testTarModTime
+		entries[i].hdr.Size = int64(len(entries[i].data))
+		err := tw.WriteHeader(&entries[i].hdr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = tw.Write(entries[i].data)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := tw.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tarball.Bytes(), entries
+}
+
+func TestWriterConvertTar(t *testing.T) {
+	tarball, entries := makeTestTar(t)
+	big := entries[3].data
+	modTime := testTarModTime
+	w, err := NewWriterWithOptions(ZstdCompression, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.BlockSize = 4096
+	err = w.AddReaderTo("/extra.txt", strings.NewReader("from the writer"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	_, err = w.ConvertTar(&buf, bytes.NewReader(tarball))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w.Contains("/etc/hosts") {
+		t.Error("Files from the tar archive were added to the Writer")
+	}
+	rdr, err := NewSquashfsReader(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	root, err := rdr.GetRootFolder()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if root.Mode() != fs.ModeDir|0755 || !root.ModTime().Equal(testTarModTime) {
+		t.Errorf("Root folder has mode %v and mod time %v", root.Mode(), root.ModTime())
+	}
+	for name, want := range map[string][]byte{
+		"etc/hosts":         entries[2].data,
+		"etc/hosts2":        entries[2].data,
+		"hosts3":            entries[2].data,
+		"big.bin":           big,
+		"implicit/file.txt": entries[4].data,
+		"xattr.txt":         entries[11].data,
+		"extra.txt":         []byte("from the writer"),
+	} {
+		data, err := rdr.ReadFile(name)
+		if err != nil {
+			t.Errorf("reading %s: %v", name, err)
+		} else if !bytes.Equal(data, want) {
+			t.Errorf("%s content doesn't match", name)
+		}
+	}
+	getInode := func(name string) *inode.Inode {
+		fil := rdr.GetFileAtPath(name)
+		if fil == nil {
+			t.Fatalf("%s not found in archive", name)
+		}
+		in, err := fil.getInode()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return in
+	}
+	hosts := getInode("/etc/hosts")
+	if hosts.Type != inode.ExtFileType || hosts.Info.(inode.ExtFile).HardLinks != 3 {
+		t.Errorf("/etc/hosts should be an extended file with 3 hard links. Type %d, info %+v", hosts.Type, hosts.Info)
+	}
+	for _, name := range []string{"/etc/hosts2", "/hosts3"} {
+		if getInode(name).Header.Number != hosts.Header.Number {
+			t.Errorf("%s doesn't have the same inode as /etc/hosts", name)
+		}
+	}
+	etc := rdr.GetFileAtPath("/etc")
+	if etc.Mode() != fs.ModeDir|0700 || etc.UID() != 10 || etc.GID() != 20 || !etc.ModTime().Equal(modTime) {
+		t.Errorf("/etc has mode %v, owner %d:%d, and mod time %v", etc.Mode(), etc.UID(), etc.GID(), etc.ModTime())
+	}
+	if getInode("/big.bin").Header.Permissions != 04755 {
+		t.Errorf("/big.bin has permissions %o, wanted 4755", getInode("/big.bin").Header.Permissions)
+	}
+	if target := rdr.GetFileAtPath("/etc/link").SymlinkPath(); target != "hosts" {
+		t.Errorf("/etc/link points to %s, wanted hosts", target)
+	}
+	null := getInode("/dev/null")
+	if null.Type != inode.CharDevType || null.Info.(inode.Device).Device != 0x103 {
+		t.Errorf("/dev/null should be a character device with the device number 0x103. Type %d, info %+v", null.Type, null.Info)
+	}
+	sda := getInode("/dev/sda1")
+	//minor 300 is 0x12C, so 0x2C is in the first byte and 0x100 is shifted by 12.
+	if sda.Type != inode.BlockDevType || sda.Info.(inode.Device).Device != 0x10082C {
+		t.Errorf("/dev/sda1 should be a block device with the device number 0x10082C. Type %d, info %+v", sda.Type, sda.Info)
+	}
+	if getInode("/dev/fifo").Type != inode.FifoType {
+		t.Error("/dev/fifo isn't a FIFO")
+	}
+	xattrs, err := rdr.GetFileAtPath("/xattr.txt").Xattrs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(xattrs) != 2 || string(xattrs["user.test"]) != "value" || string(xattrs["security.selinux"]) != "system_u:object_r:etc_t:s0" {
+		t.Errorf("/xattr.txt has xattrs %v", xattrs)
+	}
+	var badTar bytes.Buffer
+	tw := tar.NewWriter(&badTar)
+	tw.WriteHeader(&tar.Header{Typeflag: tar.TypeLink, Name: "link", Linkname: "missing"})
+	tw.Close()
+	_, err = w.ConvertTar(io.Discard, &badTar)
+	if err == nil {
+		t.Error("Hard link to a missing file didn't return an error")
+	}
+
+	//Converting doesn't change the Writer's settings, root folder, or compressor.
+	w, err = NewWriterWithOptions(XzCompression, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.BlockSize = 5000
+	dictSize := w.compressor.(*compression.Xz).DictionarySize
+	_, err = w.ConvertTar(io.Discard, bytes.NewReader(tarball))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w.BlockSize != 5000 || w.root != nil || w.compressor.(*compression.Xz).DictionarySize != dictSize {
+		t.Errorf("ConvertTar changed the Writer. BlockSize %d, root %v, dictionary size %d", w.BlockSize, w.root, w.compressor.(*compression.Xz).DictionarySize)
+	}
+}
+
+//countingDecompressor counts how many blocks are decompressed.
+type countingDecompressor struct {
+	compression.Decompressor
+	count int32
+}
+
+func (c *countingDecompressor) Decompress(r io.Reader) ([]byte, error) {
+	atomic.AddInt32(&c.count, 1)
+	return c.Decompressor.Decompress(r)
+}
+
+func TestWriterAddArchive(t *testing.T) {
+	tarball, _ := makeTestTar(t)
+	text := strings.Repeat("squashfs ", 2000)
+	w, err := NewWriter()
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.BlockSize = 4096
+	err = w.AddReaderTo("/text.txt", strings.NewReader(text))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = w.AddReaderTo("/text2.txt", strings.NewReader(text))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	_, err = w.ConvertTar(&buf, bytes.NewReader(tarball))
+	if err != nil {
+		t.Fatal(err)
+	}
+	src, err := NewSquashfsReader(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var want bytes.Buffer
+	err = src.WriteTar(&want, DefaultTarOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	//checkCopy checks that everything, including the root folder, was kept.
+	checkCopy := func(name string, copied *Reader) {
+		var got bytes.Buffer
+		err := copied.WriteTar(&got, DefaultTarOptions())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got.Bytes(), want.Bytes()) {
+			t.Errorf("%s: archive doesn't match the original", name)
+		}
+		root, err := copied.GetRootFolder()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if root.Mode() != fs.ModeDir|0755 || !root.ModTime().Equal(testTarModTime) {
+			t.Errorf("%s: root has mode %v and mod time %v", name, root.Mode(), root.ModTime())
+		}
+	}
+
+	//With nothing changed, the data is copied without being decompressed.
+	same, err := NewWriterFromReader(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	counter := &countingDecompressor{Decompressor: src.decompressor}
+	src.decompressor = counter
+	var out bytes.Buffer
+	_, err = same.WriteTo(&out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	//Only the fragment table is decompressed.
+	if counter.count > 1 {
+		t.Errorf("%d blocks were decompressed while copying the archive", counter.count)
+	}
+	copied, err := NewSquashfsReader(bytes.NewReader(out.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkCopy("copy", copied)
+	if copied.super.CompressionType != GzipCompression || copied.super.BlockSize != 4096 || !copied.ModTime().Equal(src.ModTime()) {
+		t.Errorf("Copy has compression %d, block size %d, and creation time %v", copied.super.CompressionType, copied.super.BlockSize, copied.ModTime())
+	}
+	getInode := func(rdr *Reader, name string) *inode.Inode {
+		in, err := rdr.GetFileAtPath(name).getInode()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return in
+	}
+	if getInode(copied, "/text.txt").Info.(inode.File).BlockStart != getInode(copied, "/text2.txt").Info.(inode.File).BlockStart {
+		t.Error("Duplicate files don't share their data blocks")
+	}
+	//New files can use the data of copied files.
+	dup, err := NewWriterFromReader(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = dup.AddReaderTo("/text3.txt", strings.NewReader(text))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dupRdr := writeTestArchive(t, dup)
+	if a, b := getInode(dupRdr, "/text.txt").Info.(inode.File), getInode(dupRdr, "/text3.txt").Info.(inode.File); a.BlockStart != b.BlockStart ||
+		a.FragmentIndex != b.FragmentIndex || a.FragmentOffset != b.FragmentOffset {
+		t.Errorf("A new file doesn't use the data of a copied duplicate. %+v and %+v", a, b)
+	}
+	data, err := dupRdr.ReadFile("text3.txt")
+	if err != nil || string(data) != text {
+		t.Errorf("text3.txt doesn't match: %v", err)
+	}
+
+	//Changing the compression or block size recompresses the data.
+	recomp, err := NewWriterWithOptions(ZstdCompression, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recomp.BlockSize = 8192
+	err = recomp.AddArchive("/", src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	counter.count = 0
+	out.Reset()
+	_, err = recomp.WriteTo(&out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if counter.count == 0 {
+		t.Error("Data wasn't decompressed while recompressing the archive")
+	}
+	recompressed, err := NewSquashfsReader(bytes.NewReader(out.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkCopy("recompressed", recompressed)
+	if recompressed.super.CompressionType != ZstdCompression || recompressed.super.BlockSize != 8192 {
+		t.Errorf("Recompressed archive has compression %d and block size %d", recompressed.super.CompressionType, recompressed.super.BlockSize)
+	}
+
+	//Archives can also be added inside of a folder.
+	w, err = NewWriterWithOptions(ZstdCompression, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = w.AddArchive("/sub", src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = w.AddArchive("/sub", src)
+	if err == nil {
+		t.Error("Adding the same archive twice didn't return an error")
+	}
+	sub := writeTestArchive(t, w)
+	data, err = sub.ReadFile("sub/text.txt")
+	if err != nil || string(data) != text {
+		t.Errorf("sub/text.txt doesn't match: %v", err)
+	}
+	if getInode(sub, "/sub/etc/hosts").Header.Number != getInode(sub, "/sub/hosts3").Header.Number {
+		t.Error("Hard links inside of a folder don't share an inode")
+	}
+}
+
+func TestWriterAppend(t *testing.T) {
+	tarball, entries := makeTestTar(t)
+	text := strings.Repeat("squashfs ", 2000)
+	name := filepath.Join(t.TempDir(), "append.sqfs")
+	fil, err := os.Create(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w, err := NewWriter()
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.BlockSize = 4096
+	err = w.AddReaderTo("/text.txt", strings.NewReader(text))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = w.AddReaderTo("/replace.txt", strings.NewReader(text))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = w.ConvertTar(fil, bytes.NewReader(tarball))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fil.Close()
+	original, err := os.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fil, err = os.OpenFile(name, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fil.Close()
+	w, err = NewAppendWriter(fil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for path, data := range map[string]string{
+		"/new/file.txt": "new file",
+		"/replace.txt":  "replaced",
+		"/etc/hosts":    "replaced hosts",
+		"/implicit":     "replaced folder",
+		"/copy.txt":     text,
+	} {
+		err = w.AddReaderTo(path, strings.NewReader(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = w.AddReaderTo("/new/file.txt", strings.NewReader("again"))
+	if err == nil {
+		t.Error("Adding a new file twice didn't return an error")
+	}
+	err = w.Append()
+	if err != nil {
+		t.Fatal(err)
+	}
+	appended, err := os.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	//Everything but the superblock is the same up until the end of the original archive, so if the new superblock isn't written
+	//the original archive is still there.
+	if !bytes.Equal(appended[96:len(original)], original[96:]) {
+		t.Error("The archive's existing data was changed")
+	}
+	torn := append([]byte{}, appended...)
+	copy(torn, original[:96])
+	tornRdr, err := NewSquashfsReader(bytes.NewReader(torn))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, err := tornRdr.ReadFile("replace.txt"); err != nil || string(data) != text {
+		t.Errorf("The original archive has replace.txt %q: %v", data, err)
+	}
+	if tornRdr.GetFileAtPath("/new/file.txt") != nil {
+		t.Error("The original archive has a new file")
+	}
+	rdr, err := NewSquashfsReader(bytes.NewReader(appended))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]string{
+		"text.txt":     text,
+		"big.bin":      string(entries[3].data),
+		"xattr.txt":    string(entries[11].data),
+		"new/file.txt": "new file",
+		"replace.txt":  "replaced",
+		"etc/hosts":    "replaced hosts",
+		"etc/hosts2":   string(entries[2].data),
+		"hosts3":       string(entries[2].data),
+		"implicit":     "replaced folder",
+		"etc/link":     "replaced hosts",
+		"copy.txt":     text,
+	} {
+		data, err := rdr.ReadFile(name)
+		if err != nil {
+			t.Errorf("reading %s: %v", name, err)
+		} else if string(data) != want {
+			t.Errorf("%s content doesn't match", name)
+		}
+	}
+	if rdr.GetFileAtPath("/implicit/file.txt") != nil {
+		t.Error("The contents of a replaced folder weren't removed")
+	}
+	//A new file with the same content as a file that was kept in place uses it's data.
+	textIn, err := rdr.GetFileAtPath("/text.txt").getInode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	copyIn, err := rdr.GetFileAtPath("/copy.txt").getInode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if textIn.Info.(inode.File).BlockStart != copyIn.Info.(inode.File).BlockStart {
+		t.Error("A new file doesn't use the data of a duplicate already in the archive")
+	}
+	hosts2, err := rdr.GetFileAtPath("/etc/hosts2").getInode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	hosts3, err := rdr.GetFileAtPath("/hosts3").getInode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hosts2.Header.Number != hosts3.Header.Number || hosts2.Info.(inode.ExtFile).HardLinks != 2 {
+		t.Errorf("/etc/hosts2 and /hosts3 should share an inode with 2 hard links. Info %+v", hosts2.Info)
+	}
+	xattrs, err := rdr.GetFileAtPath("/xattr.txt").Xattrs()
+	if err != nil || string(xattrs["user.test"]) != "value" {
+		t.Errorf("/xattr.txt has xattrs %v: %v", xattrs, err)
+	}
+	if dev := rdr.GetFileAtPath("/dev/null"); dev == nil || dev.UID() != 0 {
+		t.Error("/dev/null wasn't kept")
+	}
+	etc := rdr.GetFileAtPath("/etc")
+	if etc.Mode() != fs.ModeDir|0700 || etc.UID() != 10 || etc.GID() != 20 {
+		t.Errorf("/etc has mode %v and owner %d:%d", etc.Mode(), etc.UID(), etc.GID())
+	}
+
+	w, err = NewAppendWriter(fil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.BlockSize = 8192
+	err = w.Append()
+	if err == nil {
+		t.Error("Changing the block size when appending didn't return an error")
+	}
+
+	//A failed Append leaves the archive as it was, even if new data was already written.
+	before, err := os.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w, err = NewAppendWriter(fil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = w.AddReaderTo("/a.txt", strings.NewReader(strings.Repeat("appended ", 2000)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = w.AddReaderTo("/z.txt", iotest.ErrReader(errors.New("read error")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = w.Append()
+	if err == nil {
+		t.Fatal("Append with a file that can't be read didn't return an error")
+	}
+	after, err := os.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(before, after) {
+		t.Error("A failed Append changed the archive")
+	}
+
+	//AddFS and AddArchive replace files the same as AddReaderTo, and a folder that can't be added with AddFileTo doesn't replace anything.
+	w, err = NewAppendWriter(fil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	err = os.WriteFile(filepath.Join(dir, "hosts"), []byte("dir hosts"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Symlink("missing", filepath.Join(dir, "broken"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dirFil, err := os.Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dirFil.Close()
+	err = w.AddFileTo("/etc", dirFil)
+	if err == nil {
+		t.Error("Adding a folder with a broken symlink didn't return an error")
+	}
+	if etc := w.holderAt("/etc"); etc == nil || !w.base.holders[etc] || !w.base.holders[w.holderAt("/etc/hosts")] {
+		t.Error("A folder that couldn't be added replaced /etc")
+	}
+	other, err := NewWriter()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = other.AddReaderTo("/implicit", strings.NewReader("from another archive"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var otherArchive bytes.Buffer
+	_, err = other.WriteTo(&otherArchive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherRdr, err := NewSquashfsReader(bytes.NewReader(otherArchive.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = w.AddArchive("/", otherRdr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = w.AddFS("/", fstest.MapFS{
+		"replace.txt": {Data: []byte("from fs")},
+		"etc":         {Mode: fs.ModeDir | 0755},
+		"etc/hosts":   {Data: []byte("fs hosts")},
+		"new":         {Data: []byte("file replacing a folder")},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = w.AddFS("/", fstest.MapFS{"new": {Data: []byte("again")}})
+	if err == nil {
+		t.Error("AddFS replaced a file that was added after NewAppendWriter")
+	}
+	var empty bytes.Buffer
+	tar.NewWriter(&empty).Close()
+	_, err = w.ConvertTar(io.Discard, &empty)
+	if err == nil {
+		t.Error("ConvertTar with an append Writer didn't return an error")
+	}
+	err = w.Append()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rdr, err = NewSquashfsReader(fil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]string{
+		"replace.txt": "from fs",
+		"etc/hosts":   "fs hosts",
+		"etc/hosts2":  string(entries[2].data),
+		"new":         "file replacing a folder",
+		"text.txt":    text,
+		"implicit":    "from another archive",
+	} {
+		data, err := rdr.ReadFile(name)
+		if err != nil {
+			t.Errorf("reading %s: %v", name, err)
+		} else if string(data) != want {
+			t.Errorf("%s content doesn't match", name)
+		}
+	}
+	if etc := rdr.GetFileAtPath("/etc"); etc.Mode() != fs.ModeDir|0755 {
+		t.Errorf("/etc has mode %v after being replaced by AddFS", etc.Mode())
+	}
+}
+
+func TestWriterHardLinks(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "links")
+	err := os.MkdirAll(filepath.Join(dir, "sub"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(filepath.Join(dir, "a"), []byte("hard link\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(filepath.Join(dir, "single"), []byte("single\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"b", "sub/c"} {
+		err = os.Link(filepath.Join(dir, "a"), filepath.Join(dir, name))
+		if err != nil {
+			t.Skip("Can't make hard links:", err)
+		}
+	}
+	w, err := NewWriter()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fil, err := os.Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = w.AddFileTo("/file", fil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = w.AddFS("/fs", os.DirFS(dir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rdr := writeTestArchive(t, w)
+	for _, prefix := range []string{"/file", "/fs"} {
+		checkSameTree(t, rdr, dir, prefix)
+		var number uint32
+		for _, name := range []string{"/a", "/b", "/sub/c"} {
+			in, err := rdr.GetFileAtPath(prefix + name).getInode()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if number == 0 {
+				number = in.Header.Number
+			}
+			if in.Header.Number != number || hardLinks(in) != 3 {
+				t.Errorf("%s has inode %d with %d hard links. Should be %d with 3", prefix+name, in.Header.Number, hardLinks(in), number)
+			}
+		}
+		in, err := rdr.GetFileAtPath(prefix + "/single").getInode()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if in.Header.Number == number {
+			t.Errorf("%s/single shares an inode with %s/a", prefix, prefix)
+		}
+	}
+
+	out := t.TempDir()
+	errs := rdr.ExtractTo(out)
+	if len(errs) > 0 {
+		t.Fatal(errs)
+	}
+	for _, prefix := range []string{"file", "fs"} {
+		a, err := os.Stat(filepath.Join(out, prefix, "a"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, name := range []string{"b", "sub/c"} {
+			linked, err := os.Stat(filepath.Join(out, prefix, name))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !os.SameFile(a, linked) {
+				t.Errorf("%s/%s wasn't extracted as a hard link to %s/a", prefix, name, prefix)
+			}
+		}
+		single, err := os.Stat(filepath.Join(out, prefix, "single"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if os.SameFile(a, single) {
+			t.Errorf("%s/single was extracted as a hard link", prefix)
+		}
+	}
+}
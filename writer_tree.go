@@ -0,0 +1,188 @@
+package squashfs
+
+import (
+	"errors"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/CalebQ42/squashfs/internal/inode"
+)
+
+//writeEntry is a file or folder as it's being written to the archive.
+type writeEntry struct {
+	holder     *fileHolder
+	parent     *writeEntry
+	children   []*writeEntry //Sorted by name. Only used by folders.
+	blockSizes []uint32
+	blockStart uint64 //Where the entry's data blocks start.
+	size       uint64 //The size of a file's data.
+	sparse     uint64 //How many bytes are saved by sparse blocks.
+	inodeRef   uint64
+	number     uint32
+	fragIndex  uint32
+	fragOffset uint32
+	xattrIndex uint32      //noXattr if the entry doesn't have xattrs.
+	link       *writeEntry //If set, the entry is a hard link to link and uses it's inode.
+	hardLinks  uint32      //How many entries use the inode. Not used by folders.
+	inodeDone  bool        //If the inode has been written. Hard links can cause the inode to be written before the entry is reached.
+}
+
+//buildTree creates the tree of everything that will be written from w.structure.
+//Folders that are needed, but weren't added (including the root folder), are created with 0755 permissions.
+//If a holder's data has already been written, it's entry from written is used.
+func (w *Writer) buildTree(written map[*fileHolder]*writeEntry) (*writeEntry, error) {
+	root := &writeEntry{holder: w.root}
+	if root.holder == nil {
+		root.holder = &fileHolder{
+			path:   "/",
+			folder: true,
+			perm:   0755,
+		}
+	}
+	dirs := map[string]*writeEntry{"/": root}
+	var getDir func(string) *writeEntry
+	getDir = func(dirPath string) *writeEntry {
+		if dir, ok := dirs[dirPath]; ok {
+			return dir
+		}
+		parentPath, name := path.Split(strings.TrimSuffix(dirPath, "/"))
+		parent := getDir(parentPath)
+		dir := &writeEntry{
+			holder: &fileHolder{
+				path:   parentPath,
+				name:   name,
+				folder: true,
+				perm:   0755,
+			},
+			parent: parent,
+		}
+		parent.children = append(parent.children, dir)
+		dirs[dirPath] = dir
+		return dir
+	}
+	//Sorted so parent folders are always added before their children.
+	dirPaths := make([]string, 0, len(w.structure))
+	for dirPath := range w.structure {
+		dirPaths = append(dirPaths, dirPath)
+	}
+	sort.Strings(dirPaths)
+	entries := make(map[*fileHolder]*writeEntry)
+	for _, dirPath := range dirPaths {
+		parent := getDir(dirPath)
+		for _, holder := range w.structure[dirPath] {
+			ent := written[holder]
+			if ent == nil {
+				ent = &writeEntry{holder: holder}
+			}
+			ent.parent = parent
+			ent.hardLinks = 1
+			entries[holder] = ent
+			parent.children = append(parent.children, ent)
+			if holder.folder {
+				if _, ok := dirs[dirPath+holder.name+"/"]; ok {
+					return nil, errors.New("Multiple files at " + dirPath + holder.name)
+				}
+				dirs[dirPath+holder.name+"/"] = ent
+			}
+		}
+	}
+	for dirPath, dir := range dirs {
+		sort.Slice(dir.children, func(i, j int) bool {
+			return dir.children[i].holder.name < dir.children[j].holder.name
+		})
+		for i, child := range dir.children {
+			if child.holder.name == "" {
+				return nil, errors.New("File with an empty name in " + dirPath)
+			}
+			if i > 0 && dir.children[i-1].holder.name == child.holder.name {
+				return nil, errors.New("Multiple files at " + dirPath + child.holder.name)
+			}
+		}
+	}
+	//Hard links point to the holder they're linked to, so the entry of that holder is found.
+	for holder, ent := range entries {
+		if holder.link == nil {
+			continue
+		}
+		target := holder.link
+		for target.link != nil {
+			target = target.link
+		}
+		ent.link = entries[target]
+		if ent.link == nil {
+			return nil, errors.New("Hard link to a file that isn't in the archive at " + holder.path + holder.name)
+		}
+		if target.folder {
+			return nil, errors.New("Hard link to a folder at " + holder.path + holder.name)
+		}
+		ent.link.hardLinks++
+	}
+	return root, nil
+}
+
+//walk calls fn for every entry in the tree, with parents before their children.
+func (e *writeEntry) walk(fn func(*writeEntry) error) error {
+	err := fn(e)
+	if err != nil {
+		return err
+	}
+	for _, child := range e.children {
+		err = child.walk(fn)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//numberInodes gives each entry an inode number, starting at next. Children are numbered before their parent, in the
+//same order as the inodes are written, so the root is numbered last.
+//Hard links aren't numbered, since they use the number of the entry they're linked to.
+func (e *writeEntry) numberInodes(next uint32) uint32 {
+	for _, child := range e.children {
+		next = child.numberInodes(next)
+	}
+	if e.link != nil {
+		return next
+	}
+	e.number = next
+	return next + 1
+}
+
+//basicType returns the basic inode type of the entry. This is the type used in directory entries.
+func (e *writeEntry) basicType() int {
+	if e.link != nil {
+		return e.link.basicType()
+	}
+	switch {
+	case e.holder.folder:
+		return inode.DirType
+	case e.holder.symlink:
+		return inode.SymType
+	case e.holder.special&os.ModeCharDevice == os.ModeCharDevice:
+		return inode.CharDevType
+	case e.holder.special&os.ModeDevice == os.ModeDevice:
+		return inode.BlockDevType
+	case e.holder.special&os.ModeNamedPipe == os.ModeNamedPipe:
+		return inode.FifoType
+	case e.holder.special&os.ModeSocket == os.ModeSocket:
+		return inode.SocketType
+	default:
+		return inode.FileType
+	}
+}
+
+//hasData returns if the entry is a file whose data needs to be written. Hard links use the data of the entry they're linked to.
+func (e *writeEntry) hasData() bool {
+	return e.link == nil && e.basicType() == inode.FileType
+}
+
+//parentNumber returns the inode number of the entry's parent. The root's parent number is one more then the amount of inodes.
+func (e *writeEntry) parentNumber(inodeCount uint32) uint32 {
+	if e.parent == nil {
+		return inodeCount + 1
+	}
+	return e.parent.number
+}
@@ -1,28 +1,812 @@
 package squashfs
 
 import (
+	"encoding/binary"
 	"errors"
+	"hash/crc32"
 	"io"
 	"math"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/CalebQ42/squashfs/internal/compression"
+	"github.com/CalebQ42/squashfs/internal/directory"
+	"github.com/CalebQ42/squashfs/internal/inode"
 )
 
+//archiveFile is what an archive is written to. It needs to be readable so duplicate files can be compared to what's already written.
+type archiveFile interface {
+	io.WriteSeeker
+	io.ReaderAt
+}
+
+//archiveWriter keeps track of how much has been written to the archive.
+type archiveWriter struct {
+	f      archiveFile
+	start  int64 //Where the archive starts in f.
+	offset uint64
+	end    uint64 //The furthest that's been written. Can be past offset if a duplicate file's data was discarded.
+}
+
+func (a *archiveWriter) Write(p []byte) (int, error) {
+	n, err := a.f.Write(p)
+	a.offset += uint64(n)
+	if a.offset > a.end {
+		a.end = a.offset
+	}
+	return n, err
+}
+
+//ReadAt reads data that's already been written. off is relative to the start of the archive.
+func (a *archiveWriter) ReadAt(p []byte, off int64) (int, error) {
+	return a.f.ReadAt(p, a.start+off)
+}
+
+//rewind goes back to offset, so everything after it is overwritten.
+func (a *archiveWriter) rewind(offset uint64) error {
+	_, err := a.f.Seek(a.start+int64(offset), io.SeekStart)
+	if err != nil {
+		return err
+	}
+	a.offset = offset
+	return nil
+}
+
+//archive is an archive whose data is being written.
+type archive struct {
+	w       *Writer
+	out     *archiveWriter
+	pipe    *blockPipeline
+	frags   *fragmentWriter
+	dups    *duplicateFinder
+	written map[*fileHolder]*writeEntry //Files whose data was written before the tree was built.
+	sources map[*Reader]*rawSource      //Archives that files are copied from.
+	options []byte                      //The compressor options written to the archive.
+}
+
+//writeData writes the holder's data now, instead of after the tree is built. Used when the data can only be read once it's added,
+//such as when converting a tar archive.
+func (a *archive) writeData(holder *fileHolder) error {
+	ent := &writeEntry{holder: holder}
+	a.written[holder] = ent
+	return a.w.writeFileData(a.pipe, a.frags, a.dups, ent)
+}
+
+//setXzDictionary sets the xz dictionary size, if xz compression is used, once the block size is known.
+func (w *Writer) setXzDictionary() {
+	if xz, ok := w.compressor.(*compression.Xz); ok {
+		//A dictionary larger then the block size doesn't help, so it's limited to the block size.
+		//Without compressor options, the kernel expects the dictionary size to be the block size.
+		xz.DictionarySize = int32(w.BlockSize)
+		if w.xzDictionarySize != 0 && w.xzDictionarySize < w.BlockSize {
+			xz.DictionarySize = int32(w.xzDictionarySize)
+		}
+	}
+}
+
 //WriteTo attempts to write the archive to the given io.Writer.
+//
+//Since the superblock at the beginning of the archive is written last, and duplicate files are compared to data that's already written,
+//if write is not both an io.WriteSeeker and an io.ReaderAt (such as an os.File), the archive is first written to a temporary file and then copied to write.
 func (w *Writer) WriteTo(write io.Writer) (int64, error) {
+	return w.write(write, nil)
+}
+
+//write writes the archive to write. If fill isn't nil, it's called before the tree is built so it can add files and write their data.
+func (w *Writer) write(write io.Writer, fill func(*archive) error) (int64, error) {
 	if w.BlockSize > 1048576 {
 		w.BlockSize = 1048576
 	} else if w.BlockSize < 4096 {
 		w.BlockSize = 4096
 	}
-	//TODO: set forced Flag values
-	_ = superblock{
-		Magic:           magic,
-		BlockSize:       w.BlockSize,
-		BlockLog:        uint16(math.Log2(float64(w.BlockSize))),
-		CompressionType: uint16(w.compressionType),
-		Flags:           w.Flags.ToUint(),
-		IDCount:         uint16(len(w.uidGUIDTable)),
-		MajorVersion:    4,
-		MinorVersion:    0,
-	}
-	return 0, errors.New("I SAID DON'T")
+	//BlockSize must be a power of 2.
+	w.BlockSize = 1 << uint32(math.Log2(float64(w.BlockSize)))
+	if f, ok := write.(archiveFile); ok {
+		start, err := f.Seek(0, io.SeekCurrent)
+		if err == nil {
+			return w.writeArchive(f, start, fill)
+		}
+	}
+	tmp, err := os.CreateTemp("", "squashfs")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+	_, err = w.writeArchive(tmp, 0, fill)
+	if err != nil {
+		return 0, err
+	}
+	_, err = tmp.Seek(0, io.SeekStart)
+	if err != nil {
+		return 0, err
+	}
+	return io.Copy(write, tmp)
+}
+
+//writeArchive writes the archive to f, which is at start. Once everything else is written, f is seeked back to start to write the superblock.
+func (w *Writer) writeArchive(f archiveFile, start int64, fill func(*archive) error) (int64, error) {
+	w.setXzDictionary()
+	out := &archiveWriter{
+		f:     f,
+		start: start,
+	}
+	//placeholder for the superblock
+	_, err := out.Write(make([]byte, binary.Size(superblock{})))
+	if err != nil {
+		return 0, err
+	}
+	options := w.compressorOptions()
+	if options != nil {
+		//The options are written as an uncompressed metadata block.
+		var block []byte
+		block, err = w.metadataBlock(options, true)
+		if err != nil {
+			return 0, err
+		}
+		_, err = out.Write(block)
+		if err != nil {
+			return 0, err
+		}
+	}
+	return w.finishArchive(out, options, fill)
+}
+
+//finishArchive writes everything after the superblock and compressor options to out, followed by the superblock at the start of the archive.
+//options are the compressor options that are in the archive.
+func (w *Writer) finishArchive(out *archiveWriter, options []byte, fill func(*archive) error) (int64, error) {
+	a := &archive{
+		w:       w,
+		out:     out,
+		pipe:    w.newBlockPipeline(out),
+		written: make(map[*fileHolder]*writeEntry),
+		sources: make(map[*Reader]*rawSource),
+		options: options,
+	}
+	defer a.pipe.close()
+	a.frags = w.newFragmentWriter(out)
+	a.dups = newDuplicateFinder(out, a.frags)
+	if fill != nil {
+		err := fill(a)
+		if err != nil {
+			return 0, err
+		}
+	}
+	root, err := w.buildTree(a.written)
+	if err != nil {
+		return 0, err
+	}
+	//Data that's kept in place is done first, so new files with the same content can use it.
+	err = root.walk(func(ent *writeEntry) error {
+		if !ent.hasData() || ent.holder.raw == nil {
+			return nil
+		}
+		if src := a.sources[ent.holder.raw.rdr]; src != nil && src.inPlace {
+			return a.copyRawData(ent, src)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	err = root.walk(func(ent *writeEntry) error {
+		if !ent.hasData() || a.written[ent.holder] != nil {
+			return nil
+		}
+		if ent.holder.raw != nil {
+			src, err := a.source(ent.holder.raw.rdr)
+			if err != nil {
+				return err
+			}
+			if src.inPlace {
+				return nil
+			}
+			if src.copy {
+				return a.copyRawData(ent, src)
+			}
+		}
+		return w.writeFileData(a.pipe, a.frags, a.dups, ent)
+	})
+	if err != nil {
+		return 0, err
+	}
+	err = a.pipe.flush()
+	if err != nil {
+		return 0, err
+	}
+	err = a.frags.flush()
+	if err != nil {
+		return 0, err
+	}
+	inodeCount := root.numberInodes(1) - 1
+	ids, idTable := w.idTable(root)
+	if len(idTable) > math.MaxUint16 {
+		return 0, errors.New("Too many unique uids and gids")
+	}
+	xattrs := w.newXattrWriter()
+	err = root.walk(func(ent *writeEntry) error {
+		ent.xattrIndex = noXattr
+		if w.Flags.NoXattr || ent.link != nil {
+			return nil
+		}
+		var err error
+		ent.xattrIndex, err = xattrs.add(ent.holder.xattrs)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	now, err := w.creationTime()
+	if err != nil {
+		return 0, err
+	}
+	super := superblock{
+		Magic:            magic,
+		InodeCount:       inodeCount,
+		CreationTime:     uint32(now.Unix()),
+		BlockSize:        w.BlockSize,
+		CompressionType:  uint16(w.compressionType),
+		BlockLog:         uint16(math.Log2(float64(w.BlockSize))),
+		IDCount:          uint16(len(idTable)),
+		MajorVersion:     4,
+		MinorVersion:     0,
+		XattrTableStart:  noXattrTable,
+		ExportTableStart: noExportTable,
+	}
+	flags := w.Flags
+	flags.NoXattr = len(xattrs.ids) == 0
+	flags.compressorOptions = options != nil
+	flags.check = false
+	super.Flags = flags.ToUint()
+	inodes := w.newMetadataWriter(w.Flags.UncompressedInodes)
+	dirTable := w.newMetadataWriter(w.Flags.UncompressedInodes)
+	err = w.writeDir(root, inodes, dirTable, ids, inodeCount, now)
+	if err != nil {
+		return 0, err
+	}
+	super.RootInodeRef = root.inodeRef
+	super.InodeTableStart = out.offset
+	table, err := inodes.Bytes()
+	if err != nil {
+		return 0, err
+	}
+	_, err = out.Write(table)
+	if err != nil {
+		return 0, err
+	}
+	super.DirTableStart = out.offset
+	table, err = dirTable.Bytes()
+	if err != nil {
+		return 0, err
+	}
+	_, err = out.Write(table)
+	if err != nil {
+		return 0, err
+	}
+	super.FragCount = uint32(len(a.frags.entries))
+	super.FragTableStart, err = w.writeLookupTable(out, a.frags.table(), w.Flags.UncompressedFragments)
+	if err != nil {
+		return 0, err
+	}
+	if w.Flags.Exportable {
+		super.ExportTableStart, err = w.writeLookupTable(out, exportTable(root, inodeCount), w.Flags.UncompressedInodes)
+		if err != nil {
+			return 0, err
+		}
+	}
+	idData := make([]byte, 4*len(idTable))
+	for i, id := range idTable {
+		binary.LittleEndian.PutUint32(idData[4*i:], id)
+	}
+	super.IDTableStart, err = w.writeLookupTable(out, idData, w.Flags.UncompressedIDs)
+	if err != nil {
+		return 0, err
+	}
+	if len(xattrs.ids) > 0 {
+		super.XattrTableStart, err = xattrs.writeTable(w, out)
+		if err != nil {
+			return 0, err
+		}
+	}
+	super.BytesUsed = out.offset
+	//The archive is padded to a multiple of 4KB so it can be mounted as a loop device.
+	if out.offset%4096 != 0 {
+		_, err = out.Write(make([]byte, 4096-out.offset%4096))
+		if err != nil {
+			return 0, err
+		}
+	}
+	//Data of a discarded duplicate might be past the end of the archive.
+	if out.end > out.offset {
+		if t, ok := out.f.(interface{ Truncate(int64) error }); ok {
+			err = t.Truncate(out.start + int64(out.offset))
+		} else {
+			_, err = out.f.Write(make([]byte, out.end-out.offset))
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+	_, err = out.f.Seek(out.start, io.SeekStart)
+	if err != nil {
+		return 0, err
+	}
+	err = binary.Write(out.f, binary.LittleEndian, super)
+	if err != nil {
+		return 0, err
+	}
+	_, err = out.f.Seek(out.start+int64(out.offset), io.SeekStart)
+	if err != nil {
+		return 0, err
+	}
+	return int64(out.offset), nil
+}
+
+//idTable returns all the uids and gids used and a map of id to index in the table.
+func (w *Writer) idTable(root *writeEntry) (map[int]uint16, []uint32) {
+	ids := make(map[int]uint16)
+	var idTable []uint32
+	var all []int
+	root.walk(func(ent *writeEntry) error {
+		if ent.link != nil {
+			return nil
+		}
+		uid, gid := w.owner(ent)
+		all = append(all, uid, gid)
+		return nil
+	})
+	sort.Ints(all)
+	for _, id := range all {
+		if _, ok := ids[id]; !ok {
+			ids[id] = uint16(len(idTable))
+			idTable = append(idTable, uint32(id))
+		}
+	}
+	return ids, idTable
+}
+
+//owner returns the uid and gid of the entry. If AllRoot is set, they're always 0.
+func (w *Writer) owner(ent *writeEntry) (int, int) {
+	if w.AllRoot {
+		return 0, 0
+	}
+	return ent.holder.UID, ent.holder.GUID
+}
+
+//creationTime returns CreationTime if it's set, otherwise the time from SOURCE_DATE_EPOCH if it's set, otherwise the current time.
+func (w *Writer) creationTime() (time.Time, error) {
+	if !w.CreationTime.IsZero() {
+		return w.CreationTime, nil
+	}
+	epoch, ok := os.LookupEnv("SOURCE_DATE_EPOCH")
+	if !ok || epoch == "" {
+		return time.Now(), nil
+	}
+	sec, err := strconv.ParseInt(epoch, 10, 64)
+	if err != nil || sec < 0 || sec > math.MaxUint32 {
+		return time.Time{}, errors.New("Invalid SOURCE_DATE_EPOCH " + epoch)
+	}
+	return time.Unix(sec, 0), nil
+}
+
+//writeFileData reads all the data of the entry and adds it to the pipeline as data blocks.
+//Files smaller then the block size are put in a fragment block instead. If Flags.AlwaysFragments is set, the end of larger files are also put in a fragment block.
+func (w *Writer) writeFileData(pipe *blockPipeline, frags *fragmentWriter, dups *duplicateFinder, ent *writeEntry) error {
+	ent.fragIndex = 0xFFFFFFFF
+	err := pipe.add(func() error {
+		ent.blockStart = pipe.out.offset
+		return nil
+	})
+	if err != nil || ent.holder.reader == nil {
+		return err
+	}
+	if closer, ok := ent.holder.reader.(io.Closer); ok {
+		defer closer.Close()
+	}
+	checksum := crc32.NewIEEE()
+	var tail, buf []byte
+	for {
+		//Blocks are held by the pipeline until they're written, so a new buffer is needed for each block.
+		if buf == nil {
+			buf = make([]byte, w.BlockSize)
+		}
+		n, readErr := io.ReadFull(ent.holder.reader, buf)
+		if readErr != nil && readErr != io.EOF && readErr != io.ErrUnexpectedEOF {
+			return readErr
+		}
+		checksum.Write(buf[:n])
+		ent.size += uint64(n)
+		switch {
+		case n == 0:
+		case n < len(buf) && !w.Flags.NoFragments && (w.Flags.AlwaysFragments || ent.size == uint64(n)):
+			tail = buf[:n]
+		case isZeros(buf[:n]):
+			//Blocks of all zeros aren't written and have a size of 0 (sparse).
+			err = pipe.add(func() error {
+				ent.sparse += uint64(n)
+				ent.blockSizes = append(ent.blockSizes, 0)
+				return nil
+			})
+		default:
+			err = pipe.addBlock(buf[:n], w.Flags.UncompressedData, func(size uint32) error {
+				ent.blockSizes = append(ent.blockSizes, size)
+				return nil
+			})
+			buf = nil
+		}
+		if err != nil {
+			return err
+		}
+		if n < int(w.BlockSize) {
+			break
+		}
+	}
+	sum := checksum.Sum32()
+	return pipe.add(func() error {
+		return w.finishFile(pipe.out, frags, dups, ent, sum, tail)
+	})
+}
+
+//finishFile is called once all of the entry's data blocks are written. If Flags.Duplicates is set and the same data has already been written,
+//the written data is discarded and the entry uses the existing data. Otherwise, tail is added to a fragment block.
+func (w *Writer) finishFile(out *archiveWriter, frags *fragmentWriter, dups *duplicateFinder, ent *writeEntry, checksum uint32, tail []byte) error {
+	if w.Flags.Duplicates && ent.size > 0 {
+		dup, err := dups.find(ent, checksum, tail)
+		if err != nil {
+			return err
+		}
+		if dup != nil {
+			err = out.rewind(ent.blockStart)
+			if err != nil {
+				return err
+			}
+			ent.blockStart = dup.blockStart
+			ent.blockSizes = dup.blockSizes
+			ent.sparse = dup.sparse
+			ent.fragIndex = dup.fragIndex
+			ent.fragOffset = dup.fragOffset
+			return nil
+		}
+	}
+	var err error
+	if len(tail) > 0 {
+		ent.fragIndex, ent.fragOffset, err = frags.add(tail)
+		if err != nil {
+			return err
+		}
+	}
+	if w.Flags.Duplicates && ent.size > 0 {
+		dups.add(ent, checksum)
+	}
+	return nil
+}
+
+//writeBlock writes a data or fragment block, compressing it unless uncompressed is set, and returns it's size, as stored in an inode or fragment entry.
+func (w *Writer) writeBlock(out *archiveWriter, data []byte, uncompressed bool) (uint32, error) {
+	compressed := false
+	if !uncompressed {
+		var err error
+		data, compressed, err = w.compressData(data)
+		if err != nil {
+			return 0, err
+		}
+	}
+	_, err := out.Write(data)
+	if err != nil {
+		return 0, err
+	}
+	size := uint32(len(data))
+	if !compressed {
+		size |= 1 << 24
+	}
+	return size, nil
+}
+
+//exportTable returns the export table's data. The export table holds the inode reference of every inode, in order of their inode numbers.
+func exportTable(root *writeEntry, inodeCount uint32) []byte {
+	data := make([]byte, 8*inodeCount)
+	root.walk(func(ent *writeEntry) error {
+		binary.LittleEndian.PutUint64(data[8*(ent.number-1):], ent.inodeRef)
+		return nil
+	})
+	return data
+}
+
+//writeLookupTable writes data as metadata blocks, followed by the location of each block. Returns the location of the first location.
+//This is how the fragment, export, and id tables are stored.
+func (w *Writer) writeLookupTable(out *archiveWriter, data []byte, uncompressed bool) (uint64, error) {
+	locations, err := w.writeMetadataBlocks(out, data, uncompressed)
+	if err != nil {
+		return 0, err
+	}
+	start := out.offset
+	return start, binary.Write(out, binary.LittleEndian, locations)
+}
+
+//writeMetadataBlocks writes data as metadata blocks and returns the location of each block.
+func (w *Writer) writeMetadataBlocks(out *archiveWriter, data []byte, uncompressed bool) ([]uint64, error) {
+	var locations []uint64
+	for len(data) > 0 {
+		size := metadataSize
+		if len(data) < size {
+			size = len(data)
+		}
+		block, err := w.metadataBlock(data[:size], uncompressed)
+		if err != nil {
+			return nil, err
+		}
+		locations = append(locations, out.offset)
+		_, err = out.Write(block)
+		if err != nil {
+			return nil, err
+		}
+		data = data[size:]
+	}
+	return locations, nil
+}
+
+//writeDir writes the inodes of all the folder's children (recursively), then the folder's directory listing and inode.
+func (w *Writer) writeDir(dir *writeEntry, inodes, dirTable *metadataWriter, ids map[int]uint16, inodeCount uint32, now time.Time) error {
+	hardLinks := uint32(2)
+	for _, child := range dir.children {
+		var err error
+		switch {
+		case child.link != nil:
+			if !child.link.inodeDone {
+				err = w.writeInode(child.link, inodes, ids, now)
+			}
+			child.inodeRef = child.link.inodeRef
+			child.number = child.link.number
+		case child.holder.folder:
+			hardLinks++
+			err = w.writeDir(child, inodes, dirTable, ids, inodeCount, now)
+		case !child.inodeDone:
+			err = w.writeInode(child, inodes, ids, now)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	start, size, indexes, err := w.writeDirListing(dir, dirTable)
+	if err != nil {
+		return err
+	}
+	dir.inodeRef = inodes.position()
+	if len(indexes) == 0 && size <= math.MaxUint16 && dir.xattrIndex == noXattr {
+		return binary.Write(inodes, binary.LittleEndian, struct {
+			inode.Header
+			inode.Dir
+		}{
+			w.inodeHeader(dir, inode.DirType, ids, now),
+			inode.Dir{
+				DirectoryIndex:    uint32(start >> 16),
+				HardLinks:         hardLinks,
+				DirectorySize:     uint16(size),
+				DirectoryOffset:   uint16(start),
+				ParentInodeNumber: dir.parentNumber(inodeCount),
+			},
+		})
+	}
+	err = binary.Write(inodes, binary.LittleEndian, struct {
+		inode.Header
+		inode.ExtDirInit
+	}{
+		w.inodeHeader(dir, inode.ExtDirType, ids, now),
+		inode.ExtDirInit{
+			HardLinks:         hardLinks,
+			DirectorySize:     size,
+			DirectoryIndex:    uint32(start >> 16),
+			ParentInodeNumber: dir.parentNumber(inodeCount),
+			IndexCount:        uint16(len(indexes)),
+			DirectoryOffset:   uint16(start),
+			XattrIndex:        dir.xattrIndex,
+		},
+	})
+	if err != nil {
+		return err
+	}
+	for _, index := range indexes {
+		err = binary.Write(inodes, binary.LittleEndian, index.DirIndexInit)
+		if err != nil {
+			return err
+		}
+		_, err = inodes.Write([]byte(index.Name))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//writeDirListing writes the folder's directory listing. Returns where the listing starts (in the same format as an inode reference),
+//it's size (as stored in the inode), and the indexes for an extended directory inode.
+func (w *Writer) writeDirListing(dir *writeEntry, dirTable *metadataWriter) (start uint64, size uint32, indexes []inode.DirIndex, err error) {
+	start = dirTable.position()
+	lastBlock := start >> 16
+	for i := 0; i < len(dir.children); {
+		first := dir.children[i]
+		//A header can have up to 256 entries whose inodes are in the same metadata block and whose inode numbers are close to the header's.
+		end := i + 1
+		for end < len(dir.children) && end-i < 256 {
+			ent := dir.children[end]
+			diff := int64(ent.number) - int64(first.number)
+			if ent.inodeRef>>16 != first.inodeRef>>16 || diff > math.MaxInt16 || diff < math.MinInt16 {
+				break
+			}
+			end++
+		}
+		//An index is made for every header that starts in a new metadata block.
+		if pos := dirTable.position(); pos>>16 != lastBlock {
+			lastBlock = pos >> 16
+			indexes = append(indexes, inode.DirIndex{
+				Name: first.holder.name,
+				DirIndexInit: inode.DirIndexInit{
+					Offset:         size,
+					DirTableOffset: uint32(lastBlock),
+					NameSize:       uint32(len(first.holder.name) - 1),
+				},
+			})
+		}
+		hdr := directory.Header{
+			Count:       uint32(end - i - 1),
+			InodeOffset: uint32(first.inodeRef >> 16),
+			InodeNumber: first.number,
+		}
+		err = binary.Write(dirTable, binary.LittleEndian, hdr)
+		if err != nil {
+			return
+		}
+		size += uint32(binary.Size(hdr))
+		for _, ent := range dir.children[i:end] {
+			raw := directory.EntryRaw{
+				Offset:      uint16(ent.inodeRef),
+				InodeOffset: int16(int64(ent.number) - int64(first.number)),
+				Type:        uint16(ent.basicType()),
+				NameSize:    uint16(len(ent.holder.name) - 1),
+			}
+			err = binary.Write(dirTable, binary.LittleEndian, raw)
+			if err != nil {
+				return
+			}
+			_, err = dirTable.Write([]byte(ent.holder.name))
+			if err != nil {
+				return
+			}
+			size += uint32(binary.Size(raw) + len(ent.holder.name))
+		}
+		i = end
+	}
+	//The size stored in the inode is 3 bytes larger then the actual listing.
+	size += 3
+	return
+}
+
+//inodeHeader creates the header for the entry's inode.
+func (w *Writer) inodeHeader(ent *writeEntry, inodeType int, ids map[int]uint16, now time.Time) inode.Header {
+	modTime := ent.holder.modTime
+	if modTime.IsZero() || (w.ClampModTimes && modTime.After(now)) {
+		modTime = now
+	}
+	uid, gid := w.owner(ent)
+	return inode.Header{
+		InodeType:    uint16(inodeType),
+		Permissions:  uint16(ent.holder.perm),
+		UID:          ids[uid],
+		GID:          ids[gid],
+		ModifiedTime: uint32(modTime.Unix()),
+		Number:       ent.number,
+	}
+}
+
+//writeInode writes the inode for anything other then a folder.
+func (w *Writer) writeInode(ent *writeEntry, inodes *metadataWriter, ids map[int]uint16, now time.Time) error {
+	ent.inodeRef = inodes.position()
+	ent.inodeDone = true
+	if ent.holder.special != 0 {
+		return w.writeSpecialInode(ent, inodes, ids, now)
+	}
+	if ent.holder.symlink {
+		symType := inode.SymType
+		if ent.xattrIndex != noXattr {
+			symType = inode.ExtSymType
+		}
+		//SymInit and ExtSymInit are the same. Extended symlinks have the xattr index after the target path.
+		err := binary.Write(inodes, binary.LittleEndian, struct {
+			inode.Header
+			inode.SymInit
+		}{
+			w.inodeHeader(ent, symType, ids, now),
+			inode.SymInit{
+				HardLinks:      ent.hardLinks,
+				TargetPathSize: uint32(len(ent.holder.symLocation)),
+			},
+		})
+		if err != nil {
+			return err
+		}
+		_, err = inodes.Write([]byte(ent.holder.symLocation))
+		if err != nil || symType == inode.SymType {
+			return err
+		}
+		return binary.Write(inodes, binary.LittleEndian, ent.xattrIndex)
+	}
+	var err error
+	if ent.blockStart <= math.MaxUint32 && ent.size <= math.MaxUint32 && ent.sparse == 0 && ent.xattrIndex == noXattr && ent.hardLinks == 1 {
+		err = binary.Write(inodes, binary.LittleEndian, struct {
+			inode.Header
+			inode.FileInit
+		}{
+			w.inodeHeader(ent, inode.FileType, ids, now),
+			inode.FileInit{
+				BlockStart:     uint32(ent.blockStart),
+				FragmentIndex:  ent.fragIndex,
+				FragmentOffset: ent.fragOffset,
+				Size:           uint32(ent.size),
+			},
+		})
+	} else {
+		err = binary.Write(inodes, binary.LittleEndian, struct {
+			inode.Header
+			inode.ExtFileInit
+		}{
+			w.inodeHeader(ent, inode.ExtFileType, ids, now),
+			inode.ExtFileInit{
+				BlockStart:     ent.blockStart,
+				Size:           ent.size,
+				Sparse:         ent.sparse,
+				HardLinks:      ent.hardLinks,
+				FragmentIndex:  ent.fragIndex,
+				FragmentOffset: ent.fragOffset,
+				XattrIndex:     ent.xattrIndex,
+			},
+		})
+	}
+	if err != nil {
+		return err
+	}
+	return binary.Write(inodes, binary.LittleEndian, ent.blockSizes)
+}
+
+//writeSpecialInode writes the inode for a device, FIFO, or socket.
+func (w *Writer) writeSpecialInode(ent *writeEntry, inodes *metadataWriter, ids map[int]uint16, now time.Time) error {
+	inodeType := ent.basicType()
+	if ent.xattrIndex != noXattr {
+		//The extended types are the basic types plus 7.
+		inodeType += inode.ExtDirType - inode.DirType
+	}
+	header := w.inodeHeader(ent, inodeType, ids, now)
+	var info interface{}
+	switch inodeType {
+	case inode.BlockDevType, inode.CharDevType:
+		info = inode.Device{
+			HardLinks: ent.hardLinks,
+			Device:    ent.holder.rdev,
+		}
+	case inode.ExtBlockDeviceType, inode.ExtCharDeviceType:
+		info = inode.ExtDevice{
+			Device: inode.Device{
+				HardLinks: ent.hardLinks,
+				Device:    ent.holder.rdev,
+			},
+			XattrIndex: ent.xattrIndex,
+		}
+	case inode.FifoType, inode.SocketType:
+		info = inode.IPC{
+			HardLink: ent.hardLinks,
+		}
+	default:
+		info = inode.ExtIPC{
+			IPC: inode.IPC{
+				HardLink: ent.hardLinks,
+			},
+			XattrIndex: ent.xattrIndex,
+		}
+	}
+	err := binary.Write(inodes, binary.LittleEndian, header)
+	if err != nil {
+		return err
+	}
+	return binary.Write(inodes, binary.LittleEndian, info)
 }
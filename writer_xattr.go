@@ -0,0 +1,164 @@
+package squashfs
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"path"
+	"sort"
+	"strings"
+)
+
+//xattrWriter writes the xattr key/value pairs. Each unique set of xattrs is only written once and values that are
+//already written are stored out of line (as a reference to the existing value).
+type xattrWriter struct {
+	kv     *metadataWriter
+	ids    []xattrID
+	sets   map[string]uint32 //The index of each set of xattrs that's been written. Keyed by xattrSetKey.
+	values map[string]uint64 //Where each value has been written.
+}
+
+func (w *Writer) newXattrWriter() *xattrWriter {
+	return &xattrWriter{
+		kv:     w.newMetadataWriter(w.Flags.UncompressedXattr),
+		sets:   make(map[string]uint32),
+		values: make(map[string]uint64),
+	}
+}
+
+//xattrPrefix returns the index of the name's prefix in xattrPrefixes, and the name without the prefix.
+func xattrPrefix(name string) (int, string, bool) {
+	for i, prefix := range xattrPrefixes {
+		if strings.HasPrefix(name, prefix) {
+			return i, strings.TrimPrefix(name, prefix), true
+		}
+	}
+	return 0, "", false
+}
+
+//xattrSetKey returns a string that's the same for any set of xattrs with the same names and values.
+func xattrSetKey(names []string, xattrs map[string][]byte) string {
+	var key bytes.Buffer
+	for _, name := range names {
+		binary.Write(&key, binary.LittleEndian, uint32(len(name)))
+		key.WriteString(name)
+		binary.Write(&key, binary.LittleEndian, uint32(len(xattrs[name])))
+		key.Write(xattrs[name])
+	}
+	return key.String()
+}
+
+//add writes the xattrs, if the same set of xattrs hasn't already been written, and returns their index in the xattr id table.
+//If there are no xattrs, noXattr is returned.
+func (x *xattrWriter) add(xattrs map[string][]byte) (uint32, error) {
+	if len(xattrs) == 0 {
+		return noXattr, nil
+	}
+	names := make([]string, 0, len(xattrs))
+	for name := range xattrs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	setKey := xattrSetKey(names, xattrs)
+	if index, ok := x.sets[setKey]; ok {
+		return index, nil
+	}
+	id := xattrID{
+		Ref:   x.kv.position(),
+		Count: uint32(len(names)),
+	}
+	var buf bytes.Buffer
+	for _, name := range names {
+		prefix, shortName, ok := xattrPrefix(name)
+		if !ok {
+			return 0, errors.New("Unsupported xattr " + name)
+		}
+		value := xattrs[name]
+		key := xattrKeyInit{
+			Type:     uint16(prefix),
+			NameSize: uint16(len(shortName)),
+		}
+		//A reference is 8 bytes, so only larger values are stored out of line.
+		valueRef, written := x.values[string(value)]
+		if written && len(value) > 8 {
+			key.Type |= xattrOutOfLine
+		}
+		buf.Reset()
+		binary.Write(&buf, binary.LittleEndian, key)
+		buf.WriteString(shortName)
+		_, err := x.kv.Write(buf.Bytes())
+		if err != nil {
+			return 0, err
+		}
+		id.Size += uint32(buf.Len())
+		buf.Reset()
+		if key.Type&xattrOutOfLine == xattrOutOfLine {
+			binary.Write(&buf, binary.LittleEndian, uint32(8))
+			binary.Write(&buf, binary.LittleEndian, valueRef)
+		} else {
+			if !written {
+				x.values[string(value)] = x.kv.position()
+			}
+			binary.Write(&buf, binary.LittleEndian, uint32(len(value)))
+			buf.Write(value)
+		}
+		_, err = x.kv.Write(buf.Bytes())
+		if err != nil {
+			return 0, err
+		}
+		id.Size += uint32(buf.Len())
+	}
+	index := uint32(len(x.ids))
+	x.ids = append(x.ids, id)
+	x.sets[setKey] = index
+	return index, nil
+}
+
+//writeTable writes the key/value pairs, the xattr id table, and the xattr table's header. Returns the location of the header.
+func (x *xattrWriter) writeTable(w *Writer, out *archiveWriter) (uint64, error) {
+	header := xattrTableHeader{
+		KeyValueStart: out.offset,
+		IDCount:       uint32(len(x.ids)),
+	}
+	kv, err := x.kv.Bytes()
+	if err != nil {
+		return 0, err
+	}
+	_, err = out.Write(kv)
+	if err != nil {
+		return 0, err
+	}
+	var ids bytes.Buffer
+	binary.Write(&ids, binary.LittleEndian, x.ids)
+	locations, err := w.writeMetadataBlocks(out, ids.Bytes(), w.Flags.UncompressedXattr)
+	if err != nil {
+		return 0, err
+	}
+	start := out.offset
+	err = binary.Write(out, binary.LittleEndian, header)
+	if err != nil {
+		return 0, err
+	}
+	return start, binary.Write(out, binary.LittleEndian, locations)
+}
+
+//SetXattrs sets the extended attributes of the file or folder at the given filepath, replacing any it already has.
+//The names must include one of the prefixes supported by squashfs ("user.", "trusted.", or "security.").
+//
+//Files added with AddFileTo already have their xattrs (on Linux).
+func (w *Writer) SetXattrs(filepath string, xattrs map[string][]byte) error {
+	holder := w.holderAt(filepath)
+	if holder == nil {
+		return errors.New("No file at " + path.Clean(filepath))
+	}
+	for name := range xattrs {
+		if _, _, ok := xattrPrefix(name); !ok {
+			return errors.New("Unsupported xattr " + name)
+		}
+	}
+	holder.xattrs = make(map[string][]byte, len(xattrs))
+	for name, value := range xattrs {
+		holder.xattrs[name] = append([]byte{}, value...)
+	}
+	return nil
+}
@@ -0,0 +1,256 @@
+package squashfs
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/CalebQ42/squashfs/internal/inode"
+)
+
+//The prefixes of xattr names. The index in the slice is the type stored in the archive.
+var xattrPrefixes = []string{
+	"user.",
+	"trusted.",
+	"security.",
+}
+
+const (
+	//xattrOutOfLine is set on an xattr's type if the value is stored elsewhere and only a reference to it is stored.
+	xattrOutOfLine = 0x100
+	//noXattr is the xattr index used by inodes without xattrs.
+	noXattr = 0xFFFFFFFF
+	//noXattrTable is the XattrTableStart value when there is no xattr table.
+	noXattrTable = 0xFFFFFFFFFFFFFFFF
+)
+
+var (
+	//ErrXattrNotFound is returned by File.GetXattr when the file doesn't have the requested xattr.
+	ErrXattrNotFound = errors.New("Xattr not found")
+)
+
+//xattrTableHeader is at XattrTableStart and gives the locations of the metadata blocks holding the xattr ids.
+type xattrTableHeader struct {
+	KeyValueStart uint64
+	IDCount       uint32
+	_             uint32
+}
+
+//xattrID is an entry in the xattr id table. An inode's XattrIndex is an index into the table.
+type xattrID struct {
+	Ref   uint64 //Location of the first key, relative to KeyValueStart. Same format as an inode reference.
+	Count uint32 //How many key/value pairs there are
+	Size  uint32 //Total size of the key/values
+}
+
+//xattrKeyInit is the part of a key that can be easily decoded. Followed by the name.
+type xattrKeyInit struct {
+	Type     uint16
+	NameSize uint16
+}
+
+//readXattrTable reads the xattr table's header and the locations of the id blocks.
+func (r *Reader) readXattrTable() error {
+	if r.super.XattrTableStart == noXattrTable {
+		return nil
+	}
+	err := binary.Read(io.NewSectionReader(r.r, int64(r.super.XattrTableStart), int64(binary.Size(r.xattrHeader))), binary.LittleEndian, &r.xattrHeader)
+	if err != nil {
+		return err
+	}
+	r.xattrOffsets = make([]uint64, int(math.Ceil(float64(r.xattrHeader.IDCount)/512)))
+	return binary.Read(io.NewSectionReader(r.r, int64(r.super.XattrTableStart)+int64(binary.Size(r.xattrHeader)), int64(8*len(r.xattrOffsets))), binary.LittleEndian, &r.xattrOffsets)
+}
+
+//getXattrID returns the xattr id entry at the given index.
+func (r *Reader) getXattrID(index uint32) (xattrID, error) {
+	var id xattrID
+	if index >= r.xattrHeader.IDCount {
+		return id, errors.New("Xattr index out of range")
+	}
+	rdr, err := r.newMetadataReader(int64(r.xattrOffsets[index/512]))
+	if err != nil {
+		return id, err
+	}
+	_, err = rdr.Seek(int64(16*(index%512)), io.SeekStart)
+	if err != nil {
+		return id, err
+	}
+	err = binary.Read(rdr, binary.LittleEndian, &id)
+	return id, err
+}
+
+//newXattrReader returns a metadataReader at the given reference inside the xattr key/value table.
+func (r *Reader) newXattrReader(ref uint64) (*metadataReader, error) {
+	offset, metaOffset := processInodeRef(ref)
+	rdr, err := r.newMetadataReader(int64(r.xattrHeader.KeyValueStart + offset))
+	if err != nil {
+		return nil, err
+	}
+	_, err = rdr.Seek(int64(metaOffset), io.SeekStart)
+	if err != nil {
+		return nil, err
+	}
+	return rdr, nil
+}
+
+//readXattrs reads all the key/value pairs for the given xattr index.
+func (r *Reader) readXattrs(index uint32) (map[string][]byte, error) {
+	out := make(map[string][]byte)
+	if index == noXattr || r.super.XattrTableStart == noXattrTable {
+		return out, nil
+	}
+	id, err := r.getXattrID(index)
+	if err != nil {
+		return nil, err
+	}
+	rdr, err := r.newXattrReader(id.Ref)
+	if err != nil {
+		return nil, err
+	}
+	for i := uint32(0); i < id.Count; i++ {
+		var key xattrKeyInit
+		err = binary.Read(rdr, binary.LittleEndian, &key)
+		if err != nil {
+			return nil, err
+		}
+		name := make([]byte, key.NameSize)
+		_, err = io.ReadFull(rdr, name)
+		if err != nil {
+			return nil, err
+		}
+		prefix := key.Type &^ xattrOutOfLine
+		if int(prefix) >= len(xattrPrefixes) {
+			return nil, errors.New("Unknown xattr prefix")
+		}
+		var value []byte
+		value, err = readXattrValue(rdr)
+		if err != nil {
+			return nil, err
+		}
+		if key.Type&xattrOutOfLine == xattrOutOfLine {
+			if len(value) != 8 {
+				return nil, errors.New("Out of line xattr value has a bad reference")
+			}
+			var valRdr *metadataReader
+			valRdr, err = r.newXattrReader(binary.LittleEndian.Uint64(value))
+			if err != nil {
+				return nil, err
+			}
+			value, err = readXattrValue(valRdr)
+			if err != nil {
+				return nil, err
+			}
+		}
+		out[xattrPrefixes[prefix]+string(name)] = value
+	}
+	return out, nil
+}
+
+//readXattrValue reads a value's size and then the value itself.
+func readXattrValue(rdr io.Reader) ([]byte, error) {
+	var size uint32
+	err := binary.Read(rdr, binary.LittleEndian, &size)
+	if err != nil {
+		return nil, err
+	}
+	value := make([]byte, size)
+	_, err = io.ReadFull(rdr, value)
+	if err != nil {
+		return nil, err
+	}
+	return value, nil
+}
+
+//xattrIndex returns the inode's index into the xattr id table. Only extended inodes can have xattrs.
+func xattrIndex(in *inode.Inode) uint32 {
+	switch in.Type {
+	case inode.ExtDirType:
+		return in.Info.(inode.ExtDir).XattrIndex
+	case inode.ExtFileType:
+		return in.Info.(inode.ExtFile).XattrIndex
+	case inode.ExtSymType:
+		return in.Info.(inode.ExtSym).XattrIndex
+	case inode.ExtBlockDeviceType, inode.ExtCharDeviceType:
+		return in.Info.(inode.ExtDevice).XattrIndex
+	case inode.ExtFifoType, inode.ExtSocketType:
+		return in.Info.(inode.ExtIPC).XattrIndex
+	default:
+		return noXattr
+	}
+}
+
+//Xattrs returns all of the File's extended attributes. The keys are the full names, including prefix (such as "security.capability").
+//If the File has no extended attributes, an empty map is returned.
+func (f *File) Xattrs() (map[string][]byte, error) {
+	if f.r == nil {
+		return nil, errNotReading
+	}
+	in, err := f.getInode()
+	if err != nil {
+		return nil, err
+	}
+	return f.r.readXattrs(xattrIndex(in))
+}
+
+//GetXattr returns the value of the extended attribute with the given name (including prefix, such as "user.comment").
+//If the File doesn't have it, ErrXattrNotFound is returned.
+func (f *File) GetXattr(name string) ([]byte, error) {
+	xattrs, err := f.Xattrs()
+	if err != nil {
+		return nil, err
+	}
+	value, ok := xattrs[name]
+	if !ok {
+		return nil, ErrXattrNotFound
+	}
+	return value, nil
+}
+
+//xattrAllowed returns if the xattr with the given name is matched by the namespaces. Empty namespaces matches everything.
+func xattrAllowed(name string, namespaces []string) bool {
+	if len(namespaces) == 0 {
+		return true
+	}
+	for _, ns := range namespaces {
+		if name == ns || strings.HasPrefix(name, strings.TrimSuffix(ns, ".")+".") {
+			return true
+		}
+	}
+	return false
+}
+
+//setXattrs sets the File's xattrs on the extracted file at path. Symlinks are not followed.
+func (f *File) setXattrs(path string, op ExtractionOptions) (errs []error) {
+	xattrs, err := f.Xattrs()
+	if err != nil {
+		if op.Verbose {
+			fmt.Println("Error while reading xattrs for:", f.Path())
+			fmt.Println(err)
+		}
+		return []error{err}
+	}
+	names := make([]string, 0, len(xattrs))
+	for name := range xattrs {
+		if xattrAllowed(name, op.XattrNamespaces) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		err = lsetxattr(path, name, xattrs[name])
+		if err != nil {
+			if op.Verbose {
+				fmt.Println("Error while setting xattr", name, "for:", path)
+				fmt.Println(err)
+			}
+			errs = append(errs, &os.PathError{Op: "setxattr " + name, Path: path, Err: err})
+		}
+	}
+	return
+}
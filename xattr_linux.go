@@ -0,0 +1,100 @@
+//go:build linux
+// +build linux
+
+package squashfs
+
+import (
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+//lsetxattr sets the xattr on the file at path. If path is a symlink, the xattr is set on the symlink itself.
+func lsetxattr(path, name string, value []byte) error {
+	pathPtr, err := syscall.BytePtrFromString(path)
+	if err != nil {
+		return err
+	}
+	namePtr, err := syscall.BytePtrFromString(name)
+	if err != nil {
+		return err
+	}
+	_, _, errno := syscall.Syscall6(syscall.SYS_LSETXATTR, uintptr(unsafe.Pointer(pathPtr)), uintptr(unsafe.Pointer(namePtr)), uintptr(bufPointer(value)), uintptr(len(value)), 0, 0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+//lgetxattrs returns all of the xattrs of the file at path. If path is a symlink, the symlink's own xattrs are returned.
+//If the filesystem doesn't support xattrs, no xattrs are returned.
+func lgetxattrs(path string) (map[string][]byte, error) {
+	pathPtr, err := syscall.BytePtrFromString(path)
+	if err != nil {
+		return nil, err
+	}
+	names, err := sizedXattrCall(func(buf []byte) (uintptr, syscall.Errno) {
+		size, _, errno := syscall.Syscall(syscall.SYS_LLISTXATTR, uintptr(unsafe.Pointer(pathPtr)), uintptr(bufPointer(buf)), uintptr(len(buf)))
+		return size, errno
+	})
+	if err == syscall.ENOTSUP {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	out := make(map[string][]byte)
+	//names is a list of null terminated names.
+	for _, name := range strings.Split(string(names), "\x00") {
+		if name == "" {
+			continue
+		}
+		var namePtr *byte
+		namePtr, err = syscall.BytePtrFromString(name)
+		if err != nil {
+			return nil, err
+		}
+		var value []byte
+		value, err = sizedXattrCall(func(buf []byte) (uintptr, syscall.Errno) {
+			size, _, errno := syscall.Syscall6(syscall.SYS_LGETXATTR, uintptr(unsafe.Pointer(pathPtr)), uintptr(unsafe.Pointer(namePtr)), uintptr(bufPointer(buf)), uintptr(len(buf)), 0, 0)
+			return size, errno
+		})
+		if err == syscall.ENODATA {
+			//removed since it was listed
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		out[name] = value
+	}
+	return out, nil
+}
+
+//sizedXattrCall calls a listxattr or getxattr syscall, first to get the size of the data, then to get the data itself.
+func sizedXattrCall(call func(buf []byte) (uintptr, syscall.Errno)) ([]byte, error) {
+	for {
+		size, errno := call(nil)
+		if errno != 0 {
+			return nil, errno
+		}
+		buf := make([]byte, size)
+		if size == 0 {
+			return buf, nil
+		}
+		size, errno = call(buf)
+		if errno == syscall.ERANGE {
+			//The data got larger between calls.
+			continue
+		} else if errno != 0 {
+			return nil, errno
+		}
+		return buf[:size], nil
+	}
+}
+
+//bufPointer returns a pointer to the start of buf, or nil if buf is empty.
+func bufPointer(buf []byte) unsafe.Pointer {
+	if len(buf) == 0 {
+		return nil
+	}
+	return unsafe.Pointer(&buf[0])
+}
@@ -0,0 +1,18 @@
+//go:build !linux
+// +build !linux
+
+package squashfs
+
+import "errors"
+
+//errXattrUnsupported is returned when trying to set xattrs on a platform that isn't supported.
+var errXattrUnsupported = errors.New("Setting xattrs is only supported on Linux")
+
+func lsetxattr(path, name string, value []byte) error {
+	return errXattrUnsupported
+}
+
+//lgetxattrs returns the xattrs of the file at path. Xattrs are only read on Linux, so no xattrs are returned.
+func lgetxattrs(path string) (map[string][]byte, error) {
+	return nil, nil
+}